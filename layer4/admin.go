@@ -0,0 +1,278 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminConnections{})
+}
+
+// adminConnections is a module that provides the /layer4/connections endpoint
+// for the Caddy admin API. It lists the connections currently handled by layer4
+// servers and listener wrappers, and allows for closing them forcibly.
+type adminConnections struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminConnections) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.layer4",
+		New: func() caddy.Module { return new(adminConnections) },
+	}
+}
+
+// Routes returns the routes for the /layer4/connections endpoint.
+func (ac adminConnections) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminConnectionsPath,
+			Handler: caddy.AdminHandlerFunc(ac.handleConnections),
+		},
+		{
+			Pattern: adminConnectionsPath + "/",
+			Handler: caddy.AdminHandlerFunc(ac.handleConnections),
+		},
+	}
+}
+
+// handleConnections lists active connections on GET, and closes them on DELETE.
+// Both methods accept optional `server` and `remote` query parameters to filter
+// connections by server name and by remote address, IP or CIDR. A single
+// connection may also be selected by ID with the /layer4/connections/<id> path.
+// DELETE requires a filter, unless `all=true` is given to close every connection.
+func (adminConnections) handleConnections(w http.ResponseWriter, r *http.Request) error {
+	filter, err := newConnFilter(r)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+
+	if r.Method == http.MethodDelete && filter.empty() && r.URL.Query().Get("all") != "true" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("closing connections requires a connection ID, a filter or all=true"),
+		}
+	}
+
+	entries := activeConns.list(filter)
+	if filter.id != "" && len(entries) == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("connection %s not found", filter.id),
+		}
+	}
+
+	var result any
+	switch r.Method {
+	case http.MethodGet:
+		statuses := make([]connStatus, 0, len(entries))
+		for _, e := range entries {
+			statuses = append(statuses, e.status())
+		}
+		result = statuses
+	case http.MethodDelete:
+		for _, e := range entries {
+			e.cx.repl.Set(connCloseReasonReplKey, closeReasonAdmin)
+			forceClose(e.cx.Conn)
+		}
+		result = map[string]int{"closed": len(entries)}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// connFilter selects connections in the registry.
+type connFilter struct {
+	id     string
+	server string
+	remote string
+	prefix netip.Prefix
+}
+
+// newConnFilter parses the connection ID from the path of r, and other criteria from its query.
+func newConnFilter(r *http.Request) (*connFilter, error) {
+	f := &connFilter{server: r.URL.Query().Get("server")}
+
+	f.id = strings.Trim(strings.TrimPrefix(r.URL.Path, adminConnectionsPath), "/")
+	if strings.Contains(f.id, "/") {
+		return nil, fmt.Errorf("invalid connection ID: %s", f.id)
+	}
+
+	if f.remote = r.URL.Query().Get("remote"); f.remote != "" {
+		if prefix, err := netip.ParsePrefix(f.remote); err == nil {
+			f.prefix = prefix.Masked()
+		} else if ip, err := netip.ParseAddr(f.remote); err == nil {
+			f.prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		} else if _, err = netip.ParseAddrPort(f.remote); err != nil {
+			return nil, fmt.Errorf("invalid remote address: %s", f.remote)
+		}
+	}
+
+	return f, nil
+}
+
+// empty returns true if f has no criteria, i.e. it matches every connection.
+func (f *connFilter) empty() bool {
+	return f.id == "" && f.server == "" && f.remote == ""
+}
+
+// matches returns true if e satisfies all criteria of f.
+func (f *connFilter) matches(e *connEntry) bool {
+	if f.id != "" && e.id != f.id {
+		return false
+	}
+	if f.server != "" && e.server != f.server {
+		return false
+	}
+	if f.remote != "" {
+		if f.prefix.IsValid() {
+			ip, ok := remoteIP(e.cx.RemoteAddr())
+			return ok && f.prefix.Contains(ip)
+		}
+		return e.cx.RemoteAddr().String() == f.remote
+	}
+	return true
+}
+
+// connRegistry keeps track of the connections currently
+// handled by layer4 servers and listener wrappers.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*connEntry
+}
+
+// connEntry is a connection in a connRegistry.
+type connEntry struct {
+	id       string
+	server   string
+	listener string
+	start    time.Time
+	cx       *Connection
+}
+
+// connStatus is the status of a connection reported by the admin API.
+type connStatus struct {
+	ID           string    `json:"id"`
+	Server       string    `json:"server,omitempty"`
+	Listener     string    `json:"listener"`
+	Network      string    `json:"network"`
+	Local        string    `json:"local"`
+	Remote       string    `json:"remote"`
+	Route        string    `json:"route,omitempty"`
+	Upstream     string    `json:"upstream,omitempty"`
+	Started      time.Time `json:"started"`
+	Age          string    `json:"age"`
+	BytesRead    uint64    `json:"bytes_read"`
+	BytesWritten uint64    `json:"bytes_written"`
+}
+
+// activeConns is the registry of the connections handled by this process.
+var activeConns = &connRegistry{conns: make(map[string]*connEntry)}
+
+// add registers cx as handled by the given server (empty for listener wrappers) on the given listener.
+func (r *connRegistry) add(cx *Connection, server, listener string) *connEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e := &connEntry{
+		id:       cx.id,
+		server:   server,
+		listener: listener,
+		start:    time.Now(),
+		cx:       cx,
+	}
+	r.conns[e.id] = e
+	return e
+}
+
+// remove unregisters e.
+func (r *connRegistry) remove(e *connEntry) {
+	r.mu.Lock()
+	delete(r.conns, e.id)
+	r.mu.Unlock()
+}
+
+// list returns the entries matched by f, ordered by start time.
+func (r *connRegistry) list(f *connFilter) []*connEntry {
+	r.mu.Lock()
+	entries := make([]*connEntry, 0, len(r.conns))
+	for _, e := range r.conns {
+		if f.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b *connEntry) int {
+		return cmp.Or(a.start.Compare(b.start), cmp.Compare(a.id, b.id))
+	})
+	return entries
+}
+
+// status returns the current status of e.
+func (e *connEntry) status() connStatus {
+	route, _ := e.cx.repl.GetString(routeNameReplKey)
+	upstream, _ := e.cx.repl.GetString(ProxyUpstreamReplKey)
+	return connStatus{
+		ID:           e.id,
+		Server:       e.server,
+		Listener:     e.listener,
+		Network:      e.cx.LocalAddr().Network(),
+		Local:        e.cx.LocalAddr().String(),
+		Remote:       e.cx.RemoteAddr().String(),
+		Route:        route,
+		Upstream:     upstream,
+		Started:      e.start.UTC(),
+		Age:          time.Since(e.start).Round(time.Millisecond).String(),
+		BytesRead:    e.cx.bytesRead.Load(),
+		BytesWritten: e.cx.bytesWritten.Load(),
+	}
+}
+
+const (
+	adminConnectionsPath = "/layer4/connections"
+
+	// ProxyUpstreamReplKey is the placeholder set by the proxy handler with the upstream it has connected to.
+	ProxyUpstreamReplKey = AppReplPrefix + "proxy.upstream"
+)
+
+// Interface guard
+var _ caddy.AdminRouter = (*adminConnections)(nil)
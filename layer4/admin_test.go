@@ -0,0 +1,105 @@
+package layer4
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func newTestTCPConnection(t *testing.T) *Connection {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial | %s", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept | %s", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return WrapConnection(conn, []byte{}, zap.NewNop())
+}
+
+func TestAdminConnections(t *testing.T) {
+	cx1, cx2 := newTestTCPConnection(t), newTestTCPConnection(t)
+	cx1.repl.Set(routeNameReplKey, "ssh")
+	cx1.repl.Set(ProxyUpstreamReplKey, "tcp/10.0.0.1:22")
+
+	e1 := activeConns.add(cx1, "srv0", ":22")
+	defer activeConns.remove(e1)
+	e2 := activeConns.add(cx2, "srv1", ":443")
+	defer activeConns.remove(e2)
+
+	var ac adminConnections
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		if err := ac.handleConnections(rec, httptest.NewRequest(method, target, nil)); err != nil {
+			t.Fatalf("%s %s failed | %s", method, target, err)
+		}
+		return rec
+	}
+
+	rec := serve(http.MethodGet, "/layer4/connections?server=srv0")
+	var statuses []connStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("failed to decode %q | %s", rec.Body.String(), err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(statuses))
+	}
+	if s := statuses[0]; s.ID != e1.id || s.Listener != ":22" || s.Route != "ssh" || s.Upstream != "tcp/10.0.0.1:22" ||
+		s.Remote != cx1.RemoteAddr().String() || s.Network != "tcp" {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+
+	// unknown IDs aren't found
+	if err := ac.handleConnections(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodDelete, "/layer4/connections/01234567-89ab-cdef-0123-456789abcdef", nil)); err == nil {
+		t.Fatal("expected an error for an unknown connection ID")
+	}
+
+	// connections are closed by ID
+	rec = serve(http.MethodDelete, "/layer4/connections/"+e2.id)
+	if body := rec.Body.String(); body != "{\"closed\":1}\n" {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	if _, err := cx2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if reason, _ := cx2.repl.GetString(connCloseReasonReplKey); reason != closeReasonAdmin {
+		t.Fatalf("expected close reason %s, got %s", closeReasonAdmin, reason)
+	}
+
+	// connections are closed by remote IP prefix
+	rec = serve(http.MethodDelete, "/layer4/connections?server=srv0&remote=127.0.0.0/8")
+	if body := rec.Body.String(); body != "{\"closed\":1}\n" {
+		t.Fatalf("unexpected response: %s", body)
+	}
+
+	// closing all connections must be explicit
+	err := ac.handleConnections(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/layer4/connections", nil))
+	var apiErr caddy.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("expected a bad request error for an unfiltered request, got %v", err)
+	}
+	rec = serve(http.MethodDelete, "/layer4/connections?all=true")
+	if body := rec.Body.String(); body != "{\"closed\":2}\n" {
+		t.Fatalf("unexpected response: %s", body)
+	}
+}
@@ -17,6 +17,9 @@ package layer4
 import (
 	"fmt"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
@@ -37,6 +40,7 @@ type App struct {
 	packetConns []net.PacketConn
 	logger      *zap.Logger
 	ctx         caddy.Context
+	metrics     *serverMetrics
 }
 
 // CaddyModule returns the Caddy module information.
@@ -51,8 +55,10 @@ func (*App) CaddyModule() caddy.ModuleInfo {
 func (a *App) Provision(ctx caddy.Context) error {
 	a.ctx = ctx
 	a.logger = ctx.Logger()
+	a.metrics = newServerMetrics(ctx.GetMetricsRegistry())
 
 	for srvName, srv := range a.Servers {
+		srv.name, srv.metrics = srvName, a.metrics
 		err := srv.Provision(ctx, a.logger)
 		if err != nil {
 			return fmt.Errorf("server '%s': %v", srvName, err)
@@ -66,10 +72,21 @@ func (a *App) Provision(ctx caddy.Context) error {
 func (a *App) Start() error {
 	for _, s := range a.Servers {
 		for _, addr := range s.listenAddrs {
-			listeners, err := addr.ListenAll(a.ctx, net.ListenConfig{})
+			listeners, err := addr.ListenAll(a.ctx, s.SocketOptions.listenConfig())
 			if err != nil {
 				return err
 			}
+			// on Linux, Caddy binds UDP sockets with SO_REUSEPORT, so
+			// listening again yields extra sockets sharing the same address
+			if s.PacketSockets > 1 && runtime.GOOS == "linux" && strings.HasPrefix(addr.Network, "udp") {
+				for range s.PacketSockets - 1 {
+					extra, err := addr.ListenAll(a.ctx, s.SocketOptions.listenConfig())
+					if err != nil {
+						return err
+					}
+					listeners = append(listeners, extra...)
+				}
+			}
 			for _, lnAny := range listeners {
 				switch ln := lnAny.(type) {
 				case net.Listener:
@@ -107,7 +124,8 @@ func (a *App) Start() error {
 	return nil
 }
 
-// Stop stops the servers and closes all listeners.
+// Stop stops the servers and closes all listeners. In-flight connections
+// are given a grace period to finish, if the servers have one configured.
 func (a *App) Stop() error {
 	for _, pc := range a.packetConns {
 		err := pc.Close()
@@ -129,6 +147,17 @@ func (a *App) Stop() error {
 			)
 		}
 	}
+
+	var wg sync.WaitGroup
+	for _, s := range a.Servers {
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			s.drain()
+		}(s)
+	}
+	wg.Wait()
+
 	return nil
 }
 
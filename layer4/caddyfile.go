@@ -75,6 +75,19 @@ func parseLayer4(d *caddyfile.Dispenser, existingVal any) (any, error) {
 // ParseCaddyfileNestedRoutes parses the Caddyfile tokens for nested named matcher sets, handlers, idle and matching
 // timeouts, composes a list of route configurations, and adjusts the idle and matching timeouts.
 func ParseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, matchingTimeout *caddy.Duration, idleTimeout *caddy.Duration) error {
+	return ParseCaddyfileNestedRoutesWithOptions(d, routes, matchingTimeout, idleTimeout, nil)
+}
+
+// CaddyfileOptionParser parses the Caddyfile tokens of a custom option named optionName. The dispenser is positioned
+// at the option name, and the parser must consume all the option tokens, including its nested block, if any. It returns
+// false if the option isn't supported.
+type CaddyfileOptionParser func(d *caddyfile.Dispenser, optionName string) (bool, error)
+
+// ParseCaddyfileNestedRoutesWithOptions does the same as ParseCaddyfileNestedRoutes, but it also passes any options
+// it doesn't recognize to parseOption, if not nil. This is useful for servers and handlers having extra options.
+func ParseCaddyfileNestedRoutesWithOptions(d *caddyfile.Dispenser, routes *RouteList, matchingTimeout *caddy.Duration,
+	idleTimeout *caddy.Duration, parseOption CaddyfileOptionParser,
+) error {
 	var hasIdleTimeout, hasMatchingTimeout bool
 	matcherSetTokensByName, routeTokens := make(map[string][]caddyfile.Token), make([]caddyfile.Token, 0)
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
@@ -110,6 +123,14 @@ func ParseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, match
 			*matchingTimeout, hasMatchingTimeout = caddy.Duration(dur), true
 		} else if optionName == "route" {
 			routeTokens = append(routeTokens, d.NextSegment()...)
+		} else if parseOption != nil {
+			ok, err := parseOption(d, optionName)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return d.ArgErr()
+			}
 		} else {
 			return d.ArgErr()
 		}
@@ -152,7 +173,7 @@ func ParseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, match
 			}
 		}
 
-		if err := ParseCaddyfileNestedHandlers(dd, &route.HandlersRaw); err != nil {
+		if err := parseCaddyfileRouteBlock(dd, &route); err != nil {
 			return err
 		}
 		*routes = append(*routes, &route)
@@ -165,28 +186,66 @@ func ParseCaddyfileNestedRoutes(d *caddyfile.Dispenser, routes *RouteList, match
 // and composes a list of their raw JSON configurations.
 func ParseCaddyfileNestedHandlers(d *caddyfile.Dispenser, handlersRaw *[]json.RawMessage) error {
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
-		handlerName := d.Val()
-
-		unm, err := caddyfile.UnmarshalModule(d, "layer4.handlers."+handlerName)
-		if err != nil {
+		if err := parseCaddyfileNestedHandler(d, handlersRaw); err != nil {
 			return err
 		}
-		nh, ok := unm.(NextHandler)
-		if !ok {
-			return d.Errf("handler module '%s' is not a layer4 connection handler", handlerName)
-		}
-		handlerConfig := caddyconfig.JSON(nh, nil)
+	}
 
-		handlerConfig, err = SetModuleNameInline("handler", handlerName, handlerConfig)
-		if err != nil {
+	return nil
+}
+
+// parseCaddyfileRouteBlock parses the Caddyfile tokens for a route block containing
+// an optional route name and nested handlers. Syntax:
+//
+//	route [<matcher_sets...>] {
+//		name <route_name>
+//		<handler> [<handler_args>]
+//	}
+func parseCaddyfileRouteBlock(d *caddyfile.Dispenser, route *Route) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if d.Val() == "name" {
+			if route.Name != "" {
+				return d.Errf("duplicate route option '%s'", d.Val())
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			route.Name = d.Val()
+			continue
+		}
+		if err := parseCaddyfileNestedHandler(d, &route.HandlersRaw); err != nil {
 			return err
 		}
-		*handlersRaw = append(*handlersRaw, handlerConfig)
 	}
 
 	return nil
 }
 
+// parseCaddyfileNestedHandler parses the Caddyfile tokens for a single nested handler,
+// and appends its raw JSON configuration to handlersRaw.
+func parseCaddyfileNestedHandler(d *caddyfile.Dispenser, handlersRaw *[]json.RawMessage) error {
+	handlerName := d.Val()
+
+	unm, err := caddyfile.UnmarshalModule(d, "layer4.handlers."+handlerName)
+	if err != nil {
+		return err
+	}
+	nh, ok := unm.(NextHandler)
+	if !ok {
+		return d.Errf("handler module '%s' is not a layer4 connection handler", handlerName)
+	}
+	handlerConfig := caddyconfig.JSON(nh, nil)
+
+	handlerConfig, err = SetModuleNameInline("handler", handlerName, handlerConfig)
+	if err != nil {
+		return err
+	}
+	*handlersRaw = append(*handlersRaw, handlerConfig)
+
+	return nil
+}
+
 // ParseCaddyfileNestedMatcherSet parses the Caddyfile tokens for a nested matcher set,
 // and returns its raw module map value.
 func ParseCaddyfileNestedMatcherSet(d *caddyfile.Dispenser) (caddy.ModuleMap, error) {
@@ -18,12 +18,16 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -33,10 +37,14 @@ import (
 // connection handler chain where the underlying connection is not yet a layer4
 // Connection value.
 func WrapConnection(underlying net.Conn, buf []byte, logger *zap.Logger) *Connection {
+	wrapTime := time.Now().UTC()
+	id := uuid.Must(uuid.NewV7()).String() // time-ordered, like ULIDs
+
 	repl := caddy.NewReplacer()
 	repl.Set(connRemoteAddrReplKey, underlying.RemoteAddr())
 	repl.Set(connLocalAddrReplKey, underlying.LocalAddr())
-	repl.Set(ConnWrapTimeReplKey, time.Now().UTC())
+	repl.Set(connNetworkReplKey, underlying.LocalAddr().Network())
+	repl.Set(ConnWrapTimeReplKey, wrapTime)
 
 	vars := make(map[string]any)
 
@@ -49,12 +57,15 @@ func WrapConnection(underlying net.Conn, buf []byte, logger *zap.Logger) *Connec
 	cx := &Connection{
 		Conn:         underlying,
 		Context:      ctx,
-		Logger:       logger,
+		Logger:       logger.With(zap.String(connIDLogKey, id)),
 		buf:          buf,
+		id:           id,
 		isPacketConn: isPacketConn,
+		peerCred:     peerCredLookup(underlying),
 		repl:         repl,
 		vars:         vars,
 	}
+	repl.Set(connIDReplKey, id)
 
 	repl.Map(func(key string) (any, bool) {
 		// custom variables
@@ -64,6 +75,43 @@ func WrapConnection(underlying net.Conn, buf []byte, logger *zap.Logger) *Connec
 			return cx.GetVar(key[len(varsReplPrefix):]), true
 		}
 
+		// live connection values; the addresses are looked up in the replacer,
+		// so that host and port follow them if handlers override them
+		switch key {
+		case connRemoteHostReplKey, connRemotePortReplKey:
+			addr, _ := repl.Get(connRemoteAddrReplKey)
+			host, port := splitReplAddr(addr)
+			if key == connRemoteHostReplKey {
+				return host, true
+			}
+			return port, true
+		case connLocalHostReplKey, connLocalPortReplKey:
+			addr, _ := repl.Get(connLocalAddrReplKey)
+			host, port := splitReplAddr(addr)
+			if key == connLocalHostReplKey {
+				return host, true
+			}
+			return port, true
+		case connDurationReplKey:
+			return time.Since(wrapTime), true
+		case connBytesReadReplKey:
+			return cx.bytesRead.Load(), true
+		case connBytesWrittenReplKey:
+			return cx.bytesWritten.Load(), true
+		case connPeerPIDReplKey, connPeerUIDReplKey, connPeerGIDReplKey:
+			cred, err := cx.PeerCred()
+			if cred == nil || err != nil {
+				return nil, false
+			}
+			switch key {
+			case connPeerPIDReplKey:
+				return cred.PID, true
+			case connPeerUIDReplKey:
+				return cred.UID, true
+			}
+			return cred.GID, true
+		}
+
 		return nil, false
 	})
 
@@ -94,12 +142,28 @@ type Connection struct {
 	frozenOffset int
 	matching     bool
 
-	bytesRead, bytesWritten uint64
+	// updated atomically, as the admin API reads them concurrently
+	bytesRead, bytesWritten atomic.Uint64
+
+	// unique identifier, shared by all connections wrapping the same underlying connection
+	id string
+
+	// when the first route was matched, if any
+	matchedAt time.Time
+
+	// when matching of the current route list has started
+	matchingStart time.Time
 
 	// record frame boundaries for packet conns
 	isPacketConn bool
 	frameSizes   []int
 
+	// called when a panic is recovered while handling the connection
+	onPanic func()
+
+	// looks up the credentials of the peer process once, if the underlying connection is a unix socket
+	peerCred func() (*PeerCred, error)
+
 	// shortcuts for key elements of the context
 	repl *caddy.Replacer
 	vars map[string]any
@@ -108,8 +172,31 @@ type Connection struct {
 var (
 	ErrConsumedAllPrefetchedBytes = errors.New("consumed all prefetched bytes")
 	ErrMatchingBufferFull         = errors.New("matching buffer is full")
+	ErrPacketBoundariesLost       = errors.New("datagram boundaries are lost by the wrapping connection")
 )
 
+// ID returns the unique identifier of the connection, a time-ordered UUID (version 7).
+// It is the same for all connections wrapping the same underlying connection.
+func (cx *Connection) ID() string {
+	return cx.id
+}
+
+// IDField returns a log field containing the ID of the connection. Connection loggers already
+// have it, while modules logging per-connection events with their own loggers should add it,
+// so that all log lines related to a connection could be correlated.
+func (cx *Connection) IDField() zap.Field {
+	return zap.String(connIDLogKey, cx.id)
+}
+
+// PeerCred returns the credentials of the process on the other end of the connection, if the underlying
+// connection is a unix socket, or nil otherwise. They are looked up once, when first requested.
+func (cx *Connection) PeerCred() (*PeerCred, error) {
+	if cx.peerCred == nil {
+		return nil, nil
+	}
+	return cx.peerCred()
+}
+
 // GetContext returns cx.Context,
 // so that caddytls.MatchServerNameRE.Match() could obtain this context without importing layer4.
 func (cx *Connection) GetContext() context.Context {
@@ -130,19 +217,12 @@ func (cx *Connection) Read(p []byte) (n int, err error) {
 	// with that; we only read from the underlying conn
 	// after the buffer has been "depleted"
 	if len(cx.buf) > 0 && cx.offset < len(cx.buf) {
-		// for packet conns, do not read past frame boundaries
-		// TODO: if a frame is read in several ops, some handlers may not work correctly
+		// for packet conns, do not read past frame boundaries;
+		// use ReadPacket to read whole frames regardless of len(p)
 		if cx.isPacketConn {
-			var frameOffset int
-			// find the frame that should be read from
-			for _, size := range cx.frameSizes {
-				if frameOffset <= cx.offset && cx.offset < frameOffset+size {
-					n = copy(p, cx.buf[cx.offset:min(frameOffset+size, len(cx.buf))])
-					cx.offset += n
-					break
-				}
-				frameOffset += size
-			}
+			_, end := cx.bufferedFrame()
+			n = copy(p, cx.buf[cx.offset:end])
+			cx.offset += n
 		} else {
 			n = copy(p, cx.buf[cx.offset:])
 			cx.offset += n
@@ -160,14 +240,129 @@ func (cx *Connection) Read(p []byte) (n int, err error) {
 	// buffer has been "depleted" so read from
 	// underlying connection
 	n, err = cx.Conn.Read(p)
-	cx.bytesRead += uint64(n) //nolint:gosec // disable G115
+	cx.bytesRead.Add(uint64(n)) //nolint:gosec // disable G115
 
 	return
 }
 
+// IsPacket returns true if the connection carries datagrams (e.g. UDP) rather than a byte stream.
+func (cx *Connection) IsPacket() bool {
+	if cx.isPacketConn {
+		return true
+	}
+	pc, ok := cx.Conn.(interface{ IsPacket() bool })
+	return ok && pc.IsPacket()
+}
+
+// ReadPacket reads a single whole datagram into p, no matter how the datagram was
+// prefetched, e.g. in several operations during matching. If a part of the datagram
+// has already been consumed with Read, only its remainder is read. If p is too small
+// to hold the datagram, the rest of it is discarded and io.ErrShortBuffer is returned.
+// A buffer of MaxPacketBytes is always large enough. While matching, it returns
+// ErrConsumedAllPrefetchedBytes if no whole datagram has been prefetched.
+// For stream connections, ReadPacket is the same as Read, and so it is for datagram
+// connections wrapped by a net.Conn of another package, which is expected to return
+// one datagram per Read, like net.UDPConn does. However, bytes prefetched from such
+// connections aren't split into datagrams. If a layer4 packet connection is wrapped
+// by another layer4 connection which has prefetched some of its data, ReadPacket
+// returns ErrPacketBoundariesLost rather than reading merged datagrams.
+func (cx *Connection) ReadPacket(p []byte) (n int, err error) {
+	if !cx.isPacketConn {
+		// a wrapped layer4 connection may carry datagrams
+		if pr, ok := cx.Conn.(interface {
+			IsPacket() bool
+			ReadPacket([]byte) (int, error)
+		}); ok && pr.IsPacket() {
+			if cx.matching || (len(cx.buf) > 0 && cx.offset < len(cx.buf)) {
+				return 0, ErrPacketBoundariesLost
+			}
+			n, err = pr.ReadPacket(p)
+			cx.bytesRead.Add(uint64(n)) //nolint:gosec // disable G115
+			return
+		}
+		return cx.Read(p)
+	}
+
+	if len(cx.buf) > 0 && cx.offset < len(cx.buf) {
+		complete, end := cx.bufferedFrame()
+		if !complete && cx.matching {
+			return 0, ErrConsumedAllPrefetchedBytes
+		}
+
+		n = copy(p, cx.buf[cx.offset:end])
+		if n < end-cx.offset {
+			err = io.ErrShortBuffer
+		}
+		cx.offset = end
+		if !cx.matching && cx.offset == len(cx.buf) {
+			cx.offset = 0
+			cx.buf = cx.buf[:0]
+		}
+		if complete {
+			return n, err
+		}
+
+		// the rest of the frame hasn't been prefetched yet, so read it from the underlying connection
+		cx.frameSizes = cx.frameSizes[:0]
+		if cx.Conn.(*packetConn).lastPacket == nil {
+			return n, err
+		}
+		nn, rerr := cx.readFrame(p[n:])
+		if err == nil {
+			err = rerr
+		}
+		return n + nn, err
+	}
+
+	if cx.matching {
+		return 0, ErrConsumedAllPrefetchedBytes
+	}
+
+	cx.frameSizes = cx.frameSizes[:0]
+	return cx.readFrame(p)
+}
+
+// WritePacket writes p as a single datagram. For stream connections, WritePacket is the same as Write.
+func (cx *Connection) WritePacket(p []byte) (n int, err error) {
+	// packetConn writes a datagram per call, so do wrapped layer4 connections
+	return cx.Write(p)
+}
+
+// bufferedFrame returns whether the packet conn frame that cx.offset points to has been prefetched completely,
+// and where its prefetched part ends in cx.buf. Frame sizes are only recorded once frames are read completely.
+func (cx *Connection) bufferedFrame() (complete bool, end int) {
+	var frameOffset int
+	for _, size := range cx.frameSizes {
+		if frameOffset <= cx.offset && cx.offset < frameOffset+size {
+			return true, min(frameOffset+size, len(cx.buf))
+		}
+		frameOffset += size
+	}
+	return false, len(cx.buf)
+}
+
+// readFrame reads the rest of the current frame from the underlying packet conn into p.
+// If p is too small, the rest of the frame is discarded, and io.ErrShortBuffer is returned.
+func (cx *Connection) readFrame(p []byte) (n int, err error) {
+	pc := cx.Conn.(*packetConn)
+	if len(p) > 0 || pc.lastPacket == nil {
+		n, err = pc.Read(p)
+		cx.bytesRead.Add(uint64(n)) //nolint:gosec // disable G115
+		if err != nil {
+			return n, err
+		}
+	}
+	if pc.lastPacket != nil {
+		cx.bytesRead.Add(uint64(pc.lastBuf.Len())) //nolint:gosec // disable G115
+		pc.discardLastPacket()
+		return n, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
 func (cx *Connection) Write(p []byte) (n int, err error) {
 	n, err = cx.Conn.Write(p)
-	cx.bytesWritten += uint64(n) //nolint:gosec // disable G115
+	cx.bytesWritten.Add(uint64(n)) //nolint:gosec // disable G115
 	return
 }
 
@@ -176,18 +371,28 @@ func (cx *Connection) Write(p []byte) (n int, err error) {
 // a connection is wrapped by a package that does not support
 // our Connection type (for example, `tls.Server()`).
 func (cx *Connection) Wrap(conn net.Conn) *Connection {
-	return &Connection{
-		Conn:         conn,
-		Context:      cx.Context,
-		Logger:       cx.Logger,
-		buf:          cx.buf,
-		offset:       cx.offset,
-		matching:     cx.matching,
-		bytesRead:    cx.bytesRead,
-		bytesWritten: cx.bytesWritten,
-		repl:         cx.repl,
-		vars:         cx.vars,
+	wrapped := &Connection{
+		Conn:          conn,
+		Context:       cx.Context,
+		Logger:        cx.Logger,
+		buf:           cx.buf,
+		offset:        cx.offset,
+		matching:      cx.matching,
+		id:            cx.id,
+		onPanic:       cx.onPanic,
+		peerCred:      cx.peerCred,
+		matchingStart: cx.matchingStart,
+		repl:          cx.repl,
+		vars:          cx.vars,
 	}
+	wrapped.bytesRead.Store(cx.bytesRead.Load())
+	wrapped.bytesWritten.Store(cx.bytesWritten.Load())
+	// keep frame boundaries of the buffered packets, if conn still reads them
+	if _, ok := conn.(*packetConn); ok && cx.isPacketConn {
+		wrapped.isPacketConn = true
+		wrapped.frameSizes = cx.frameSizes
+	}
+	return wrapped
 }
 
 // prefetch tries to read all bytes that a client initially sent us without blocking.
@@ -210,7 +415,7 @@ func (cx *Connection) prefetch() (err error) {
 			cx.buf = append(cx.buf, tmp[:n]...)
 		}
 
-		cx.bytesRead += uint64(n) //nolint:gosec // disable G115
+		cx.bytesRead.Add(uint64(n)) //nolint:gosec // disable G115
 
 		if err != nil {
 			return err
@@ -293,11 +498,38 @@ func (cx *Connection) GetVar(key string) any {
 	return cx.vars[key]
 }
 
+// MatchingStartedAt returns the time when matching of the current route list has started.
+// It is zero if the connection hasn't been passed to any route list.
+func (cx *Connection) MatchingStartedAt() time.Time {
+	return cx.matchingStart
+}
+
 // Replacer returns a pointer to the replacer in the connection context
 func (cx *Connection) Replacer() *caddy.Replacer {
 	return cx.repl
 }
 
+// splitReplAddr splits the string form of addr, a value of an address placeholder, into host and port.
+// If addr has no port (e.g. a unix socket path), the whole address is returned as host.
+func splitReplAddr(addr any) (host, port string) {
+	var addrStr string
+	switch a := addr.(type) {
+	case net.Addr:
+		addrStr = a.String()
+	case string:
+		addrStr = a
+	case nil:
+		return "", ""
+	default:
+		addrStr = fmt.Sprint(a)
+	}
+	host, port, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return addrStr, ""
+	}
+	return host, port
+}
+
 // MatchingBytes returns all bytes currently available for matching. This is only intended for reading.
 // Do not write into the slice. It's a view of the internal buffer, and you will likely mess up the connection.
 // Use of this for matching purpose should be accompanied by corresponding error value,
@@ -316,22 +548,53 @@ var (
 
 	// listenerCtxKey is the key used to get the listener from a handler
 	listenerCtxKey caddy.CtxKey = "listener"
+
+	// packetListenerCtxKey is the key used to get the packet listener from a handler
+	packetListenerCtxKey caddy.CtxKey = "packet_listener"
 )
 
 // Replacer prefixes and keys; names of context variables
 const (
 	AppReplPrefix    = "l4."
 	connReplPrefix   = AppReplPrefix + "conn."
+	errorReplPrefix  = AppReplPrefix + "error."
 	regexpReplPrefix = AppReplPrefix + "regexp."
+	routeReplPrefix  = AppReplPrefix + "route."
 	varsReplPrefix   = AppReplPrefix + "vars."
 
-	connLocalAddrReplKey  = connReplPrefix + "local_addr"
-	connRemoteAddrReplKey = connReplPrefix + "remote_addr"
-	ConnWrapTimeReplKey   = connReplPrefix + "wrap_time"
+	connBytesReadReplKey    = connReplPrefix + "bytes_read"
+	connBytesWrittenReplKey = connReplPrefix + "bytes_written"
+	connCloseReasonReplKey  = connReplPrefix + "close_reason"
+	connDurationReplKey     = connReplPrefix + "duration"
+	connIDReplKey           = connReplPrefix + "id"
+	connListenerReplKey     = connReplPrefix + "listener"
+	connLocalAddrReplKey    = connReplPrefix + "local_addr"
+	connLocalHostReplKey    = connReplPrefix + "local_host"
+	connLocalPortReplKey    = connReplPrefix + "local_port"
+	connNetworkReplKey      = connReplPrefix + "network"
+	connPeerGIDReplKey      = connReplPrefix + "peer_gid"
+	connPeerPIDReplKey      = connReplPrefix + "peer_pid"
+	connPeerUIDReplKey      = connReplPrefix + "peer_uid"
+	connRemoteAddrReplKey   = connReplPrefix + "remote_addr"
+	connRemoteHostReplKey   = connReplPrefix + "remote_host"
+	connRemotePortReplKey   = connReplPrefix + "remote_port"
+	connServerNameReplKey   = connReplPrefix + "server_name"
+	ConnWrapTimeReplKey     = connReplPrefix + "wrap_time"
+	errorReplKey            = AppReplPrefix + "error"
+	errorMessageReplKey     = errorReplPrefix + "message"
+	errorReasonReplKey      = errorReplPrefix + "reason"
+	routeNameReplKey        = routeReplPrefix + "name"
 
 	TLSConnectionStatesVarName = "tls_connection_states"
+
+	// the log field containing connection IDs
+	connIDLogKey = "conn_id"
 )
 
+// MaxPacketBytes is the maximum size of datagrams read from packet connections, which accommodates jumbo frames.
+// A buffer of this size is large enough for Connection.ReadPacket to read any datagram.
+const MaxPacketBytes = 9000
+
 // the prefetch chunk size is a very large 2kb, in order to completely fetch the ~1.7kb X25519Kyber768Draft00 based TLS ClientHello. https://pq.cloudflareresearch.com/
 const prefetchChunkSize = 2048
 
@@ -2,9 +2,13 @@ package layer4
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -91,3 +95,195 @@ func TestConnection_FreezeAndUnfreeze(t *testing.T) {
 		t.Fatalf("expected %s but received %s", consumeData, buf)
 	}
 }
+
+// newTestPacketConn returns a packetConn that reads the packets sent to its readCh.
+func newTestPacketConn(t *testing.T) *packetConn {
+	t.Helper()
+
+	socket, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	t.Cleanup(func() { _ = socket.Close() })
+
+	pc := &packetConn{
+		PacketConn:  socket,
+		readCh:      make(chan *packet, 5),
+		addr:        &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12345},
+		closeCh:     make(chan string, 5),
+		idleTimeout: time.Minute,
+	}
+	_ = pc.SetReadDeadline(time.Time{})
+	return pc
+}
+
+func TestConnection_ReadPacketPreservesDatagrams(t *testing.T) {
+	pc := newTestPacketConn(t)
+
+	send := func(size int, fill byte) []byte {
+		buf := udpBufPool.Get().([]byte)
+		copy(buf, bytes.Repeat([]byte{fill}, size))
+		pc.readCh <- &packet{pooledBuf: buf, n: size}
+		return buf[:size:size]
+	}
+	large, small := send(3000, 'a'), send(100, 'b')
+
+	cx := WrapConnection(pc, []byte{}, zap.NewNop())
+	if !cx.IsPacket() {
+		t.Fatal("expected a packet connection")
+	}
+
+	p := make([]byte, MaxPacketBytes)
+
+	// the large datagram takes two prefetches, so it isn't available for matching after the first one
+	if err := cx.prefetch(); err != nil {
+		t.Fatal(err)
+	}
+	cx.freeze()
+	if _, err := cx.ReadPacket(p); !errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+		t.Fatalf("expected %v for a partially prefetched datagram, got %v", ErrConsumedAllPrefetchedBytes, err)
+	}
+	cx.unfreeze()
+
+	if err := cx.prefetch(); err != nil {
+		t.Fatal(err)
+	}
+	cx.freeze()
+	n, err := cx.ReadPacket(p)
+	if err != nil || !bytes.Equal(p[:n], large) {
+		t.Fatalf("expected the large datagram while matching, got %d bytes and error %v", n, err)
+	}
+	if _, err = cx.ReadPacket(p); !errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+		t.Fatalf("expected %v, got %v", ErrConsumedAllPrefetchedBytes, err)
+	}
+	cx.unfreeze()
+
+	// after matching, the buffered datagram is followed by the one read from the underlying connection
+	for _, expected := range [][]byte{large, small} {
+		n, err = cx.ReadPacket(p)
+		if err != nil || !bytes.Equal(p[:n], expected) {
+			t.Fatalf("expected a datagram of %d bytes, got %d bytes and error %v", len(expected), n, err)
+		}
+	}
+
+	// a short buffer gets a truncated datagram, and its remainder is discarded
+	send(2000, 'c')
+	next := send(10, 'd')
+	n, err = cx.ReadPacket(p[:1000])
+	if n != 1000 || !errors.Is(err, io.ErrShortBuffer) {
+		t.Fatalf("expected 1000 bytes and %v, got %d bytes and error %v", io.ErrShortBuffer, n, err)
+	}
+	n, err = cx.ReadPacket(p)
+	if err != nil || !bytes.Equal(p[:n], next) {
+		t.Fatalf("expected the next datagram, got %d bytes and error %v", n, err)
+	}
+}
+
+func TestConnection_ReadPacketOfWrappedConnections(t *testing.T) {
+	pc := newTestPacketConn(t)
+	pc.readCh <- &packet{pooledBuf: udpBufPool.Get().([]byte), n: 10}
+	p := make([]byte, MaxPacketBytes)
+
+	// a wrapping layer4 connection doesn't know the boundaries of the data it has prefetched
+	inner := WrapConnection(pc, []byte{}, zap.NewNop())
+	outer := WrapConnection(inner, []byte{}, zap.NewNop())
+	if err := outer.prefetch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outer.ReadPacket(p); !errors.Is(err, ErrPacketBoundariesLost) {
+		t.Fatalf("expected %v, got %v", ErrPacketBoundariesLost, err)
+	}
+
+	// a net.Conn of another package is read one datagram at a time
+	pc.readCh <- &packet{pooledBuf: udpBufPool.Get().([]byte), n: 20}
+	foreign := WrapConnection(struct{ net.Conn }{pc}, []byte{}, zap.NewNop())
+	if n, err := foreign.ReadPacket(p); err != nil || n != 20 {
+		t.Fatalf("expected a datagram of 20 bytes, got %d bytes and error %v", n, err)
+	}
+
+	// stream connections are read as usual
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+	go func() { _, _ = in.Write([]byte("stream")) }()
+	stream := WrapConnection(out, []byte{}, zap.NewNop())
+	if n, err := stream.ReadPacket(p); err != nil || string(p[:n]) != "stream" {
+		t.Fatalf("expected to read from the stream, got %q and error %v", p[:n], err)
+	}
+}
+
+func TestConnection_WrapKeepsFrameBoundaries(t *testing.T) {
+	pc := newTestPacketConn(t)
+
+	for _, size := range []int{10, 20} {
+		buf := udpBufPool.Get().([]byte)
+		pc.readCh <- &packet{pooledBuf: buf, n: size}
+	}
+
+	cx := WrapConnection(pc, []byte{}, zap.NewNop())
+	for range 2 {
+		if err := cx.prefetch(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wrapped := cx.Wrap(pc)
+	if !wrapped.IsPacket() {
+		t.Fatal("expected the wrapped connection to be a packet connection")
+	}
+	p := make([]byte, MaxPacketBytes)
+	for _, size := range []int{10, 20} {
+		n, err := wrapped.ReadPacket(p)
+		if err != nil || n != size {
+			t.Fatalf("expected a datagram of %d bytes, got %d bytes and error %v", size, n, err)
+		}
+	}
+}
+
+func TestConnection_Placeholders(t *testing.T) {
+	cx := WrapConnection(&dummyConn{
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321},
+	}, []byte{}, zap.NewNop())
+	other := WrapConnection(&dummyConn{
+		localAddr:  dummyAddr{ip: "/run/caddy-l4.sock", network: "unix"},
+		remoteAddr: dummyAddr{ip: "@", network: "unix"},
+	}, []byte{}, zap.NewNop())
+
+	if _, err := uuid.Parse(cx.ID()); err != nil || other.ID() == cx.ID() {
+		t.Fatalf("expected unique UUIDs, got %s and %s", cx.ID(), other.ID())
+	}
+	if wrapped := cx.Wrap(nil); wrapped.ID() != cx.ID() {
+		t.Fatalf("expected a wrapped connection to keep ID %s, got %s", cx.ID(), wrapped.ID())
+	}
+
+	for i, tc := range []struct {
+		cx       *Connection
+		input    string
+		expected string
+	}{
+		{cx: cx, input: "{l4.conn.remote_host}:{l4.conn.remote_port}", expected: "2001:db8::1:54321"},
+		{cx: cx, input: "{l4.conn.local_host}:{l4.conn.local_port}", expected: "127.0.0.1:443"},
+		{cx: cx, input: "{l4.conn.network}", expected: "tcp"},
+		{cx: other, input: "{l4.conn.network} {l4.conn.local_host} {l4.conn.local_port}", expected: "unix /run/caddy-l4.sock -"},
+	} {
+		if actual := tc.cx.repl.ReplaceAll(tc.input, "-"); actual != tc.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expected, actual)
+		}
+	}
+
+	// values are live
+	cx.repl.Set(connRemoteAddrReplKey, "192.0.2.1:1234")
+	cx.bytesRead.Add(10)
+	cx.bytesWritten.Add(20)
+	time.Sleep(time.Millisecond)
+	if actual := cx.repl.ReplaceAll("{l4.conn.remote_host} {l4.conn.bytes_read} {l4.conn.bytes_written}", "-"); actual != "192.0.2.1 10 20" {
+		t.Errorf("expected updated values, got %q", actual)
+	}
+	if duration, _ := cx.repl.Get(connDurationReplKey); duration.(time.Duration) < time.Millisecond {
+		t.Errorf("expected duration of at least 1ms, got %v", duration)
+	}
+	if id, _ := cx.repl.Get(connIDReplKey); id != cx.ID() {
+		t.Errorf("expected ID %s, got %v", cx.ID(), id)
+	}
+}
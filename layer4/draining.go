@@ -0,0 +1,108 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// trackConnection registers cx as in-flight. It returns false if the server
+// is stopping, in which case cx must be closed without being handled.
+func (s *Server) trackConnection(cx *Connection) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.stopping {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*Connection]struct{})
+	}
+	s.conns[cx] = struct{}{}
+	s.connsWg.Add(1)
+	return true
+}
+
+// untrackConnection removes cx from the in-flight connections.
+func (s *Server) untrackConnection(cx *Connection) {
+	s.connsMu.Lock()
+	delete(s.conns, cx)
+	s.connsMu.Unlock()
+	s.connsWg.Done()
+}
+
+// drain makes the server stop handling new connections and waits for in-flight
+// connections to finish within the grace period. Once it expires, the remaining
+// connections are closed. If there is no grace period, in-flight connections
+// are left to finish on their own.
+func (s *Server) drain() {
+	s.connsMu.Lock()
+	s.stopping = true
+	count := len(s.conns)
+	s.connsMu.Unlock()
+
+	if count == 0 || s.GracePeriod <= 0 {
+		return
+	}
+
+	s.logger.Info("draining connections",
+		zap.Int("count", count),
+		zap.Duration("grace_period", time.Duration(s.GracePeriod)),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		s.connsWg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Duration(s.GracePeriod))
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	s.connsMu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for cx := range s.conns {
+		conns = append(conns, cx.Conn)
+	}
+	s.connsMu.Unlock()
+
+	s.logger.Warn("grace period expired; closing remaining connections", zap.Int("count", len(conns)))
+
+	for _, conn := range conns {
+		forceClose(conn)
+	}
+}
+
+// forceClose aborts any ongoing I/O on conn from another goroutine.
+func forceClose(conn net.Conn) {
+	// packetConn shares the server socket, and its Close isn't
+	// safe to call concurrently with Read, so end its session
+	// instead, and let any ongoing Read time out
+	if pc, ok := conn.(*packetConn); ok {
+		pc.end()
+		_ = pc.SetReadDeadline(time.Now())
+		return
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,118 @@
+package layer4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestServerDrainClosesConnectionsAfterGracePeriod(t *testing.T) {
+	s := &Server{GracePeriod: caddy.Duration(50 * time.Millisecond), logger: zap.NewNop()}
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	if !s.trackConnection(cx) {
+		t.Fatal("expected the connection to be tracked")
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer s.untrackConnection(cx)
+		_, err := cx.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	start := time.Now()
+	s.drain()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected drain to wait for the grace period, but it returned after %s", elapsed)
+	}
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("expected the connection to be closed, got error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection to be closed after the grace period")
+	}
+
+	// no new connections are accepted once the server is stopping
+	if s.trackConnection(WrapConnection(in, []byte{}, zap.NewNop())) {
+		t.Fatal("expected the connection not to be tracked by a stopping server")
+	}
+}
+
+func TestServerDrainReturnsOnceConnectionsFinish(t *testing.T) {
+	s := &Server{GracePeriod: caddy.Duration(time.Minute), logger: zap.NewNop()}
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	if !s.trackConnection(cx) {
+		t.Fatal("expected the connection to be tracked")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.untrackConnection(cx)
+	}()
+
+	start := time.Now()
+	s.drain()
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected drain to return once connections finish, but it returned after %s", elapsed)
+	}
+}
+
+func TestServerDrainEndsPacketSessionsAfterGracePeriod(t *testing.T) {
+	s := &Server{GracePeriod: caddy.Duration(50 * time.Millisecond), logger: zap.NewNop()}
+
+	pc := newTestPacketConn(t)
+	pc.ended = make(chan struct{})
+
+	cx := WrapConnection(pc, []byte{}, zap.NewNop())
+	if !s.trackConnection(cx) {
+		t.Fatal("expected the connection to be tracked")
+	}
+
+	// the handler keeps extending its read deadline, so only ending the session makes it return
+	readErr := make(chan error, 1)
+	go func() {
+		defer s.untrackConnection(cx)
+		for {
+			_ = pc.SetReadDeadline(time.Now().Add(time.Hour))
+			_, err := pc.Read(make([]byte, 1))
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	s.drain()
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("expected the session to be ended, got error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the session to be ended after the grace period")
+	}
+	select {
+	case <-pc.closeCh:
+	default:
+		t.Fatal("expected the server loop to be notified of the ended session")
+	}
+}
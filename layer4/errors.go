@@ -0,0 +1,120 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// ErrorRoutes is a list of routes that handle connections the primary routes have failed to handle,
+// i.e. when their matching has failed or timed out, or when their handlers have returned an error
+// (e.g. a dial failure, a TLS handshake error or no upstreams available). The error is exposed via
+// `{l4.error.message}` and `{l4.error.reason}` placeholders, so that these routes could send
+// a fallback banner, proxy to a maintenance backend, or close the connection depending on it.
+type ErrorRoutes struct {
+	// Routes express composable logic for handling connections that have failed.
+	Routes RouteList `json:"routes,omitempty"`
+
+	// Maximum time connections have to complete the matching phase of the error routes.
+	// Default: the matching timeout of the primary routes.
+	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
+}
+
+// Provision sets up the error routes.
+func (er *ErrorRoutes) Provision(ctx caddy.Context) error {
+	if er == nil {
+		return nil
+	}
+	if err := er.Routes.Provision(ctx); err != nil {
+		return fmt.Errorf("setting up error routes: %v", err)
+	}
+	return nil
+}
+
+// Wrap returns a handler that passes connections to primary, and then to the error routes
+// compiled with next, if primary has failed. If there are no error routes, primary is returned.
+func (er *ErrorRoutes) Wrap(primary Handler, logger *zap.Logger, matchingTimeout time.Duration, next Handler) Handler {
+	if er == nil || len(er.Routes) == 0 {
+		return primary
+	}
+	if er.MatchingTimeout > 0 {
+		matchingTimeout = time.Duration(er.MatchingTimeout)
+	}
+	errorRoute := er.Routes.Compile(logger, matchingTimeout, next)
+
+	return HandlerFunc(func(cx *Connection) error {
+		err := primary.Handle(cx)
+		// connections handed to the next listener or packet conn wrapper aren't failures
+		if errors.Is(err, errHijacked) {
+			return err
+		}
+		if err != nil {
+			logger.Error("handling connection; invoking error routes",
+				zap.String("remote", cx.RemoteAddr().String()),
+				zap.Error(err),
+				cx.IDField(),
+			)
+			cx.repl.Set(connCloseReasonReplKey, closeReasonHandlerError)
+			setError(cx, err, closeReasonHandlerError)
+		}
+
+		// matching failures are recorded by the primary routes instead of being returned
+		if _, pending := cx.repl.Get(errorReplKey); !pending {
+			return nil
+		}
+		cx.repl.Delete(errorReplKey) // error routes of an outer route list don't handle it again
+
+		return errorRoute.Handle(cx)
+	})
+}
+
+// UnmarshalCaddyfile sets up the ErrorRoutes from Caddyfile tokens. Syntax:
+//
+//	handle_errors {
+//		matching_timeout <duration>
+//		@a <matcher> [<matcher_args>]
+//		route @a {
+//			<handler> [<handler_args>]
+//		}
+//		route {
+//			<handler> [<handler_args>]
+//		}
+//	}
+func (er *ErrorRoutes) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume option name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	return ParseCaddyfileNestedRoutes(d, &er.Routes, &er.MatchingTimeout, nil)
+}
+
+// setError records err as a failure the error routes are to handle for the given reason.
+func setError(cx *Connection, err error, reason string) {
+	cx.repl.Set(errorReplKey, err)
+	cx.repl.Set(errorMessageReplKey, err.Error())
+	cx.repl.Set(errorReasonReplKey, reason)
+}
+
+// Interface guard
+var _ caddyfile.Unmarshaler = (*ErrorRoutes)(nil)
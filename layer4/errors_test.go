@@ -0,0 +1,141 @@
+package layer4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newTestErrorRoutes returns error routes which record the error placeholders on invocation.
+func newTestErrorRoutes(invoked chan<- [2]string) *ErrorRoutes {
+	return &ErrorRoutes{Routes: RouteList{&Route{middleware: []Middleware{
+		func(Handler) Handler {
+			return HandlerFunc(func(cx *Connection) error {
+				message, _ := cx.repl.GetString(errorMessageReplKey)
+				reason, _ := cx.repl.GetString(errorReasonReplKey)
+				invoked <- [2]string{message, reason}
+				return nil
+			})
+		},
+	}}}}
+}
+
+func TestErrorRoutesHandleHandlerErrors(t *testing.T) {
+	invoked := make(chan [2]string, 1)
+	primary := RouteList{&Route{middleware: []Middleware{
+		func(Handler) Handler {
+			return HandlerFunc(func(*Connection) error { return errors.New("no upstreams available") })
+		},
+	}}}.Compile(zap.NewNop(), time.Second, nopHandler{})
+
+	handler := newTestErrorRoutes(invoked).Wrap(primary, zap.NewNop(), time.Second, nopHandler{})
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	if err := handler.Handle(cx); err != nil {
+		t.Fatalf("expected the error to be handled, got %v", err)
+	}
+
+	select {
+	case got := <-invoked:
+		if got != [2]string{"no upstreams available", closeReasonHandlerError} {
+			t.Fatalf("unexpected error placeholders: %v", got)
+		}
+	default:
+		t.Fatal("expected the error routes to be invoked")
+	}
+	if reason, _ := cx.repl.GetString(connCloseReasonReplKey); reason != closeReasonHandlerError {
+		t.Fatalf("expected close reason %s, got %s", closeReasonHandlerError, reason)
+	}
+}
+
+func TestErrorRoutesHandleMatchingTimeouts(t *testing.T) {
+	invoked := make(chan [2]string, 2)
+	primary := RouteList{&Route{
+		matcherSets: MatcherSets{MatcherSet{&testIoMatcher{}}},
+	}}.Compile(zap.NewNop(), 5*time.Millisecond, nopHandler{})
+
+	// the error is handled by the innermost error routes only
+	inner := newTestErrorRoutes(invoked).Wrap(primary, zap.NewNop(), time.Second, nopHandler{})
+	outer := newTestErrorRoutes(invoked).Wrap(inner, zap.NewNop(), time.Second, nopHandler{})
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	if err := outer.Handle(cx); err != nil {
+		t.Fatalf("expected the error to be handled, got %v", err)
+	}
+
+	if len(invoked) != 1 {
+		t.Fatalf("expected the error routes to be invoked once, got %d", len(invoked))
+	}
+	if got := <-invoked; got != [2]string{ErrMatchingTimeout.Error(), closeReasonMatchingTimeout} {
+		t.Fatalf("unexpected error placeholders: %v", got)
+	}
+}
+
+func TestErrorRoutesSkipSuccessfulConnections(t *testing.T) {
+	invoked := make(chan [2]string, 1)
+	handler := newTestErrorRoutes(invoked).Wrap(nopHandler{}, zap.NewNop(), time.Second, nopHandler{})
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	if err := handler.Handle(WrapConnection(out, []byte{}, zap.NewNop())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(invoked) != 0 {
+		t.Fatal("expected the error routes not to be invoked")
+	}
+}
+
+func TestErrorRoutesSkipConnectionsPassedToListener(t *testing.T) {
+	invoked := make(chan [2]string, 1)
+	lw := &ListenerWrapper{logger: zap.NewNop()}
+	lw.compiledRoute = newTestErrorRoutes(invoked).Wrap(RouteList{}.Compile(zap.NewNop(), time.Second, listenerHandler{}),
+		zap.NewNop(), time.Second, nopHandler{})
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln := lw.WrapListener(tcpLn)
+	defer func() { _ = ln.Close() }()
+
+	client, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// the connection passed to the next listener must stay open
+	if _, err = client.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected to read from the passed connection, got %q, %v", buf, err)
+	}
+	// wait for the handler to return, so that the error routes would have been invoked by now
+	ln.(*listener).wg.Wait()
+	if len(invoked) != 0 {
+		t.Fatal("expected the error routes not to be invoked")
+	}
+}
@@ -95,3 +95,10 @@ type listenerHandler struct{}
 func (listenerHandler) Handle(conn *Connection) error {
 	return conn.Context.Value(listenerCtxKey).(*listener).pipeConnection(conn)
 }
+
+// packetListenerHandler is a connection handler that passes incoming packet connections to the next packet conn wrapper
+type packetListenerHandler struct{}
+
+func (packetListenerHandler) Handle(conn *Connection) error {
+	return conn.Context.Value(packetListenerCtxKey).(*packetListener).pipeConnection(conn)
+}
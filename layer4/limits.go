@@ -0,0 +1,257 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	acceptQueueTimeoutDefault        = 5 * time.Second
+	connectionLimitPrefixIPv4Default = 24
+	connectionLimitPrefixIPv6Default = 64
+
+	// rejectionWarnInterval is how often rejections are logged at WARN level at most.
+	rejectionWarnInterval = time.Second
+)
+
+// Errors returned when a connection is rejected due to a limit.
+var (
+	errConnLimitServer       = errors.New("server connection limit reached")
+	errConnLimitIP           = errors.New("remote IP connection limit reached")
+	errConnLimitPrefix       = errors.New("remote prefix connection limit reached")
+	errConnLimitQueueTimeout = errors.New("timed out waiting in accept queue")
+)
+
+// connLimiter enforces concurrent connection limits for a server.
+type connLimiter struct {
+	maxConns     int
+	perIP        int
+	perPrefix    int
+	prefixIPv4   int
+	prefixIPv6   int
+	queueSize    int32
+	queueTimeout time.Duration
+
+	// slots is a semaphore for the server-wide limit; nil if unlimited.
+	slots chan struct{}
+	// queued counts connections waiting for a slot.
+	queued atomic.Int32
+	// rejected counts connections rejected due to any limit.
+	rejected atomic.Uint64
+	// warnedAt is the time of the last rejection logged at WARN level, in Unix nanoseconds.
+	warnedAt atomic.Int64
+
+	mu            sync.Mutex
+	connsByIP     map[netip.Addr]int
+	connsByPrefix map[netip.Prefix]int
+}
+
+// newConnLimiter returns a connLimiter for the server's limits,
+// or nil if the server has no limits configured.
+func newConnLimiter(s *Server) *connLimiter {
+	if s.MaxConnections <= 0 && s.MaxConnectionsPerIP <= 0 && s.MaxConnectionsPerPrefix <= 0 {
+		return nil
+	}
+
+	l := &connLimiter{
+		maxConns:     s.MaxConnections,
+		perIP:        s.MaxConnectionsPerIP,
+		perPrefix:    s.MaxConnectionsPerPrefix,
+		prefixIPv4:   s.ConnectionLimitPrefixIPv4,
+		prefixIPv6:   s.ConnectionLimitPrefixIPv6,
+		queueSize:    int32(s.AcceptQueueSize),
+		queueTimeout: time.Duration(s.AcceptQueueTimeout),
+	}
+	if l.maxConns > 0 {
+		l.slots = make(chan struct{}, l.maxConns)
+	}
+	if l.perIP > 0 {
+		l.connsByIP = make(map[netip.Addr]int)
+	}
+	if l.perPrefix > 0 {
+		l.connsByPrefix = make(map[netip.Prefix]int)
+	}
+	return l
+}
+
+// shouldWarn returns true if a rejection at now is the first one in rejectionWarnInterval,
+// so that floods of rejected connections or packets don't turn into floods of warnings.
+func (l *connLimiter) shouldWarn(now time.Time) bool {
+	last := l.warnedAt.Load()
+	if now.UnixNano()-last < int64(rejectionWarnInterval) {
+		return false
+	}
+	return l.warnedAt.CompareAndSwap(last, now.UnixNano())
+}
+
+// admit reserves capacity for a new connection from remote. On success, it returns a release function that must be
+// called once the connection is done. If the server-wide limit is reached and queueing is allowed, it also returns
+// a wait function that blocks until a slot is available, and must be called (and succeed) before the connection is
+// handled. An error is returned if the connection must be rejected right away.
+func (l *connLimiter) admit(remote net.Addr, allowQueue bool) (release func(), wait func() error, err error) {
+	ip, hasIP := remoteIP(remote)
+	if hasIP {
+		if err = l.reserveIP(ip); err != nil {
+			l.rejected.Add(1)
+			return nil, nil, err
+		}
+	}
+
+	var hasSlot atomic.Bool
+	release = func() {
+		if hasSlot.Swap(false) {
+			<-l.slots
+		}
+		if hasIP {
+			l.releaseIP(ip)
+		}
+	}
+
+	if l.slots == nil {
+		return release, nil, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		hasSlot.Store(true)
+		return release, nil, nil
+	default:
+	}
+
+	if !allowQueue || !l.enqueue() {
+		release()
+		l.rejected.Add(1)
+		return nil, nil, errConnLimitServer
+	}
+
+	wait = func() error {
+		defer l.queued.Add(-1)
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			hasSlot.Store(true)
+			return nil
+		case <-timer.C:
+			l.rejected.Add(1)
+			return errConnLimitQueueTimeout
+		}
+	}
+
+	return release, wait, nil
+}
+
+// enqueue reserves a place in the accept queue, if there is any left.
+func (l *connLimiter) enqueue() bool {
+	for {
+		queued := l.queued.Load()
+		if queued >= l.queueSize {
+			return false
+		}
+		if l.queued.CompareAndSwap(queued, queued+1) {
+			return true
+		}
+	}
+}
+
+// reserveIP increments the connection counters for ip and its prefix, unless any of them is at its limit.
+func (l *connLimiter) reserveIP(ip netip.Addr) error {
+	if l.connsByIP == nil && l.connsByPrefix == nil {
+		return nil
+	}
+
+	prefix := l.prefixOf(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.connsByIP != nil && l.connsByIP[ip] >= l.perIP {
+		return errConnLimitIP
+	}
+	if l.connsByPrefix != nil && l.connsByPrefix[prefix] >= l.perPrefix {
+		return errConnLimitPrefix
+	}
+	if l.connsByIP != nil {
+		l.connsByIP[ip]++
+	}
+	if l.connsByPrefix != nil {
+		l.connsByPrefix[prefix]++
+	}
+
+	return nil
+}
+
+// releaseIP decrements the connection counters for ip and its prefix.
+func (l *connLimiter) releaseIP(ip netip.Addr) {
+	if l.connsByIP == nil && l.connsByPrefix == nil {
+		return
+	}
+
+	prefix := l.prefixOf(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.connsByIP != nil {
+		if l.connsByIP[ip] <= 1 {
+			delete(l.connsByIP, ip)
+		} else {
+			l.connsByIP[ip]--
+		}
+	}
+	if l.connsByPrefix != nil {
+		if l.connsByPrefix[prefix] <= 1 {
+			delete(l.connsByPrefix, prefix)
+		} else {
+			l.connsByPrefix[prefix]--
+		}
+	}
+}
+
+// prefixOf returns the network prefix ip belongs to for per-prefix limiting.
+func (l *connLimiter) prefixOf(ip netip.Addr) netip.Prefix {
+	bits := l.prefixIPv6
+	if ip.Is4() {
+		bits = l.prefixIPv4
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix
+}
+
+// remoteIP extracts the IP address from addr, if it has any.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	case *net.UDPAddr:
+		ip, ok := netip.AddrFromSlice(a.IP)
+		return ip.Unmap(), ok
+	}
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
@@ -0,0 +1,122 @@
+package layer4
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiterPerIPAndPrefix(t *testing.T) {
+	l := newConnLimiter(&Server{
+		MaxConnectionsPerIP:       2,
+		MaxConnectionsPerPrefix:   3,
+		ConnectionLimitPrefixIPv4: 24,
+		ConnectionLimitPrefixIPv6: 64,
+	})
+
+	addr := func(s string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(s), Port: 12345} }
+
+	var releases []func()
+	for i, tc := range []struct {
+		remote string
+		err    error
+	}{
+		{remote: "192.168.0.1"},
+		{remote: "192.168.0.1"},
+		{remote: "192.168.0.1", err: errConnLimitIP},
+		{remote: "192.168.0.2"},
+		{remote: "192.168.0.3", err: errConnLimitPrefix},
+		{remote: "192.168.1.1"},
+		{remote: "::ffff:192.168.0.4", err: errConnLimitPrefix},
+		{remote: "2001:db8::1"},
+	} {
+		release, wait, err := l.admit(addr(tc.remote), true)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Test %d: expected error %v, got %v", i, tc.err, err)
+		}
+		if wait != nil {
+			t.Fatalf("Test %d: expected no waiting", i)
+		}
+		if release != nil {
+			releases = append(releases, release)
+		}
+	}
+
+	if l.rejected.Load() != 3 {
+		t.Fatalf("expected 3 rejected connections, got %d", l.rejected.Load())
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	if len(l.connsByIP) != 0 || len(l.connsByPrefix) != 0 {
+		t.Fatalf("expected no tracked addresses after release, got %v and %v", l.connsByIP, l.connsByPrefix)
+	}
+}
+
+func TestConnLimiterAcceptQueue(t *testing.T) {
+	l := newConnLimiter(&Server{
+		MaxConnections:  1,
+		AcceptQueueSize: 1,
+	})
+	l.queueTimeout = time.Second
+
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	release1, wait1, err := l.admit(remote, true)
+	if err != nil || wait1 != nil {
+		t.Fatalf("expected the first connection to be admitted, got error %v", err)
+	}
+
+	// the second connection is queued, the third one is rejected
+	release2, wait2, err := l.admit(remote, true)
+	if err != nil || wait2 == nil {
+		t.Fatalf("expected the second connection to be queued, got error %v", err)
+	}
+	if _, _, err = l.admit(remote, true); !errors.Is(err, errConnLimitServer) {
+		t.Fatalf("expected the third connection to be rejected, got error %v", err)
+	}
+
+	// packet connections are never queued
+	if _, _, err = l.admit(remote, false); !errors.Is(err, errConnLimitServer) {
+		t.Fatalf("expected the packet connection to be rejected, got error %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release1()
+	}()
+	if err = wait2(); err != nil {
+		t.Fatalf("expected the queued connection to get a slot, got error %v", err)
+	}
+	release2()
+
+	// the queue times out if no slot is released in time
+	l.queueTimeout = 10 * time.Millisecond
+	release3, _, _ := l.admit(remote, true)
+	defer release3()
+	_, wait4, err := l.admit(remote, true)
+	if err != nil || wait4 == nil {
+		t.Fatalf("expected the connection to be queued, got error %v", err)
+	}
+	if err = wait4(); !errors.Is(err, errConnLimitQueueTimeout) {
+		t.Fatalf("expected the queued connection to time out, got error %v", err)
+	}
+}
+
+func TestConnLimiterShouldWarn(t *testing.T) {
+	l := &connLimiter{}
+	now := time.Now()
+	if !l.shouldWarn(now) {
+		t.Fatal("expected the first rejection to be warned about")
+	}
+	for i := range 100 {
+		if l.shouldWarn(now.Add(time.Duration(i) * time.Millisecond)) {
+			t.Fatalf("expected rejection %d within the interval not to be warned about", i)
+		}
+	}
+	if !l.shouldWarn(now.Add(rejectionWarnInterval)) {
+		t.Fatal("expected a rejection after the interval to be warned about")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"runtime"
 	"sync"
@@ -19,15 +20,24 @@ func init() {
 	caddy.RegisterModule(&ListenerWrapper{})
 }
 
-// ListenerWrapper is a Caddy module that wraps App as a listener wrapper, it doesn't support udp.
+// ListenerWrapper is a Caddy module that wraps App as a listener wrapper, it doesn't support udp (see PacketConnWrapper).
 type ListenerWrapper struct {
 	// Routes express composable logic for handling byte streams.
 	Routes RouteList `json:"routes,omitempty"`
 
+	// Errors configures routes that handle connections the primary routes have failed to handle.
+	// Connections are never passed to the next listener wrapper by these routes.
+	Errors *ErrorRoutes `json:"errors,omitempty"`
+
 	// Maximum time connections have to complete the matching phase (the first terminal handler is matched). Default: 3s.
 	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
 
+	// Enables access logging and configures how access logs are handled.
+	// Connections passed to the next listener wrapper aren't logged.
+	Logs *ServerLogConfig `json:"logs,omitempty"`
+
 	compiledRoute Handler
+	metrics       *serverMetrics
 
 	logger *zap.Logger
 	ctx    caddy.Context
@@ -45,16 +55,29 @@ func (*ListenerWrapper) CaddyModule() caddy.ModuleInfo {
 func (lw *ListenerWrapper) Provision(ctx caddy.Context) error {
 	lw.ctx = ctx
 	lw.logger = ctx.Logger()
+	lw.metrics = newServerMetrics(ctx.GetMetricsRegistry())
 
 	if lw.MatchingTimeout <= 0 {
 		lw.MatchingTimeout = caddy.Duration(MatchingTimeoutDefault)
 	}
 
+	if lw.Logs != nil {
+		err := lw.Logs.provision(lw.logger)
+		if err != nil {
+			return fmt.Errorf("setting up access logs: %v", err)
+		}
+	}
+
 	err := lw.Routes.Provision(ctx)
 	if err != nil {
 		return err
 	}
-	lw.compiledRoute = lw.Routes.Compile(lw.logger, time.Duration(lw.MatchingTimeout), listenerHandler{})
+	err = lw.Errors.Provision(ctx)
+	if err != nil {
+		return err
+	}
+	lw.compiledRoute = lw.Errors.Wrap(lw.Routes.Compile(lw.logger, time.Duration(lw.MatchingTimeout), listenerHandler{}),
+		lw.logger, time.Duration(lw.MatchingTimeout), nopHandler{})
 
 	return nil
 }
@@ -65,6 +88,8 @@ func (lw *ListenerWrapper) WrapListener(l net.Listener) net.Listener {
 	li := &listener{
 		Listener:      l,
 		logger:        lw.logger,
+		logs:          lw.Logs,
+		metrics:       lw.metrics,
 		compiledRoute: lw.compiledRoute,
 		done:          make(chan struct{}),
 		connChan:      connChan,
@@ -78,6 +103,12 @@ func (lw *ListenerWrapper) WrapListener(l net.Listener) net.Listener {
 //
 //	layer4 {
 //		matching_timeout <duration>
+//		log [<logger_name>] {
+//			<log_option> [<log_option_args>]
+//		}
+//		handle_errors {
+//			<routes>
+//		}
 //		@a <matcher> [<matcher_args>]
 //		@b {
 //			<matcher> [<matcher_args>]
@@ -104,16 +135,45 @@ func (lw *ListenerWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		return d.ArgErr()
 	}
 
-	if err := ParseCaddyfileNestedRoutes(d, &lw.Routes, &lw.MatchingTimeout, nil); err != nil {
+	if err := ParseCaddyfileNestedRoutesWithOptions(d, &lw.Routes, &lw.MatchingTimeout, nil,
+		lw.unmarshalCaddyfileOption); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// unmarshalCaddyfileOption sets up the ListenerWrapper's options other than routes and timeouts from Caddyfile tokens.
+func (lw *ListenerWrapper) unmarshalCaddyfileOption(d *caddyfile.Dispenser, optionName string) (bool, error) {
+	switch optionName {
+	case "log":
+		if lw.Logs != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		lw.Logs = new(ServerLogConfig)
+		if err := lw.Logs.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+	case "handle_errors":
+		if lw.Errors != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		lw.Errors = new(ErrorRoutes)
+		if err := lw.Errors.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
 type listener struct {
 	net.Listener
 	logger        *zap.Logger
+	logs          *ServerLogConfig
+	metrics       *serverMetrics
 	compiledRoute Handler
 
 	closed atomic.Bool
@@ -176,18 +236,32 @@ func (l *listener) handle(conn net.Conn) {
 
 	cx := WrapConnection(conn, buf, l.logger)
 	cx.Context = context.WithValue(cx.Context, listenerCtxKey, l)
+	cx.repl.Set(connListenerReplKey, l.Addr().String())
+	listener := l.Addr().String()
+	cx.onPanic = func() { l.metrics.panicRecovered("", listener) }
+
+	entry := activeConns.add(cx, "", listener)
+	defer activeConns.remove(entry)
 
 	start := time.Now()
-	err = l.compiledRoute.Handle(cx)
+	l.metrics.connectionOpened("", listener)
+	defer func() { l.metrics.connectionClosed("", listener, cx, start) }()
+
+	err = handleRecovering(l.compiledRoute, cx, "listener_wrapper")
 	duration := time.Since(start)
-	if err != nil && !errors.Is(err, errHijacked) {
-		l.logger.Error("handling connection", zap.Error(err))
+	if err != nil && !errors.Is(err, errHijacked) && !errors.Is(err, ErrPanicked) {
+		cx.Logger.Error("handling connection", zap.Error(err))
+	}
+
+	if !errors.Is(err, errHijacked) {
+		setCloseReason(cx, err)
+		l.logs.logConnection(cx, duration, err)
 	}
 
-	l.logger.Debug("connection stats",
+	cx.Logger.Debug("connection stats",
 		zap.String("remote", cx.RemoteAddr().String()),
-		zap.Uint64("read", cx.bytesRead),
-		zap.Uint64("written", cx.bytesWritten),
+		zap.Uint64("read", cx.bytesRead.Load()),
+		zap.Uint64("written", cx.bytesWritten.Load()),
 		zap.Duration("duration", duration),
 	)
 }
@@ -0,0 +1,299 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ServerLogConfig describes a server's access log configuration. If enabled,
+// one structured entry is emitted for every connection the server handles,
+// once the connection is closed. Entries are emitted by a logger named
+// "layer4.log.access" (or "caddy.listeners.layer4.log.access" for listener
+// wrappers), so they can be routed to any sink with Caddy's logging config.
+type ServerLogConfig struct {
+	// LoggerName is an optional suffix appended to the access logger name,
+	// e.g. a value of "ssh" makes the server emit its access logs with
+	// the "layer4.log.access.ssh" logger.
+	LoggerName string `json:"logger_name,omitempty"`
+
+	// Fields are extra fields added to each access log entry. Keys are field
+	// names, and values may contain placeholders that are evaluated when the
+	// connection is closed, e.g. `{l4.tls.server_name}` or `{l4.proxy.upstream}`.
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// SkipRemoteIPs is a list of IP ranges (or CIDRs) connections from which
+	// are not logged. Connections may also be excluded from the access log
+	// by setting the `log_skip` variable to true with the `vars` handler.
+	SkipRemoteIPs []string `json:"skip_remote_ips,omitempty"`
+
+	// Sampling configures access log entry sampling. If enabled, only some
+	// entries within the given interval are emitted. This is useful for
+	// servers handling a high rate of connections.
+	Sampling *caddy.LogSampling `json:"sampling,omitempty"`
+
+	logger    *zap.Logger
+	skipCIDRs []netip.Prefix
+}
+
+// provision sets up the access logger as a child of logger.
+func (slc *ServerLogConfig) provision(logger *zap.Logger) error {
+	repl := caddy.NewReplacer()
+	for _, addrOrCIDR := range slc.SkipRemoteIPs {
+		addrOrCIDR = repl.ReplaceAll(addrOrCIDR, "")
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(addrOrCIDR)
+		if err != nil {
+			return fmt.Errorf("skip remote IPs: %v", err)
+		}
+		slc.skipCIDRs = append(slc.skipCIDRs, prefix)
+	}
+
+	slc.logger = logger.Named("log.access")
+	if slc.LoggerName != "" {
+		slc.logger = slc.logger.Named(slc.LoggerName)
+	}
+
+	if slc.Sampling != nil {
+		// use the same defaults as Caddy does for sampled logs
+		if slc.Sampling.Interval == 0 {
+			slc.Sampling.Interval = 1 * time.Second
+		}
+		if slc.Sampling.First == 0 {
+			slc.Sampling.First = 100
+		}
+		if slc.Sampling.Thereafter == 0 {
+			slc.Sampling.Thereafter = 100
+		}
+		sampling := slc.Sampling
+		slc.logger = slc.logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, sampling.Interval, sampling.First, sampling.Thereafter)
+		}))
+	}
+
+	return nil
+}
+
+// shouldLog returns true if the connection should be logged.
+func (slc *ServerLogConfig) shouldLog(cx *Connection) bool {
+	if slc == nil || slc.logger == nil {
+		return false
+	}
+
+	// this connection may be flagged as omitted from the logs
+	if skip, ok := cx.GetVar(LogSkipVar).(bool); ok && skip {
+		return false
+	}
+
+	if len(slc.skipCIDRs) > 0 {
+		remote := cx.RemoteAddr().String()
+		ipStr, _, err := net.SplitHostPort(remote)
+		if err != nil {
+			ipStr = remote // OK; probably didn't have a port
+		}
+		if ip, err := netip.ParseAddr(ipStr); err == nil {
+			for _, prefix := range slc.skipCIDRs {
+				if prefix.Contains(ip) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// logConnection emits an access log entry for cx, unless skipped.
+func (slc *ServerLogConfig) logConnection(cx *Connection, duration time.Duration, err error) {
+	if !slc.shouldLog(cx) {
+		return
+	}
+
+	repl := cx.Replacer()
+	closeReason, _ := repl.GetString(connCloseReasonReplKey)
+
+	fields := make([]zap.Field, 0, 10+len(slc.Fields))
+	fields = append(fields,
+		cx.IDField(),
+		zap.String("network", cx.LocalAddr().Network()),
+		zap.String("local", cx.LocalAddr().String()),
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.Uint64("bytes_read", cx.bytesRead.Load()),
+		zap.Uint64("bytes_written", cx.bytesWritten.Load()),
+		zap.Duration("duration", duration),
+		zap.String("close_reason", closeReason),
+	)
+	if routeName, ok := repl.GetString(routeNameReplKey); ok && routeName != "" {
+		fields = append(fields, zap.String("route", routeName))
+	}
+	for name, value := range slc.Fields {
+		fields = append(fields, zap.String(name, repl.ReplaceAll(value, "")))
+	}
+
+	logFunc := slc.logger.Info
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+		logFunc = slc.logger.Error
+	}
+	logFunc("handled connection", fields...)
+}
+
+// UnmarshalCaddyfile sets up the ServerLogConfig from Caddyfile tokens. Syntax:
+//
+//	log [<logger_name>] {
+//		field <name> <value>
+//		skip_remote_ip <ranges...>
+//		sampling_interval <duration>
+//		sampling_first <int>
+//		sampling_thereafter <int>
+//	}
+func (slc *ServerLogConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+	if d.NextArg() {
+		slc.LoggerName = d.Val()
+	}
+
+	var hasSamplingInterval, hasSamplingFirst, hasSamplingThereafter bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "field":
+			if d.CountRemainingArgs() != 2 {
+				return d.ArgErr()
+			}
+			_, name, _, value := d.NextArg(), d.Val(), d.NextArg(), d.Val()
+			if slc.Fields == nil {
+				slc.Fields = make(map[string]string)
+			}
+			if _, exists := slc.Fields[name]; exists {
+				return d.Errf("duplicate %s field '%s'", wrapper, name)
+			}
+			slc.Fields[name] = value
+		case "skip_remote_ip":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			for d.NextArg() {
+				val := d.Val()
+				if val == "private_ranges" {
+					slc.SkipRemoteIPs = append(slc.SkipRemoteIPs, caddyhttp.PrivateRangesCIDR()...)
+					continue
+				}
+				slc.SkipRemoteIPs = append(slc.SkipRemoteIPs, val)
+			}
+		case "sampling_interval":
+			if hasSamplingInterval {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+			}
+			if slc.Sampling == nil {
+				slc.Sampling = &caddy.LogSampling{}
+			}
+			slc.Sampling.Interval, hasSamplingInterval = dur, true
+		case "sampling_first":
+			if hasSamplingFirst {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			if slc.Sampling == nil {
+				slc.Sampling = &caddy.LogSampling{}
+			}
+			slc.Sampling.First, hasSamplingFirst = int(val), true
+		case "sampling_thereafter":
+			if hasSamplingThereafter {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseInt(d.Val(), 10, 32)
+			if err != nil {
+				return d.Errf("parsing %s option '%s': %v", wrapper, optionName, err)
+			}
+			if slc.Sampling == nil {
+				slc.Sampling = &caddy.LogSampling{}
+			}
+			slc.Sampling.Thereafter, hasSamplingThereafter = int(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// LogSkipVar is the name of the connection variable which, if set to true,
+// excludes the connection from the access log.
+const LogSkipVar = "log_skip"
+
+// Possible values of the {l4.conn.close_reason} placeholder.
+const (
+	closeReasonCompleted       = "completed"
+	closeReasonHandlerError    = "handler_error"
+	closeReasonMatchingError   = "matching_error"
+	closeReasonMatchingTimeout = "matching_timeout"
+	closeReasonPanic           = "panic"
+	closeReasonAdmin           = "admin"
+)
+
+// setCloseReason records why handling of cx has ended, unless
+// a more specific reason has already been recorded by routing.
+func setCloseReason(cx *Connection, err error) {
+	if _, ok := cx.repl.Get(connCloseReasonReplKey); ok {
+		return
+	}
+	if err != nil {
+		cx.repl.Set(connCloseReasonReplKey, closeReasonHandlerError)
+	} else {
+		cx.repl.Set(connCloseReasonReplKey, closeReasonCompleted)
+	}
+}
+
+// Interface guard
+var _ caddyfile.Unmarshaler = (*ServerLogConfig)(nil)
@@ -0,0 +1,130 @@
+package layer4
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestServerLogConfigLogsConnection(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	slc := &ServerLogConfig{
+		LoggerName: "ssh",
+		Fields:     map[string]string{"upstream": "{l4.proxy.upstream}"},
+	}
+	if err := slc.provision(zap.New(core)); err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	cx := newTestTCPConnection(t)
+	cx.bytesRead.Store(10)
+	cx.bytesWritten.Store(20)
+	cx.repl.Set(routeNameReplKey, "ssh")
+	cx.repl.Set(ProxyUpstreamReplKey, "tcp/10.0.0.1:22")
+	setCloseReason(cx, nil)
+	slc.logConnection(cx, time.Second, nil)
+
+	failed := newTestTCPConnection(t)
+	setCloseReason(failed, errors.New("dial failed"))
+	slc.logConnection(failed, time.Second, errors.New("dial failed"))
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if e := entries[0]; e.LoggerName != "log.access.ssh" || e.Level != zapcore.InfoLevel || e.Message != "handled connection" {
+		t.Fatalf("unexpected entry: %+v", e.Entry)
+	}
+	fields := entries[0].ContextMap()
+	for name, expected := range map[string]any{
+		connIDLogKey:    cx.id,
+		"network":       "tcp",
+		"remote":        cx.RemoteAddr().String(),
+		"bytes_read":    uint64(10),
+		"bytes_written": uint64(20),
+		"duration":      time.Second,
+		"close_reason":  closeReasonCompleted,
+		"route":         "ssh",
+		"upstream":      "tcp/10.0.0.1:22",
+	} {
+		if fields[name] != expected {
+			t.Errorf("expected field %s to be %v, got %v", name, expected, fields[name])
+		}
+	}
+
+	// failed connections are logged at error level with the error, and unset fields are omitted
+	fields = entries[1].ContextMap()
+	if entries[1].Level != zapcore.ErrorLevel || fields["close_reason"] != closeReasonHandlerError ||
+		fields["error"] != "dial failed" || fields["upstream"] != "" {
+		t.Fatalf("unexpected entry: %+v %v", entries[1].Entry, fields)
+	}
+	if _, ok := fields["route"]; ok {
+		t.Fatal("expected no route field for a connection matched by no named route")
+	}
+}
+
+func TestServerLogConfigSkipsConnections(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		skipIPs   []string
+		logSkip   bool
+		expectLog bool
+	}{
+		{name: "no skip", expectLog: true},
+		{name: "skipped remote IP", skipIPs: []string{"192.0.2.0/24", "127.0.0.0/8"}},
+		{name: "other remote IP", skipIPs: []string{"192.0.2.1"}, expectLog: true},
+		{name: "log_skip variable", logSkip: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(zapcore.InfoLevel)
+			slc := &ServerLogConfig{SkipRemoteIPs: tc.skipIPs}
+			if err := slc.provision(zap.New(core)); err != nil {
+				t.Fatalf("provision failed | %s", err)
+			}
+
+			cx := newTestTCPConnection(t)
+			if tc.logSkip {
+				cx.SetVar(LogSkipVar, true)
+			}
+			slc.logConnection(cx, time.Second, nil)
+
+			if logged := logs.Len() == 1; logged != tc.expectLog {
+				t.Fatalf("expected the connection to be logged: %t", tc.expectLog)
+			}
+		})
+	}
+
+	// invalid ranges are rejected
+	if err := (&ServerLogConfig{SkipRemoteIPs: []string{"not an IP"}}).provision(zap.NewNop()); err == nil {
+		t.Fatal("expected an error for an invalid IP range")
+	}
+}
+
+func TestServerLogConfigSamplesEntries(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	slc := &ServerLogConfig{Sampling: &caddy.LogSampling{Interval: time.Minute, First: 2, Thereafter: 3}}
+	if err := slc.provision(zap.New(core)); err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+
+	cx := newTestTCPConnection(t)
+	for range 8 {
+		slc.logConnection(cx, time.Second, nil)
+	}
+
+	// the first 2 entries, and then every 3rd one: 1, 2, 5 and 8
+	if logs.Len() != 4 {
+		t.Fatalf("expected 4 sampled entries, got %d", logs.Len())
+	}
+}
+
+func TestServerLogConfigNilSafe(t *testing.T) {
+	var slc *ServerLogConfig // a server without access logs
+
+	slc.logConnection(newTestTCPConnection(t), time.Second, nil)
+}
@@ -16,9 +16,12 @@ package layer4
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -29,7 +32,10 @@ import (
 func init() {
 	caddy.RegisterModule(&MatchRemoteIP{})
 	caddy.RegisterModule(&MatchLocalIP{})
+	caddy.RegisterModule(&MatchNetwork{})
 	caddy.RegisterModule(&MatchNot{})
+	caddy.RegisterModule(&MatchAll{})
+	caddy.RegisterModule(&MatchAny{})
 }
 
 // ConnMatcher is a type that can match a connection.
@@ -40,6 +46,31 @@ type ConnMatcher interface {
 	Match(*Connection) (bool, error)
 }
 
+// TimedMatcher is a ConnMatcher whose outcome depends on the time elapsed since the start of matching, rather than
+// only on the data received, e.g. a matcher of clients remaining silent. Since matching otherwise waits for more data,
+// routes are also re-evaluated once each of the checkpoints has elapsed since the start of matching, even if no data
+// has been received meanwhile. Such matchers should return ErrConsumedAllPrefetchedBytes until they can decide.
+type TimedMatcher interface {
+	ConnMatcher
+
+	// MatchingCheckpoints returns the durations since the start of matching at which routes are re-evaluated.
+	MatchingCheckpoints() []time.Duration
+}
+
+// matchingCheckpoints returns the checkpoints of all timed matchers in mss, sorted and deduplicated.
+func matchingCheckpoints(mss []MatcherSet) []time.Duration {
+	var checkpoints []time.Duration
+	for _, ms := range mss {
+		for _, m := range ms {
+			if tm, ok := m.(TimedMatcher); ok {
+				checkpoints = append(checkpoints, tm.MatchingCheckpoints()...)
+			}
+		}
+	}
+	slices.Sort(checkpoints)
+	return slices.Compact(checkpoints)
+}
+
 // MatcherSet is a set of matchers which
 // must all match in order for the request
 // to be matched successfully.
@@ -281,6 +312,98 @@ func (m *MatchLocalIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// MatchNetwork matches connections by the network type of the listener they have been accepted on
+// (e.g. `tcp`, `udp` or `unix`), the IP family of their remote address (`ip4` or `ip6`), or both
+// (e.g. `tcp4` or `udp6`). The network type is determined before any handlers wrap connections,
+// while the remote address follows them, e.g. it's the client's address after `proxy_protocol`.
+type MatchNetwork struct {
+	Networks []string `json:"networks,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchNetwork) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.network",
+		New: func() caddy.Module { return new(MatchNetwork) },
+	}
+}
+
+// Provision validates m's networks.
+func (m *MatchNetwork) Provision(_ caddy.Context) error {
+	for _, network := range m.Networks {
+		switch network {
+		case "ip4", "ip6", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixgram", "unixpacket":
+		default:
+			return fmt.Errorf("unsupported network: %s", network)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the connection is of one of the designated networks.
+func (m *MatchNetwork) Match(cx *Connection) (bool, error) {
+	network, _ := cx.repl.GetString(connNetworkReplKey)
+	family := m.getRemoteFamily(cx)
+	for _, n := range m.Networks {
+		switch n {
+		case "ip4", "ip6":
+			if family == n {
+				return true, nil
+			}
+		case "tcp4", "tcp6", "udp4", "udp6":
+			if network == n[:3] && family == "ip"+n[3:] {
+				return true, nil
+			}
+		default:
+			if network == n {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// getRemoteFamily returns `ip4` or `ip6` depending on the remote address of the connection,
+// or an empty string if it isn't an IP address. IPv4-mapped IPv6 addresses are treated as IPv4.
+func (m *MatchNetwork) getRemoteFamily(cx *Connection) string {
+	remote := cx.Conn.RemoteAddr().String()
+
+	ipStr, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		ipStr = remote // OK; probably didn't have a port
+	}
+
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return ""
+	}
+	if ip.Unmap().Is4() {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// UnmarshalCaddyfile sets up the MatchNetwork from Caddyfile tokens. Syntax:
+//
+//	network <networks...>
+func (m *MatchNetwork) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// At least one same-line option must be provided
+	if d.CountRemainingArgs() == 0 {
+		return d.ArgErr()
+	}
+
+	m.Networks = append(m.Networks, d.RemainingArgs()...)
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed layer4 connection matcher '%s': blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
 // MatchNot matches requests by negating the results of its matcher
 // sets. A single "not" matcher takes one or more matcher sets. Each
 // matcher set is OR'ed; in other words, if any matcher set returns
@@ -347,9 +470,16 @@ func (m *MatchNot) Provision(ctx caddy.Context) error {
 // Match returns true if r matches m. Since this matcher negates
 // the embedded matchers, false is returned if any of its matcher
 // sets return true.
+// If any matcher set needs more data, and no other matcher set
+// returns true, ErrConsumedAllPrefetchedBytes is returned.
 func (m *MatchNot) Match(r *Connection) (bool, error) {
+	var pending error
 	for _, ms := range m.MatcherSets {
 		match, err := ms.Match(r)
+		if errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+			pending = err
+			continue
+		}
 		if err != nil {
 			return false, err
 		}
@@ -357,9 +487,17 @@ func (m *MatchNot) Match(r *Connection) (bool, error) {
 			return false, nil
 		}
 	}
+	if pending != nil {
+		return false, pending
+	}
 	return true, nil
 }
 
+// MatchingCheckpoints returns the checkpoints of the timed matchers m negates.
+func (m *MatchNot) MatchingCheckpoints() []time.Duration {
+	return matchingCheckpoints(m.MatcherSets)
+}
+
 // UnmarshalCaddyfile sets up the MatchNot from Caddyfile tokens. Syntax:
 //
 //	not {
@@ -387,6 +525,217 @@ func (m *MatchNot) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// MatchAll matches connections matched by all of its matcher sets.
+// Individual matchers within a set work the same (i.e. different
+// matchers in the same set are AND'ed). Together with MatchAny and
+// MatchNot, it allows for expressing arbitrary boolean combinations
+// of matchers within a single matcher set of a route.
+//
+// NOTE: The generated docs which describe the structure of this
+// module are wrong because of how this type unmarshals JSON in a
+// custom way. The correct structure is an array of matcher sets,
+// the same as for the "not" matcher.
+type MatchAll struct {
+	MatcherSetsRaw []caddy.ModuleMap `json:"-" caddy:"namespace=layer4.matchers"`
+	MatcherSets    MatcherSets       `json:"-"`
+}
+
+// CaddyModule implements caddy.Module.
+func (*MatchAll) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.all",
+		New: func() caddy.Module { return new(MatchAll) },
+	}
+}
+
+// UnmarshalJSON satisfies json.Unmarshaler. It puts the JSON
+// bytes directly into m's MatcherSetsRaw field.
+func (m *MatchAll) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.MatcherSetsRaw)
+}
+
+// MarshalJSON satisfies json.Marshaler by marshaling
+// m's raw matcher sets.
+func (m *MatchAll) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.MatcherSetsRaw)
+}
+
+// Provision loads the matcher modules to be combined.
+func (m *MatchAll) Provision(ctx caddy.Context) error {
+	matcherSets, err := ctx.LoadModule(m, "MatcherSetsRaw")
+	if err != nil {
+		return fmt.Errorf("loading matcher sets: %v", err)
+	}
+	return m.MatcherSets.FromInterface(matcherSets)
+}
+
+// Match returns true if all of m's matcher sets return true. False is returned
+// as soon as any matcher set returns false, even if other matcher sets need
+// more data. Otherwise, ErrConsumedAllPrefetchedBytes is returned until
+// all matcher sets have got enough data to decide.
+func (m *MatchAll) Match(cx *Connection) (bool, error) {
+	var pending error
+	for _, ms := range m.MatcherSets {
+		match, err := ms.Match(cx)
+		if errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+			pending = err
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	if pending != nil {
+		return false, pending
+	}
+	return true, nil
+}
+
+// MatchingCheckpoints returns the checkpoints of the timed matchers m combines.
+func (m *MatchAll) MatchingCheckpoints() []time.Duration {
+	return matchingCheckpoints(m.MatcherSets)
+}
+
+// UnmarshalCaddyfile sets up the MatchAll from Caddyfile tokens. Syntax:
+//
+//	all {
+//		<matcher> {
+//			<submatcher> [<args...>]
+//		}
+//		<matcher>
+//	}
+//	all <matcher> {
+//		<submatcher> [<args...>]
+//	}
+//	all <matcher>
+//
+// Note: all matchers inside an all block are parsed into a single matcher set, i.e. they are ANDed.
+func (m *MatchAll) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+
+	matcherSet, err := ParseCaddyfileNestedMatcherSet(d)
+	if err != nil {
+		return err
+	}
+	m.MatcherSetsRaw = append(m.MatcherSetsRaw, matcherSet)
+
+	return nil
+}
+
+// MatchAny matches connections matched by any of its matcher sets.
+// Individual matchers within a set work the same (i.e. different
+// matchers in the same set are AND'ed). Together with MatchAll and
+// MatchNot, it allows for expressing arbitrary boolean combinations
+// of matchers within a single matcher set of a route.
+//
+// NOTE: The generated docs which describe the structure of this
+// module are wrong because of how this type unmarshals JSON in a
+// custom way. The correct structure is an array of matcher sets,
+// the same as for the "not" matcher.
+type MatchAny struct {
+	MatcherSetsRaw []caddy.ModuleMap `json:"-" caddy:"namespace=layer4.matchers"`
+	MatcherSets    MatcherSets       `json:"-"`
+}
+
+// CaddyModule implements caddy.Module.
+func (*MatchAny) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.any",
+		New: func() caddy.Module { return new(MatchAny) },
+	}
+}
+
+// UnmarshalJSON satisfies json.Unmarshaler. It puts the JSON
+// bytes directly into m's MatcherSetsRaw field.
+func (m *MatchAny) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.MatcherSetsRaw)
+}
+
+// MarshalJSON satisfies json.Marshaler by marshaling
+// m's raw matcher sets.
+func (m *MatchAny) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.MatcherSetsRaw)
+}
+
+// Provision loads the matcher modules to be combined.
+func (m *MatchAny) Provision(ctx caddy.Context) error {
+	matcherSets, err := ctx.LoadModule(m, "MatcherSetsRaw")
+	if err != nil {
+		return fmt.Errorf("loading matcher sets: %v", err)
+	}
+	return m.MatcherSets.FromInterface(matcherSets)
+}
+
+// Match returns true if any of m's matcher sets returns true. True is returned
+// as soon as any matcher set returns true, even if other matcher sets need
+// more data. Otherwise, ErrConsumedAllPrefetchedBytes is returned until
+// all matcher sets have got enough data to decide.
+func (m *MatchAny) Match(cx *Connection) (bool, error) {
+	var pending error
+	for _, ms := range m.MatcherSets {
+		match, err := ms.Match(cx)
+		if errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+			pending = err
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, pending
+}
+
+// MatchingCheckpoints returns the checkpoints of the timed matchers m combines.
+func (m *MatchAny) MatchingCheckpoints() []time.Duration {
+	return matchingCheckpoints(m.MatcherSets)
+}
+
+// UnmarshalCaddyfile sets up the MatchAny from Caddyfile tokens. Syntax:
+//
+//	any {
+//		<matcher> {
+//			<submatcher> [<args...>]
+//		}
+//		<matcher>
+//	}
+//	any <matcher> {
+//		<submatcher> [<args...>]
+//	}
+//	any <matcher>
+//
+// Note: each matcher inside an any block is parsed into a separate matcher set, i.e. they are ORed. Matchers
+// that must be ANDed within an any block may be wrapped into an all matcher. The same matcher may be repeated.
+func (m *MatchAny) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Token() // consume wrapper name
+
+	for nesting := d.Nesting(); d.NextArg() || d.NextBlock(nesting); {
+		segment := d.NextSegment()
+
+		// parse each matcher as if it were the only one wrapped
+		wrapper.Line, wrapper.File = segment[0].Line, segment[0].File
+		dd := caddyfile.NewDispenser(append([]caddyfile.Token{wrapper}, segment...))
+		dd.Next() // consume wrapper name
+
+		matcherSet, err := ParseCaddyfileNestedMatcherSet(dd)
+		if err != nil {
+			return err
+		}
+		m.MatcherSetsRaw = append(m.MatcherSetsRaw, matcherSet)
+	}
+
+	if len(m.MatcherSetsRaw) == 0 {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
 // Interface guards
 var (
 	_ caddy.Module          = (*MatchRemoteIP)(nil)
@@ -397,8 +746,23 @@ var (
 	_ ConnMatcher           = (*MatchLocalIP)(nil)
 	_ caddy.Provisioner     = (*MatchLocalIP)(nil)
 	_ caddyfile.Unmarshaler = (*MatchLocalIP)(nil)
+	_ caddy.Module          = (*MatchNetwork)(nil)
+	_ ConnMatcher           = (*MatchNetwork)(nil)
+	_ caddy.Provisioner     = (*MatchNetwork)(nil)
+	_ caddyfile.Unmarshaler = (*MatchNetwork)(nil)
 	_ caddy.Module          = (*MatchNot)(nil)
 	_ caddy.Provisioner     = (*MatchNot)(nil)
 	_ ConnMatcher           = (*MatchNot)(nil)
+	_ TimedMatcher          = (*MatchNot)(nil)
 	_ caddyfile.Unmarshaler = (*MatchNot)(nil)
+	_ caddy.Module          = (*MatchAll)(nil)
+	_ caddy.Provisioner     = (*MatchAll)(nil)
+	_ ConnMatcher           = (*MatchAll)(nil)
+	_ TimedMatcher          = (*MatchAll)(nil)
+	_ caddyfile.Unmarshaler = (*MatchAll)(nil)
+	_ caddy.Module          = (*MatchAny)(nil)
+	_ caddy.Provisioner     = (*MatchAny)(nil)
+	_ ConnMatcher           = (*MatchAny)(nil)
+	_ TimedMatcher          = (*MatchAny)(nil)
+	_ caddyfile.Unmarshaler = (*MatchAny)(nil)
 )
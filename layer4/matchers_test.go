@@ -1,6 +1,7 @@
 package layer4
 
 import (
+	"errors"
 	"net"
 	"testing"
 
@@ -215,3 +216,123 @@ func TestNotMatcher(t *testing.T) {
 		}
 	}
 }
+
+// testNeedsMoreMatcher is a matcher that never has enough data to decide.
+type testNeedsMoreMatcher struct{}
+
+func (testNeedsMoreMatcher) Match(*Connection) (bool, error) {
+	return false, ErrConsumedAllPrefetchedBytes
+}
+
+func TestAllAnyMatchers(t *testing.T) {
+	cx := WrapConnection(&dummyConn{
+		localAddr:  dummyAddr{ip: "127.0.0.1", network: "tcp"},
+		remoteAddr: dummyAddr{ip: "192.168.0.1", network: "tcp"},
+	}, []byte{}, zap.NewNop())
+
+	local := provision(&MatchLocalIP{Ranges: []string{"127.0.0.1"}})
+	remote := provision(&MatchRemoteIP{Ranges: []string{"192.168.0.0/16"}})
+	other := provision(&MatchRemoteIP{Ranges: []string{"172.16.0.0/12"}})
+	needsMore := testNeedsMoreMatcher{}
+
+	for i, tc := range []struct {
+		matcher   ConnMatcher
+		match     bool
+		needsMore bool
+	}{
+		{matcher: &MatchAll{}, match: true},
+		{matcher: &MatchAny{}, match: false},
+		{matcher: &MatchAll{MatcherSets: MatcherSets{{local}, {remote}}}, match: true},
+		{matcher: &MatchAll{MatcherSets: MatcherSets{{local}, {other}}}, match: false},
+		{matcher: &MatchAny{MatcherSets: MatcherSets{{other}, {local, remote}}}, match: true},
+		{matcher: &MatchAny{MatcherSets: MatcherSets{{other}, {local, other}}}, match: false},
+		// a definite result doesn't depend on matchers needing more data
+		{matcher: &MatchAll{MatcherSets: MatcherSets{{needsMore}, {other}}}, match: false},
+		{matcher: &MatchAny{MatcherSets: MatcherSets{{needsMore}, {remote}}}, match: true},
+		{matcher: &MatchNot{MatcherSets: MatcherSets{{needsMore}, {remote}}}, match: false},
+		// otherwise, matchers needing more data make the composites need more data
+		{matcher: &MatchAll{MatcherSets: MatcherSets{{needsMore}, {remote}}}, needsMore: true},
+		{matcher: &MatchAny{MatcherSets: MatcherSets{{needsMore}, {other}}}, needsMore: true},
+		{matcher: &MatchNot{MatcherSets: MatcherSets{{needsMore}, {other}}}, needsMore: true},
+		// (local and remote) or (other and not needsMore)
+		{matcher: &MatchAny{MatcherSets: MatcherSets{
+			{&MatchAll{MatcherSets: MatcherSets{{local}, {remote}}}},
+			{&MatchAll{MatcherSets: MatcherSets{{other}, {&MatchNot{MatcherSets: MatcherSets{{needsMore}}}}}}},
+		}}, match: true},
+		// (other and remote) or not (local and needsMore)
+		{matcher: &MatchAny{MatcherSets: MatcherSets{
+			{&MatchAll{MatcherSets: MatcherSets{{other}, {remote}}}},
+			{&MatchNot{MatcherSets: MatcherSets{{&MatchAll{MatcherSets: MatcherSets{{local}, {needsMore}}}}}}},
+		}}, needsMore: true},
+	} {
+		actual, err := tc.matcher.Match(cx)
+		if tc.needsMore {
+			if !errors.Is(err, ErrConsumedAllPrefetchedBytes) {
+				t.Errorf("Test %d %+v: Expected %v, got: %v", i, tc.matcher, ErrConsumedAllPrefetchedBytes, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d %+v: Expected no error, got: %v", i, tc.matcher, err)
+			continue
+		}
+		if actual != tc.match {
+			t.Errorf("Test %d %+v: Expected %t, got %t", i, tc.matcher, tc.match, actual)
+		}
+	}
+}
+
+func TestNetworkMatcher(t *testing.T) {
+	tcp4 := WrapConnection(&dummyConn{
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.2"), Port: 54321},
+	}, []byte{}, zap.NewNop())
+	udp6 := WrapConnection(&dummyConn{
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53},
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 54321},
+	}, []byte{}, zap.NewNop())
+	unix := WrapConnection(&dummyConn{
+		localAddr:  &net.UnixAddr{Name: "/run/caddy-l4.sock", Net: "unix"},
+		remoteAddr: &net.UnixAddr{Name: "@", Net: "unix"},
+	}, []byte{}, zap.NewNop())
+	// a connection wrapped by a handler, e.g. proxy_protocol, keeps its network type and gets a new remote address
+	wrapped := tcp4.Wrap(&dummyConn{
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 54321},
+	})
+
+	for i, tc := range []struct {
+		cx       *Connection
+		networks []string
+		match    bool
+	}{
+		{cx: tcp4, networks: []string{"tcp"}, match: true},
+		{cx: tcp4, networks: []string{"udp", "unix"}, match: false},
+		{cx: tcp4, networks: []string{"ip4"}, match: true},
+		{cx: tcp4, networks: []string{"tcp6", "udp4"}, match: false},
+		{cx: tcp4, networks: []string{"tcp4"}, match: true},
+		{cx: udp6, networks: []string{"udp"}, match: true},
+		{cx: udp6, networks: []string{"ip4"}, match: false},
+		{cx: udp6, networks: []string{"udp6"}, match: true},
+		{cx: unix, networks: []string{"unix"}, match: true},
+		{cx: unix, networks: []string{"ip4", "ip6", "unixgram"}, match: false},
+		{cx: wrapped, networks: []string{"tcp6"}, match: true},
+		{cx: wrapped, networks: []string{"ip4"}, match: false},
+	} {
+		m := &MatchNetwork{Networks: tc.networks}
+		if err := m.Provision(caddy.Context{}); err != nil {
+			t.Fatalf("Test %d: provision failed | %s", i, err)
+		}
+		matched, err := m.Match(tc.cx)
+		if err != nil {
+			t.Fatalf("Test %d: match failed | %s", i, err)
+		}
+		if matched != tc.match {
+			t.Fatalf("Test %d: matched = %t, want %t", i, matched, tc.match)
+		}
+	}
+
+	if err := (&MatchNetwork{Networks: []string{"sctp"}}).Provision(caddy.Context{}); err == nil {
+		t.Fatal("expected an error for an unsupported network")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverMetrics holds the Prometheus collectors for layer4 servers. They are
+// registered by the app against the instance's metrics registry (obtained from
+// the Caddy context), and all of them are labeled by server name and listener
+// address.
+type serverMetrics struct {
+	connectionsTotal *prometheus.CounterVec
+	activeConns      *prometheus.GaugeVec
+	rejectedConns    *prometheus.CounterVec
+	matchingDuration *prometheus.HistogramVec
+	matchingTimeouts *prometheus.CounterVec
+	routesMatched    *prometheus.CounterVec
+	routesUnmatched  *prometheus.CounterVec
+	bytesReceived    *prometheus.CounterVec
+	bytesSent        *prometheus.CounterVec
+	evictedSessions  *prometheus.CounterVec
+	panicsTotal      *prometheus.CounterVec
+}
+
+// RegisterOrExisting registers c on reg, or returns the collector that
+// is already registered there if an identical one is present, e.g. when
+// the app is provisioned again on config reload with the same registry,
+// or when several handlers of one config share the instance registry.
+// If c can't be registered otherwise, it's returned unregistered, so that
+// recording metrics is a harmless no-op rather than a crash.
+func RegisterOrExisting[C prometheus.Collector](reg *prometheus.Registry, c C) C {
+	if err := reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		// the unregistered collector still works, it just isn't exported
+	}
+	return c
+}
+
+// newServerMetrics creates and registers the server metrics on reg.
+func newServerMetrics(reg *prometheus.Registry) *serverMetrics {
+	const ns, sub = "caddy", "layer4"
+	labels := []string{"server", "listener"}
+	return &serverMetrics{
+		connectionsTotal: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "connections_total",
+			Help:      "Total number of connections accepted by a server.",
+		}, labels)),
+		activeConns: RegisterOrExisting(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "active_connections",
+			Help:      "Number of connections currently being handled by a server.",
+		}, labels)),
+		rejectedConns: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "rejected_connections_total",
+			Help:      "Total number of connections rejected by a server due to connection limits.",
+		}, labels)),
+		matchingDuration: RegisterOrExisting(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "matching_duration_seconds",
+			Help:      "Time it takes a server to match the first route of a connection.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, labels)),
+		matchingTimeouts: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "matching_timeouts_total",
+			Help:      "Total number of connections a server failed to match within the matching timeout.",
+		}, labels)),
+		routesMatched: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "routes_matched_total",
+			Help:      "Total number of connections matched by any route of a server.",
+		}, labels)),
+		routesUnmatched: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "routes_unmatched_total",
+			Help:      "Total number of connections matched by no route of a server.",
+		}, labels)),
+		bytesReceived: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "received_bytes_total",
+			Help:      "Total number of bytes read from connections by a server.",
+		}, labels)),
+		bytesSent: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "sent_bytes_total",
+			Help:      "Total number of bytes written to connections by a server.",
+		}, labels)),
+		evictedSessions: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "udp_sessions_evicted_total",
+			Help:      "Total number of UDP sessions evicted by a server due to session limits.",
+		}, append(labels, "reason"))),
+		panicsTotal: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "panics_total",
+			Help:      "Total number of panics recovered while handling connections.",
+		}, labels)),
+	}
+}
+
+// connectionOpened records the start of handling a connection.
+func (m *serverMetrics) connectionOpened(server, listener string) {
+	if m == nil {
+		return
+	}
+	m.connectionsTotal.WithLabelValues(server, listener).Inc()
+	m.activeConns.WithLabelValues(server, listener).Inc()
+}
+
+// connectionRejected records a connection rejected due to connection limits.
+func (m *serverMetrics) connectionRejected(server, listener string) {
+	if m == nil {
+		return
+	}
+	m.rejectedConns.WithLabelValues(server, listener).Inc()
+}
+
+// sessionEvicted records a UDP session evicted due to the given session limit.
+func (m *serverMetrics) sessionEvicted(server, listener, reason string) {
+	if m == nil {
+		return
+	}
+	m.evictedSessions.WithLabelValues(server, listener, reason).Inc()
+}
+
+// panicRecovered records a panic recovered while handling a connection.
+func (m *serverMetrics) panicRecovered(server, listener string) {
+	if m == nil {
+		return
+	}
+	m.panicsTotal.WithLabelValues(server, listener).Inc()
+}
+
+// connectionClosed records the end of handling cx, including its matching outcome and traffic.
+func (m *serverMetrics) connectionClosed(server, listener string, cx *Connection, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.activeConns.WithLabelValues(server, listener).Dec()
+	m.bytesReceived.WithLabelValues(server, listener).Add(float64(cx.bytesRead.Load()))
+	m.bytesSent.WithLabelValues(server, listener).Add(float64(cx.bytesWritten.Load()))
+
+	closeReason, _ := cx.repl.GetString(connCloseReasonReplKey)
+	if closeReason == closeReasonMatchingTimeout {
+		m.matchingTimeouts.WithLabelValues(server, listener).Inc()
+	}
+	if !cx.matchedAt.IsZero() {
+		m.routesMatched.WithLabelValues(server, listener).Inc()
+		m.matchingDuration.WithLabelValues(server, listener).Observe(cx.matchedAt.Sub(start).Seconds())
+	} else if closeReason != closeReasonMatchingTimeout && closeReason != closeReasonMatchingError {
+		m.routesUnmatched.WithLabelValues(server, listener).Inc()
+	}
+}
+
+// routeMetrics holds the Prometheus collectors for named routes,
+// labeled by route name.
+type routeMetrics struct {
+	matchesTotal     *prometheus.CounterVec
+	handlerErrors    *prometheus.CounterVec
+	matchingDuration *prometheus.HistogramVec
+}
+
+// newRouteMetrics creates and registers the route metrics on reg,
+// reusing any collectors already registered there by another route.
+func newRouteMetrics(reg *prometheus.Registry) *routeMetrics {
+	const ns, sub = "caddy", "layer4_route"
+	labels := []string{"route"}
+	return &routeMetrics{
+		matchesTotal: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "matches_total",
+			Help:      "Total number of connections matched by a route.",
+		}, labels)),
+		handlerErrors: RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "handler_errors_total",
+			Help:      "Total number of errors returned by the handlers of a route.",
+		}, labels)),
+		matchingDuration: RegisterOrExisting(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "matching_duration_seconds",
+			Help:      "Time it takes to match a route since its route list started matching a connection.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, labels)),
+	}
+}
+
+// routeMatched records a connection matched by route after the given time.
+func (m *routeMetrics) routeMatched(route string, timeToMatch time.Duration) {
+	if m == nil {
+		return
+	}
+	m.matchesTotal.WithLabelValues(route).Inc()
+	m.matchingDuration.WithLabelValues(route).Observe(timeToMatch.Seconds())
+}
+
+// handlerFailed records an error returned by the handlers of route.
+func (m *routeMetrics) handlerFailed(route string) {
+	if m == nil {
+		return
+	}
+	m.handlerErrors.WithLabelValues(route).Inc()
+}
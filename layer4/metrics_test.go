@@ -0,0 +1,94 @@
+package layer4
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestServerMetricsConnections(t *testing.T) {
+	m := newServerMetrics(prometheus.NewRegistry())
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	start := time.Now()
+
+	// a matched connection
+	cx1 := WrapConnection(out, []byte{}, zap.NewNop())
+	cx1.bytesRead.Store(10)
+	cx1.bytesWritten.Store(20)
+	cx1.matchedAt = start.Add(5 * time.Millisecond)
+	m.connectionOpened("srv0", ":443")
+
+	// a connection that has timed out while matching
+	cx2 := WrapConnection(out, []byte{}, zap.NewNop())
+	cx2.repl.Set(connCloseReasonReplKey, closeReasonMatchingTimeout)
+	m.connectionOpened("srv0", ":443")
+
+	// a connection that hasn't been matched by any route
+	cx3 := WrapConnection(out, []byte{}, zap.NewNop())
+	cx3.bytesRead.Store(5)
+	m.connectionOpened("srv0", ":443")
+
+	if got := testutil.ToFloat64(m.activeConns.WithLabelValues("srv0", ":443")); got != 3 {
+		t.Errorf("active_connections = %v, want 3", got)
+	}
+
+	m.connectionClosed("srv0", ":443", cx1, start)
+	m.connectionClosed("srv0", ":443", cx2, start)
+	m.connectionClosed("srv0", ":443", cx3, start)
+
+	for name, tc := range map[string]struct {
+		collector prometheus.Collector
+		want      float64
+	}{
+		"connections_total":       {m.connectionsTotal.WithLabelValues("srv0", ":443"), 3},
+		"active_connections":      {m.activeConns.WithLabelValues("srv0", ":443"), 0},
+		"matching_timeouts_total": {m.matchingTimeouts.WithLabelValues("srv0", ":443"), 1},
+		"routes_matched_total":    {m.routesMatched.WithLabelValues("srv0", ":443"), 1},
+		"routes_unmatched_total":  {m.routesUnmatched.WithLabelValues("srv0", ":443"), 1},
+		"received_bytes_total":    {m.bytesReceived.WithLabelValues("srv0", ":443"), 15},
+		"sent_bytes_total":        {m.bytesSent.WithLabelValues("srv0", ":443"), 20},
+	} {
+		if got := testutil.ToFloat64(tc.collector); got != tc.want {
+			t.Errorf("%s = %v, want %v", name, got, tc.want)
+		}
+	}
+
+	if got := testutil.CollectAndCount(m.matchingDuration); got != 1 {
+		t.Errorf("matching_duration_seconds series = %v, want 1", got)
+	}
+}
+
+func TestServerMetricsNilSafe(t *testing.T) {
+	var m *serverMetrics // an app that was never provisioned
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	m.connectionOpened("srv0", ":443")
+	m.connectionRejected("srv0", ":443")
+	m.panicRecovered("srv0", ":443")
+	m.connectionClosed("srv0", ":443", WrapConnection(out, []byte{}, zap.NewNop()), time.Now())
+}
+
+func TestServerMetricsDuplicateRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	m1 := newServerMetrics(reg)
+	m2 := newServerMetrics(reg)
+
+	m1.connectionRejected("srv0", ":443")
+	m2.connectionRejected("srv0", ":443")
+
+	if got := testutil.ToFloat64(m1.rejectedConns.WithLabelValues("srv0", ":443")); got != 2 {
+		t.Errorf("rejected_connections_total = %v, want 2 (collectors must be shared)", got)
+	}
+}
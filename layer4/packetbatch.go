@@ -0,0 +1,254 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchConn is implemented by ipv4.PacketConn and ipv6.PacketConn. On Linux,
+// they read and write multiple datagrams per system call with recvmmsg and
+// sendmmsg. On other platforms, they fall back to one datagram per call.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchPacketConn reads and writes datagrams in batches.
+type batchPacketConn struct {
+	conn    batchConn
+	udpConn *net.UDPConn
+	// whether udpConn is an IPv6 socket that may be dual-stack
+	ipv6   bool
+	size   int
+	writes chan *packetWrite
+	closed chan struct{}
+}
+
+// packetWrite is a datagram waiting to be written in a batch.
+type packetWrite struct {
+	b    []byte
+	addr net.Addr
+	err  chan error
+}
+
+var packetWritePool = sync.Pool{
+	New: func() any {
+		return &packetWrite{err: make(chan error, 1)}
+	},
+}
+
+// newBatchPacketConn returns a batchPacketConn for pc, or nil if pc isn't
+// a UDP socket, e.g. a Unix datagram socket. The caller must call close
+// once the batchPacketConn is no longer used.
+func newBatchPacketConn(pc net.PacketConn, size int) *batchPacketConn {
+	udpConn := unwrapUDPConn(pc)
+	if udpConn == nil {
+		return nil
+	}
+
+	bpc := &batchPacketConn{
+		udpConn: udpConn,
+		size:    size,
+		writes:  make(chan *packetWrite, size),
+		closed:  make(chan struct{}),
+	}
+	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		bpc.conn = ipv4.NewPacketConn(udpConn)
+	} else {
+		// IPv6 sockets may be dual-stack, so they receive IPv4 datagrams as well
+		bpc.conn, bpc.ipv6 = ipv6.NewPacketConn(udpConn), true
+	}
+
+	go bpc.writeLoop()
+
+	return bpc
+}
+
+// unwrapUDPConn returns the UDP socket underlying pc, if any. Caddy wraps
+// the sockets it creates, so that it could track their usage.
+func unwrapUDPConn(pc net.PacketConn) *net.UDPConn {
+	for {
+		switch c := pc.(type) {
+		case *net.UDPConn:
+			return c
+		case interface{ Unwrap() net.PacketConn }:
+			pc = c.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// readPackets reads datagrams in batches and passes each of them to handle,
+// until a non-timeout error occurs. Buffers of the datagrams passed to handle
+// come from udpBufPool, and it's up to handle to put them back.
+func (bpc *batchPacketConn) readPackets(handle func(packet)) error {
+	msgs := make([]ipv4.Message, bpc.size)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{udpBufPool.Get().([]byte)}
+	}
+	defer func() {
+		for i := range msgs {
+			udpBufPool.Put(msgs[i].Buffers[0])
+		}
+	}()
+
+	for {
+		n, err := bpc.conn.ReadBatch(msgs, 0)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		for i := range msgs[:n] {
+			handle(packet{
+				pooledBuf: msgs[i].Buffers[0],
+				n:         msgs[i].N,
+				addr:      msgs[i].Addr,
+			})
+			msgs[i].Buffers[0] = udpBufPool.Get().([]byte)
+			msgs[i].N, msgs[i].Addr = 0, nil
+		}
+	}
+}
+
+// writeTo writes b to addr in the next batch, and waits until it's written.
+func (bpc *batchPacketConn) writeTo(b []byte, addr net.Addr) (int, error) {
+	// batches encode IPv4 destinations as AF_INET socket addresses,
+	// which dual-stack sockets may refuse, so write those one by one
+	if udpAddr, ok := addr.(*net.UDPAddr); bpc.ipv6 && (!ok || udpAddr.IP.To4() != nil) {
+		return bpc.udpConn.WriteTo(b, addr)
+	}
+
+	w := packetWritePool.Get().(*packetWrite)
+	w.b, w.addr = b, addr
+
+	select {
+	case bpc.writes <- w:
+	case <-bpc.closed:
+		packetWritePool.Put(w)
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case err := <-w.err:
+		w.b, w.addr = nil, nil
+		packetWritePool.Put(w)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case <-bpc.closed:
+		// w isn't reused, since it may still be in a batch being written
+		return 0, net.ErrClosed
+	}
+}
+
+// writeLoop writes queued datagrams in batches until bpc is closed.
+func (bpc *batchPacketConn) writeLoop() {
+	msgs := make([]ipv4.Message, bpc.size)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+	batch := make([]*packetWrite, 0, bpc.size)
+
+	for {
+		// wait for the first datagram, then take as many queued ones as fit in a batch
+		select {
+		case w := <-bpc.writes:
+			batch = append(batch, w)
+		case <-bpc.closed:
+			return
+		}
+	collect:
+		for len(batch) < bpc.size {
+			select {
+			case w := <-bpc.writes:
+				batch = append(batch, w)
+			default:
+				break collect
+			}
+		}
+
+		for i, w := range batch {
+			msgs[i].Buffers[0], msgs[i].Addr = w.b, w.addr
+		}
+
+		// a batch may be written partially, so write the rest until done or failed
+		var written int
+		for written < len(batch) {
+			n, err := bpc.conn.WriteBatch(msgs[written:len(batch)], 0)
+			if err != nil {
+				// the datagram that failed gets the error, the following ones are retried
+				batch[written].err <- err
+				written++
+				continue
+			}
+			for _, w := range batch[written : written+n] {
+				w.err <- nil
+			}
+			written += n
+		}
+
+		for i := range batch {
+			msgs[i].Buffers[0], msgs[i].Addr = nil, nil
+			batch[i] = nil
+		}
+		batch = batch[:0]
+	}
+}
+
+// close stops writing datagrams in batches.
+func (bpc *batchPacketConn) close() {
+	close(bpc.closed)
+}
+
+// packetShard is a part of the packet connection table of a server socket.
+// Each shard is served by its own goroutine.
+type packetShard struct {
+	// packets receives the datagrams from downstreams this shard is responsible for.
+	packets chan packet
+	// udpConns tracks active packetConns by downstream address:port. They will
+	// be removed from this map after being closed.
+	udpConns map[string]*packetConn
+	// closeCh is used to receive notifications of socket closures from
+	// packetConn, which allows us to remove stale connections (whose
+	// proxy handlers have completed) from the udpConns map.
+	closeCh chan string
+}
+
+// packetShardIndex returns the index of the shard responsible for addr.
+func packetShardIndex(addr net.Addr, shards int) int {
+	if shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		_, _ = h.Write(udpAddr.IP)
+		_, _ = h.Write([]byte{byte(udpAddr.Port >> 8), byte(udpAddr.Port)})
+	} else {
+		_, _ = h.Write([]byte(addr.String()))
+	}
+	return int(h.Sum32() % uint32(shards)) //nolint:gosec // disable G115
+}
@@ -0,0 +1,169 @@
+package layer4
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// startPacketEchoServer serves a UDP socket on loopback with a server echoing every datagram back.
+func startPacketEchoServer(tb testing.TB, batchSize, shards int) net.Addr {
+	tb.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen | %s", err)
+	}
+
+	server := &Server{
+		IdleTimeout:     caddy.Duration(idleTimeoutDefault),
+		PacketBatchSize: batchSize,
+		PacketShards:    shards,
+		logger:          zap.NewNop(),
+	}
+	server.compiledRoute = RouteList{}.Compile(zap.NewNop(), time.Second, HandlerFunc(func(cx *Connection) error {
+		buf := make([]byte, 9000)
+		for {
+			n, err := cx.Read(buf)
+			if err != nil {
+				return nil
+			}
+			if _, err = cx.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = server.servePacket(pc)
+	}()
+	tb.Cleanup(func() {
+		_ = pc.Close()
+		<-served
+	})
+
+	return pc.LocalAddr()
+}
+
+func TestServePacketBatchedAndSharded(t *testing.T) {
+	for _, tc := range []struct {
+		batchSize int
+		shards    int
+	}{
+		{batchSize: 1, shards: 1},
+		{batchSize: 16, shards: 1},
+		{batchSize: 1, shards: 4},
+		{batchSize: 16, shards: 4},
+	} {
+		t.Run(fmt.Sprintf("batch=%d,shards=%d", tc.batchSize, tc.shards), func(t *testing.T) {
+			addr := startPacketEchoServer(t, tc.batchSize, tc.shards)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+			for i := range 8 {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					client, err := net.Dial("udp", addr.String())
+					if err != nil {
+						errs <- err
+						return
+					}
+					defer func() { _ = client.Close() }()
+
+					buf := make([]byte, 64)
+					for j := range 10 {
+						msg := fmt.Appendf(nil, "client %d message %d", i, j)
+						_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+						if _, err = client.Write(msg); err != nil {
+							errs <- err
+							return
+						}
+						n, err := client.Read(buf)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if !bytes.Equal(buf[:n], msg) {
+							errs <- fmt.Errorf("expected %q, got %q", msg, buf[:n])
+							return
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPacketShardIndexIsStable(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	index := packetShardIndex(addr, 8)
+	if index < 0 || index >= 8 {
+		t.Fatalf("expected index within [0, 8), got %d", index)
+	}
+	for range 10 {
+		if i := packetShardIndex(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, 8); i != index {
+			t.Fatalf("expected the same index %d for the same address, got %d", index, i)
+		}
+	}
+	if i := packetShardIndex(addr, 1); i != 0 {
+		t.Fatalf("expected index 0 for a single shard, got %d", i)
+	}
+}
+
+// BenchmarkServePacket compares the unbatched single-table receive path with the batched and sharded ones.
+// Each iteration is a datagram round trip from one of many concurrent downstreams.
+func BenchmarkServePacket(b *testing.B) {
+	for _, bc := range []struct {
+		batchSize int
+		shards    int
+	}{
+		{batchSize: 1, shards: 1},
+		{batchSize: 32, shards: 1},
+		{batchSize: 1, shards: 8},
+		{batchSize: 32, shards: 8},
+	} {
+		b.Run(fmt.Sprintf("batch=%d,shards=%d", bc.batchSize, bc.shards), func(b *testing.B) {
+			addr := startPacketEchoServer(b, bc.batchSize, bc.shards)
+			msg := bytes.Repeat([]byte{'x'}, 512)
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				client, err := net.Dial("udp", addr.String())
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer func() { _ = client.Close() }()
+
+				buf := make([]byte, len(msg))
+				for pb.Next() {
+					_ = client.SetDeadline(time.Now().Add(time.Second))
+					if _, err = client.Write(msg); err != nil {
+						b.Error(err)
+						return
+					}
+					// a lost datagram only costs this iteration its deadline
+					_, _ = client.Read(buf)
+				}
+			})
+		})
+	}
+}
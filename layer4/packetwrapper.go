@@ -0,0 +1,504 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(&PacketConnWrapper{})
+}
+
+// PacketConnWrapper is a Caddy module that wraps App as a packet conn wrapper, e.g. for the HTTP/3 server of
+// the HTTP app. Each downstream (i.e. remote address and port pair) is handled as a separate connection, and
+// those not handled by terminal handlers are passed to the next packet conn wrapper or the HTTP/3 server
+// together with all their subsequent datagrams. The wrapped packet conn is a plain net.PacketConn, so the next
+// wrapper can't use the features of *net.UDPConn, e.g. QUIC servers don't get ECN marks and GSO batching.
+type PacketConnWrapper struct {
+	// Routes express composable logic for handling packet connections.
+	Routes RouteList `json:"routes,omitempty"`
+
+	// Errors configures routes that handle connections the primary routes have failed to handle.
+	// Connections are never passed to the next packet conn wrapper by these routes.
+	Errors *ErrorRoutes `json:"errors,omitempty"`
+
+	// Maximum time connections have to complete the matching phase (the first terminal handler is matched). Default: 3s.
+	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
+
+	// Maximum time packet connection association (by downstream address:port) is removed. Default: 30s.
+	// It also applies to downstreams passed to the next packet conn wrapper, so it shouldn't be shorter
+	// than the idle timeout of QUIC connections.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// Enables access logging and configures how access logs are handled.
+	// Connections passed to the next packet conn wrapper aren't logged.
+	Logs *ServerLogConfig `json:"logs,omitempty"`
+
+	compiledRoute Handler
+	metrics       *serverMetrics
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (*PacketConnWrapper) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.packetconns.layer4",
+		New: func() caddy.Module { return new(PacketConnWrapper) },
+	}
+}
+
+// Provision sets up the PacketConnWrapper.
+func (pcw *PacketConnWrapper) Provision(ctx caddy.Context) error {
+	pcw.logger = ctx.Logger()
+	pcw.metrics = newServerMetrics(ctx.GetMetricsRegistry())
+
+	if pcw.MatchingTimeout <= 0 {
+		pcw.MatchingTimeout = caddy.Duration(MatchingTimeoutDefault)
+	}
+
+	if pcw.IdleTimeout <= 0 {
+		pcw.IdleTimeout = caddy.Duration(idleTimeoutDefault)
+	}
+
+	if pcw.Logs != nil {
+		err := pcw.Logs.provision(pcw.logger)
+		if err != nil {
+			return fmt.Errorf("setting up access logs: %v", err)
+		}
+	}
+
+	err := pcw.Routes.Provision(ctx)
+	if err != nil {
+		return err
+	}
+	err = pcw.Errors.Provision(ctx)
+	if err != nil {
+		return err
+	}
+	pcw.compiledRoute = pcw.Errors.Wrap(pcw.Routes.Compile(pcw.logger, time.Duration(pcw.MatchingTimeout), packetListenerHandler{}),
+		pcw.logger, time.Duration(pcw.MatchingTimeout), nopHandler{})
+
+	return nil
+}
+
+// WrapPacketConn wraps pc, so that it only returns the datagrams of downstreams passed by the routes.
+func (pcw *PacketConnWrapper) WrapPacketConn(pc net.PacketConn) net.PacketConn {
+	pl := &packetListener{
+		PacketConn:    pc,
+		logger:        pcw.logger,
+		logs:          pcw.Logs,
+		metrics:       pcw.metrics,
+		compiledRoute: pcw.compiledRoute,
+		idleTimeout:   time.Duration(pcw.IdleTimeout),
+		packets:       make(chan packet, 64),
+		closeCh:       make(chan string, 10),
+		passCh:        make(chan *packetConn),
+		done:          make(chan struct{}),
+	}
+	go pl.loop()
+	return pl
+}
+
+// UnmarshalCaddyfile sets up the PacketConnWrapper from Caddyfile tokens. Syntax:
+//
+//	layer4 {
+//		matching_timeout <duration>
+//		idle_timeout <duration>
+//		log [<logger_name>] {
+//			<log_option> [<log_option_args>]
+//		}
+//		handle_errors {
+//			<routes>
+//		}
+//		@a <matcher> [<matcher_args>]
+//		@b {
+//			<matcher> [<matcher_args>]
+//			<matcher> [<matcher_args>]
+//		}
+//		route @a @b {
+//			<handler> [<handler_args>]
+//		}
+//		@c <matcher> {
+//			<matcher_option> [<matcher_option_args>]
+//		}
+//		route @c {
+//			<handler> [<handler_args>]
+//			<handler> {
+//				<handler_option> [<handler_option_args>]
+//			}
+//		}
+//	}
+func (pcw *PacketConnWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	if err := ParseCaddyfileNestedRoutesWithOptions(d, &pcw.Routes, &pcw.MatchingTimeout, &pcw.IdleTimeout,
+		pcw.unmarshalCaddyfileOption); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// unmarshalCaddyfileOption sets up the PacketConnWrapper's options other than routes and timeouts from Caddyfile tokens.
+func (pcw *PacketConnWrapper) unmarshalCaddyfileOption(d *caddyfile.Dispenser, optionName string) (bool, error) {
+	switch optionName {
+	case "log":
+		if pcw.Logs != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		pcw.Logs = new(ServerLogConfig)
+		if err := pcw.Logs.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+	case "handle_errors":
+		if pcw.Errors != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		pcw.Errors = new(ErrorRoutes)
+		if err := pcw.Errors.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// packetListener is a net.PacketConn that handles downstreams with layer4 routes, and returns the datagrams
+// of the downstreams passed by the routes from ReadFrom. Datagrams are written to the underlying packet conn.
+type packetListener struct {
+	net.PacketConn
+	logger        *zap.Logger
+	logs          *ServerLogConfig
+	metrics       *serverMetrics
+	compiledRoute Handler
+	idleTimeout   time.Duration
+
+	// datagrams of the passed downstreams to be returned from ReadFrom
+	packets chan packet
+	// receives addresses of the closed downstream connections
+	closeCh chan string
+	// receives the downstream connections passed by the routes
+	passCh chan *packetConn
+	// closed once reading from the underlying packet conn fails with err
+	done chan struct{}
+	err  error
+
+	readDeadline packetDeadline
+}
+
+// packetDeadline signals when the deadline set with SetReadDeadline expires.
+type packetDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{} // closed once the deadline expires
+}
+
+// set replaces the deadline with t. A zero t means no deadline.
+func (d *packetDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // the timer has fired, so wait for it to close the channel
+	}
+	d.timer = nil
+
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+
+	dur := time.Until(t)
+	if !t.IsZero() && dur <= 0 {
+		if !isClosed(d.expired) {
+			close(d.expired)
+		}
+		return
+	}
+	if isClosed(d.expired) {
+		d.expired = make(chan struct{})
+	}
+	if !t.IsZero() {
+		expired := d.expired
+		d.timer = time.AfterFunc(dur, func() { close(expired) })
+	}
+}
+
+// wait returns a channel which is closed once the deadline expires.
+func (d *packetDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+	return d.expired
+}
+
+// isClosed returns true if ch is closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// loop reads datagrams from the underlying packet conn and dispatches them, until reading fails.
+func (pl *packetListener) loop() {
+	incoming := make(chan packet, 10)
+	go pl.dispatch(incoming)
+	defer close(incoming)
+
+	for {
+		buf := udpBufPool.Get().([]byte)
+		n, addr, err := pl.PacketConn.ReadFrom(buf)
+		if err != nil {
+			udpBufPool.Put(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			pl.err = err
+			close(pl.done)
+			return
+		}
+		incoming <- packet{
+			pooledBuf: buf,
+			n:         n,
+			addr:      addr,
+		}
+	}
+}
+
+// dispatch sends the incoming datagrams of passed downstreams to be returned from ReadFrom, and the rest
+// of them to the connections handling their downstreams, until incoming is closed. Passed downstreams
+// are forgotten once they have been idle for idleTimeout.
+func (pl *packetListener) dispatch(incoming <-chan packet) {
+	udpConns := make(map[string]*packetConn)
+	passed := make(map[string]time.Time)
+
+	ticker := time.NewTicker(pl.idleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case addr := <-pl.closeCh:
+			conn, ok := udpConns[addr]
+			if ok {
+				// This will abort any active Read() from another goroutine and return EOF
+				close(conn.readCh)
+				// Drain pending packets to ensure we release buffers back to the pool
+				for pkt := range conn.readCh {
+					udpBufPool.Put(pkt.pooledBuf)
+				}
+			}
+			delete(udpConns, addr)
+
+		case conn := <-pl.passCh:
+			addr := conn.addr.String()
+			if udpConns[addr] != conn {
+				// The connection has already been closed, e.g. due to idle timeout
+				continue
+			}
+			delete(udpConns, addr)
+			passed[addr] = time.Now()
+			// Datagrams received while the connection was being passed follow the ones it has already read
+			close(conn.readCh)
+			for pkt := range conn.readCh {
+				pl.pass(*pkt)
+			}
+
+		case now := <-ticker.C:
+			for addr, lastSeen := range passed {
+				if now.Sub(lastSeen) > pl.idleTimeout {
+					delete(passed, addr)
+				}
+			}
+
+		case pkt, ok := <-incoming:
+			if !ok {
+				return
+			}
+			addr := pkt.addr.String()
+			if _, ok := passed[addr]; ok {
+				passed[addr] = time.Now()
+				pl.pass(pkt)
+				continue
+			}
+			conn, ok := udpConns[addr]
+			if !ok {
+				conn = &packetConn{
+					PacketConn:  pl.PacketConn,
+					readCh:      make(chan *packet, 5),
+					addr:        pkt.addr,
+					closeCh:     pl.closeCh,
+					loopDone:    pl.done,
+					idleTimeout: pl.idleTimeout,
+				}
+				udpConns[addr] = conn
+				go pl.handle(conn)
+			}
+			conn.readCh <- &pkt
+		}
+	}
+}
+
+// pass queues pkt to be returned from ReadFrom, unless reading from the underlying packet conn has failed.
+func (pl *packetListener) pass(pkt packet) {
+	select {
+	case pl.packets <- pkt:
+	case <-pl.done:
+		udpBufPool.Put(pkt.pooledBuf)
+	}
+}
+
+func (pl *packetListener) handle(conn *packetConn) {
+	var err error
+	defer func() {
+		if !errors.Is(err, errHijacked) {
+			_ = conn.Close()
+		}
+	}()
+
+	buf := bufPool.Get().([]byte)
+	buf = buf[:0]
+	defer bufPool.Put(buf)
+
+	listener := pl.LocalAddr().String()
+	cx := WrapConnection(conn, buf, pl.logger)
+	cx.Context = context.WithValue(cx.Context, packetListenerCtxKey, pl)
+	cx.repl.Set(connListenerReplKey, listener)
+	cx.onPanic = func() { pl.metrics.panicRecovered("", listener) }
+
+	entry := activeConns.add(cx, "", listener)
+	defer activeConns.remove(entry)
+
+	start := time.Now()
+	pl.metrics.connectionOpened("", listener)
+	defer func() { pl.metrics.connectionClosed("", listener, cx, start) }()
+
+	err = handleRecovering(pl.compiledRoute, cx, "packet_conn_wrapper")
+	duration := time.Since(start)
+	if err != nil && !errors.Is(err, errHijacked) && !errors.Is(err, ErrPanicked) {
+		cx.Logger.Error("handling connection", zap.Error(err))
+	}
+
+	if !errors.Is(err, errHijacked) {
+		setCloseReason(cx, err)
+		pl.logs.logConnection(cx, duration, err)
+	}
+
+	cx.Logger.Debug("connection stats",
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.Uint64("read", cx.bytesRead.Load()),
+		zap.Uint64("written", cx.bytesWritten.Load()),
+		zap.Duration("duration", duration),
+	)
+}
+
+// ReadFrom returns the next datagram of the passed downstreams.
+func (pl *packetListener) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-pl.packets:
+		n := copy(b, pkt.pooledBuf[:pkt.n])
+		udpBufPool.Put(pkt.pooledBuf)
+		return n, pkt.addr, nil
+	case <-pl.done:
+		return 0, nil, pl.err
+	case <-pl.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// SetDeadline sets the read deadline of ReadFrom and the write deadline of the underlying packet conn.
+func (pl *packetListener) SetDeadline(t time.Time) error {
+	pl.readDeadline.set(t)
+	return pl.PacketConn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom. The underlying packet conn is read by the loop instead,
+// so its own read deadline is left intact.
+func (pl *packetListener) SetReadDeadline(t time.Time) error {
+	pl.readDeadline.set(t)
+	return nil
+}
+
+// pipeConnection passes the datagrams cx has already read, and all the subsequent datagrams of its downstream
+// to be returned from ReadFrom.
+func (pl *packetListener) pipeConnection(cx *Connection) error {
+	conn, ok := cx.Conn.(*packetConn)
+	if !ok {
+		return errors.New("wrapped packet connections can't be passed to the next packet conn wrapper")
+	}
+
+	// ReadPacket never blocks while there is a buffered datagram or a rest of it
+	for cx.offset < len(cx.buf) || conn.lastPacket != nil {
+		buf := udpBufPool.Get().([]byte)
+		n, err := cx.ReadPacket(buf)
+		if err != nil {
+			udpBufPool.Put(buf)
+			return err
+		}
+		pl.pass(packet{
+			pooledBuf: buf,
+			n:         n,
+			addr:      conn.addr,
+		})
+	}
+
+	// Keep passing the datagrams the loop sends to conn until the loop takes it over
+	readCh := conn.readCh
+	for {
+		select {
+		case pl.passCh <- conn:
+			return errHijacked
+		case pkt, ok := <-readCh:
+			if !ok {
+				readCh = nil
+				continue
+			}
+			pl.pass(*pkt)
+		case <-pl.done:
+			return net.ErrClosed
+		}
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Module            = (*PacketConnWrapper)(nil)
+	_ caddy.PacketConnWrapper = (*PacketConnWrapper)(nil)
+	_ caddyfile.Unmarshaler   = (*PacketConnWrapper)(nil)
+)
@@ -0,0 +1,196 @@
+package layer4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// testPrefixMatcher matches connections starting with its bytes.
+type testPrefixMatcher []byte
+
+func (m testPrefixMatcher) Match(cx *Connection) (bool, error) {
+	buf := make([]byte, len(m))
+	_, err := io.ReadFull(cx, buf)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(buf, m), nil
+}
+
+func TestPacketConnWrapperPassesUnhandledDownstreams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	echo := NextHandlerFunc(func(cx *Connection, _ Handler) error {
+		buf := make([]byte, MaxPacketBytes)
+		for {
+			n, err := cx.ReadPacket(buf)
+			if err != nil {
+				return nil
+			}
+			if _, err = cx.WritePacket(buf[:n]); err != nil {
+				return err
+			}
+		}
+	})
+	routes := RouteList{&Route{
+		matcherSets: MatcherSets{{testPrefixMatcher("echo")}},
+		middleware:  []Middleware{wrapHandler(echo)},
+	}}
+	pcw := &PacketConnWrapper{
+		IdleTimeout:   caddy.Duration(idleTimeoutDefault),
+		compiledRoute: routes.Compile(zap.NewNop(), time.Second, packetListenerHandler{}),
+		logger:        zap.NewNop(),
+	}
+	wrapped := pcw.WrapPacketConn(pc)
+
+	passedClient, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial | %s", err)
+	}
+	defer func() { _ = passedClient.Close() }()
+	echoClient, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial | %s", err)
+	}
+	defer func() { _ = echoClient.Close() }()
+
+	// the downstream is passed once the first datagram doesn't match, and so are its subsequent datagrams
+	buf := make([]byte, MaxPacketBytes)
+	for _, msg := range []string{"hello 1", "hello 2", "echo 3"} {
+		if _, err = passedClient.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write | %s", err)
+		}
+	}
+	for _, msg := range []string{"hello 1", "hello 2", "echo 3"} {
+		n, addr, err := wrapped.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to read | %s", err)
+		}
+		if string(buf[:n]) != msg || addr.String() != passedClient.LocalAddr().String() {
+			t.Fatalf("expected %q from %s, got %q from %s", msg, passedClient.LocalAddr(), buf[:n], addr)
+		}
+	}
+
+	// datagrams are written to the passed downstreams as usual
+	if _, err = wrapped.WriteTo([]byte("reply"), passedClient.LocalAddr()); err != nil {
+		t.Fatalf("failed to write | %s", err)
+	}
+	_ = passedClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := passedClient.Read(buf); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("expected %q, got %q (%v)", "reply", buf[:n], err)
+	}
+
+	// the other downstream is handled by the route
+	for _, msg := range []string{"echo 1", "hello 2"} {
+		_ = echoClient.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err = echoClient.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write | %s", err)
+		}
+		n, err := echoClient.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("expected %q, got %q (%v)", msg, buf[:n], err)
+		}
+	}
+
+	_ = pc.Close()
+	if _, _, err = wrapped.ReadFrom(buf); err == nil {
+		t.Fatal("expected an error once the packet conn is closed")
+	}
+}
+
+func TestPacketConnWrapperHandleErrorsPassesDownstreams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	invoked := make(chan [2]string, 1)
+	pcw := &PacketConnWrapper{
+		IdleTimeout: caddy.Duration(idleTimeoutDefault),
+		compiledRoute: newTestErrorRoutes(invoked).Wrap(RouteList{}.Compile(zap.NewNop(), time.Second, packetListenerHandler{}),
+			zap.NewNop(), time.Second, nopHandler{}),
+		metrics: newServerMetrics(prometheus.NewRegistry()),
+		logger:  zap.NewNop(),
+	}
+	wrapped := pcw.WrapPacketConn(pc)
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial | %s", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// the downstream passed to the next wrapper (e.g. QUIC) must keep being served
+	buf := make([]byte, MaxPacketBytes)
+	for _, msg := range []string{"hello 1", "hello 2"} {
+		if _, err = client.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write | %s", err)
+		}
+		n, _, err := wrapped.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("expected %q, got %q (%v)", msg, buf[:n], err)
+		}
+	}
+	if len(invoked) != 0 {
+		t.Fatal("expected the error routes not to be invoked")
+	}
+
+	if got := testutil.ToFloat64(pcw.metrics.connectionsTotal.WithLabelValues("", pc.LocalAddr().String())); got != 1 {
+		t.Errorf("connections_total = %v, want 1", got)
+	}
+}
+
+func TestPacketConnWrapperHonorsReadDeadline(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = pc.Close() }()
+
+	pcw := &PacketConnWrapper{
+		IdleTimeout:   caddy.Duration(idleTimeoutDefault),
+		compiledRoute: RouteList{}.Compile(zap.NewNop(), time.Second, packetListenerHandler{}),
+		logger:        zap.NewNop(),
+	}
+	wrapped := pcw.WrapPacketConn(pc)
+	buf := make([]byte, MaxPacketBytes)
+
+	// an expired deadline aborts reading at once, and a future one once it expires
+	for _, deadline := range []time.Time{time.Now().Add(-time.Second), time.Now().Add(50 * time.Millisecond)} {
+		_ = wrapped.SetReadDeadline(deadline)
+		_, _, err = wrapped.ReadFrom(buf)
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+	}
+
+	// clearing the deadline makes reading wait for datagrams again
+	_ = wrapped.SetReadDeadline(time.Time{})
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial | %s", err)
+	}
+	defer func() { _ = client.Close() }()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = client.Write([]byte("hello"))
+	}()
+	if n, _, err := wrapped.ReadFrom(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected %q, got %q (%v)", "hello", buf[:n], err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// ErrPanicked is returned in place of a panic recovered while handling a connection.
+var ErrPanicked = errors.New("recovered from panic")
+
+// ReportPanic logs r, a value recovered from a panic that occurred while handling cx
+// in the given scope, along with a stack trace, and counts it in the metrics of
+// the server cx belongs to. It must be called from the deferred function that
+// recovered the panic, so that the stack trace points to the culprit.
+// The caller remains responsible for closing whatever the panic has affected.
+func (cx *Connection) ReportPanic(scope string, r any) {
+	cx.Logger.Error("panic while handling connection",
+		zap.String("scope", scope),
+		zap.String("network", cx.LocalAddr().Network()),
+		zap.String("local", cx.LocalAddr().String()),
+		zap.String("remote", cx.RemoteAddr().String()),
+		zap.Any("panic", r),
+		zap.ByteString("stack", debug.Stack()),
+	)
+	if cx.onPanic != nil {
+		cx.onPanic()
+	}
+}
+
+// handleRecovering passes cx to h, and returns an error wrapping ErrPanicked if h panics.
+// In that case, the panic is reported, and cx is closed with the corresponding close reason.
+func handleRecovering(h Handler, cx *Connection, scope string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cx.ReportPanic(scope, r)
+			cx.repl.Set(connCloseReasonReplKey, closeReasonPanic)
+			_ = cx.Close()
+			err = fmt.Errorf("%w: %v", ErrPanicked, r)
+		}
+	}()
+	return h.Handle(cx)
+}
@@ -0,0 +1,49 @@
+package layer4
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestServerHandleRecoversPanic(t *testing.T) {
+	server := &Server{
+		name:    "srv0",
+		metrics: newServerMetrics(prometheus.NewRegistry()),
+		logger:  zap.NewNop(),
+	}
+	server.compiledRoute = RouteList{}.Compile(zap.NewNop(), time.Second, HandlerFunc(func(cx *Connection) error {
+		panic("boom")
+	}))
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		server.handle(out, ":443")
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the panicking connection to be handled")
+	}
+
+	// only the affected connection is closed
+	if _, err := in.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF on the closed connection, got %v", err)
+	}
+	if got := testutil.ToFloat64(server.metrics.panicsTotal.WithLabelValues("srv0", ":443")); got != 1 {
+		t.Errorf("panics_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(server.metrics.activeConns.WithLabelValues("srv0", ":443")); got != 0 {
+		t.Errorf("active_connections = %v, want 0", got)
+	}
+}
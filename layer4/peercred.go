@@ -0,0 +1,227 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchPeerCred{})
+}
+
+// PeerCred contains the credentials of the process on the other end of a unix socket connection,
+// as they were when the connection was established.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+// peerCredLookup returns a function that looks up the peer credentials of conn once, and caches them.
+// The function returns nil credentials if conn isn't a unix socket connection.
+func peerCredLookup(conn net.Conn) func() (*PeerCred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return func() (*PeerCred, error) { return nil, nil }
+	}
+	return sync.OnceValues(func() (*PeerCred, error) {
+		rawConn, err := unixConn.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		var cred *PeerCred
+		var credErr error
+		err = rawConn.Control(func(fd uintptr) {
+			cred, credErr = getPeerCred(fd)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cred, credErr
+	})
+}
+
+// MatchPeerCred matches unix socket connections by the credentials of the peer process, i.e. the process
+// that has connected to the socket. Connections of other types never match.
+type MatchPeerCred struct {
+	// UIDs is a list of user IDs, ranges of them (e.g. `1000-1999`) or user names.
+	// If not empty, the peer process must have one of the listed effective user IDs.
+	UIDs []string `json:"uids,omitempty"`
+	// GIDs is a list of group IDs, ranges of them (e.g. `1000-1999`) or group names.
+	// If not empty, the peer process must have one of the listed effective group IDs.
+	// Note that supplementary groups of the peer process are not taken into account.
+	GIDs []string `json:"gids,omitempty"`
+
+	uidRanges []idRange
+	gidRanges []idRange
+}
+
+// idRange is an inclusive range of user or group IDs.
+type idRange struct {
+	first, last int
+}
+
+// CaddyModule returns the Caddy module information.
+func (*MatchPeerCred) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.peer_cred",
+		New: func() caddy.Module { return new(MatchPeerCred) },
+	}
+}
+
+// Provision parses m's IDs and ranges, and looks up the user and group names.
+func (m *MatchPeerCred) Provision(_ caddy.Context) (err error) {
+	if len(m.UIDs) == 0 && len(m.GIDs) == 0 {
+		return fmt.Errorf("no uids or gids")
+	}
+	m.uidRanges, err = parseIDRanges(m.UIDs, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return fmt.Errorf("parsing uids: %v", err)
+	}
+	m.gidRanges, err = parseIDRanges(m.GIDs, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return fmt.Errorf("parsing gids: %v", err)
+	}
+	return nil
+}
+
+// Match returns true if the connection is from a peer process with one of the designated user IDs
+// and one of the designated group IDs.
+func (m *MatchPeerCred) Match(cx *Connection) (bool, error) {
+	cred, err := cx.PeerCred()
+	if err != nil {
+		return false, fmt.Errorf("getting peer credentials: %v", err)
+	}
+	if cred == nil {
+		return false, nil
+	}
+	return idRangesContain(m.uidRanges, cred.UID) && idRangesContain(m.gidRanges, cred.GID), nil
+}
+
+// UnmarshalCaddyfile sets up the MatchPeerCred from Caddyfile tokens. Syntax:
+//
+//	peer_cred {
+//		uid <uids...>
+//		gid <gids...>
+//	}
+func (m *MatchPeerCred) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "uid":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.UIDs = append(m.UIDs, d.RemainingArgs()...)
+		case "gid":
+			if d.CountRemainingArgs() == 0 {
+				return d.ArgErr()
+			}
+			m.GIDs = append(m.GIDs, d.RemainingArgs()...)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// parseIDRanges parses values that are IDs, ranges of IDs, or names resolved into IDs with lookup.
+func parseIDRanges(values []string, lookup func(name string) (string, error)) ([]idRange, error) {
+	ranges := make([]idRange, 0, len(values))
+	for _, value := range values {
+		// names may contain hyphens, so only a pair of numbers is a range
+		if first, last, found := strings.Cut(value, "-"); found {
+			firstID, err1 := strconv.Atoi(first)
+			lastID, err2 := strconv.Atoi(last)
+			if err1 == nil && err2 == nil {
+				if firstID < 0 || lastID < firstID {
+					return nil, fmt.Errorf("invalid range: %s", value)
+				}
+				ranges = append(ranges, idRange{first: firstID, last: lastID})
+				continue
+			}
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			idStr, lerr := lookup(value)
+			if lerr != nil {
+				return nil, lerr
+			}
+			if id, err = strconv.Atoi(idStr); err != nil {
+				return nil, fmt.Errorf("invalid id of %s: %s", value, idStr)
+			}
+		}
+		if id < 0 {
+			return nil, fmt.Errorf("invalid id: %s", value)
+		}
+		ranges = append(ranges, idRange{first: id, last: id})
+	}
+	return ranges, nil
+}
+
+// idRangesContain returns true if id is within any of ranges, or there are no ranges.
+func idRangesContain(ranges []idRange, id int) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if r.first <= id && id <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*MatchPeerCred)(nil)
+	_ ConnMatcher           = (*MatchPeerCred)(nil)
+	_ caddy.Provisioner     = (*MatchPeerCred)(nil)
+	_ caddyfile.Unmarshaler = (*MatchPeerCred)(nil)
+)
@@ -0,0 +1,113 @@
+//go:build linux
+
+package layer4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestPeerCredPlaceholdersAndMatcher(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "l4.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial | %s", err)
+	}
+	defer func() { _ = client.Close() }()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept | %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	cx := WrapConnection(conn, []byte{}, zap.NewNop())
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	for key, expected := range map[string]string{
+		"{l4.conn.peer_pid}": strconv.Itoa(os.Getpid()),
+		"{l4.conn.peer_uid}": uid,
+		"{l4.conn.peer_gid}": gid,
+	} {
+		if actual := cx.Replacer().ReplaceAll(key, "-"); actual != expected {
+			t.Fatalf("expected %s to be %q, got %q", key, expected, actual)
+		}
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+	pipeCx := WrapConnection(out, []byte{}, zap.NewNop())
+	if actual := pipeCx.Replacer().ReplaceAll("{l4.conn.peer_uid}", "-"); actual != "-" {
+		t.Fatalf("expected no peer uid for a non-unix connection, got %q", actual)
+	}
+
+	for i, tc := range []struct {
+		matcher     *MatchPeerCred
+		shouldMatch bool
+	}{
+		{matcher: &MatchPeerCred{UIDs: []string{uid}}, shouldMatch: true},
+		{matcher: &MatchPeerCred{UIDs: []string{uid + "-" + uid}, GIDs: []string{gid}}, shouldMatch: true},
+		{matcher: &MatchPeerCred{UIDs: []string{strconv.Itoa(os.Getuid() + 1)}}, shouldMatch: false},
+		{matcher: &MatchPeerCred{UIDs: []string{uid}, GIDs: []string{strconv.Itoa(os.Getgid() + 1)}}, shouldMatch: false},
+	} {
+		if err = tc.matcher.Provision(ctx); err != nil {
+			t.Fatalf("Test %d: provision failed | %s", i, err)
+		}
+		matched, err := tc.matcher.Match(cx)
+		if err != nil {
+			t.Fatalf("Test %d: match failed | %s", i, err)
+		}
+		if matched != tc.shouldMatch {
+			t.Fatalf("Test %d: matched = %t, want %t", i, matched, tc.shouldMatch)
+		}
+		if matched, _ = tc.matcher.Match(pipeCx); matched {
+			t.Fatalf("Test %d: a non-unix connection shouldn't match", i)
+		}
+	}
+
+	for i, ids := range [][]string{{"2-1"}, {"-1"}, {"no-such-user-l4"}} {
+		if err = (&MatchPeerCred{UIDs: ids}).Provision(ctx); err == nil {
+			t.Fatalf("Test %d: expected an error for %v", i, ids)
+		}
+	}
+}
+
+func TestParseIDRangesHyphenatedNames(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		if name == "www-data" {
+			return "33", nil
+		}
+		return "", fmt.Errorf("unknown name: %s", name)
+	}
+
+	ranges, err := parseIDRanges([]string{"www-data", "1000-1999", "0"}, lookup)
+	if err != nil {
+		t.Fatalf("failed to parse | %s", err)
+	}
+	want := []idRange{{first: 33, last: 33}, {first: 1000, last: 1999}, {first: 0, last: 0}}
+	if !slices.Equal(ranges, want) {
+		t.Fatalf("ranges = %v, want %v", ranges, want)
+	}
+
+	for _, values := range [][]string{{"2-1"}, {"systemd-network-l4"}} {
+		if _, err = parseIDRanges(values, lookup); err == nil {
+			t.Fatalf("expected an error for %v", values)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package layer4
+
+import "errors"
+
+// getPeerCred returns an error on platforms other than Linux, where peer credentials are not supported.
+func getPeerCred(_ uintptr) (*PeerCred, error) {
+	return nil, errors.New("peer credentials are only supported on Linux")
+}
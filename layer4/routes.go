@@ -33,6 +33,14 @@ import (
 // clause: if the matchers match, then the handlers will be
 // executed.
 type Route struct {
+	// Name is an optional route name. If set, it is recorded on the connections
+	// matched by this route, exposed as `{l4.route.name}` placeholder, and used
+	// as a label of the route metrics. Defaults to the route's `@id`, if any.
+	Name string `json:"name,omitempty"`
+
+	// ID is the route's config ID that is used to access it via the admin API.
+	ID string `json:"@id,omitempty"`
+
 	// Matchers define the conditions upon which to execute the handlers.
 	// All matchers within the same set must match, and at least one set
 	// must match; in other words, matchers are AND'ed together within a
@@ -45,12 +53,23 @@ type Route struct {
 
 	matcherSets MatcherSets
 	middleware  []Middleware
+	metrics     *routeMetrics
+	checkpoints []time.Duration
 }
 
 var ErrMatchingTimeout = errors.New("aborted matching according to timeout")
 
 // Provision sets up a route.
 func (r *Route) Provision(ctx caddy.Context) error {
+	if r.Name == "" {
+		r.Name = r.ID
+	}
+
+	// only named routes have metrics to keep their cardinality bounded
+	if r.Name != "" {
+		r.metrics = newRouteMetrics(ctx.GetMetricsRegistry())
+	}
+
 	// matchers
 	matchersIface, err := ctx.LoadModule(r, "MatcherSetsRaw")
 	if err != nil {
@@ -60,6 +79,7 @@ func (r *Route) Provision(ctx caddy.Context) error {
 	if err != nil {
 		return err
 	}
+	r.checkpoints = matchingCheckpoints(r.matcherSets)
 
 	// handlers
 	mods, err := ctx.LoadModule(r, "HandlersRaw")
@@ -95,6 +115,21 @@ func (routes RouteList) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// nextMatchingCheckpoint returns the earliest of the checkpoints since start that is yet to come
+// before the deadline, or zero time if there are none.
+func nextMatchingCheckpoint(start time.Time, checkpoints []time.Duration, deadline time.Time) time.Time {
+	now := time.Now()
+	for _, checkpoint := range checkpoints {
+		if t := start.Add(checkpoint); t.After(now) {
+			if t.Before(deadline) {
+				return t
+			}
+			break
+		}
+	}
+	return time.Time{}
+}
+
 const (
 	// routes that need more data to determine the match
 	routeNeedsMore = iota
@@ -107,8 +142,17 @@ const (
 // This should only be done once: after all the routes have
 // been provisioned, and before the server loop begins.
 func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duration, next Handler) Handler {
+	var checkpoints []time.Duration
+	for _, route := range routes {
+		checkpoints = append(checkpoints, route.checkpoints...)
+	}
+	slices.Sort(checkpoints)
+	checkpoints = slices.Compact(checkpoints)
+
 	return HandlerFunc(func(cx *Connection) error {
-		deadline := time.Now().Add(matchingTimeout)
+		start := time.Now()
+		deadline := start.Add(matchingTimeout)
+		cx.matchingStart = start
 
 		var (
 			lastMatchedRouteIdx = -1
@@ -131,14 +175,37 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 			// only read more because matchers require more (no matcher in the simplest case).
 			// can happen if this routes list is embedded in another
 			if lastNeedsMoreIdx != -1 {
+				// wake up at the next checkpoint of timed matchers, if it comes before the matching deadline
+				// (packet conns are excluded, since their deadlines have a granularity of one second)
+				var checkpoint time.Time
+				if !cx.isPacketConn {
+					checkpoint = nextMatchingCheckpoint(start, checkpoints, deadline)
+				}
+				if !checkpoint.IsZero() {
+					err = cx.SetReadDeadline(checkpoint)
+					if err != nil {
+						return err
+					}
+				}
 				err = cx.prefetch()
+				if !checkpoint.IsZero() {
+					// re-evaluate routes if no data has been received by the checkpoint
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						err = nil
+					}
+					if derr := cx.SetReadDeadline(deadline); derr != nil {
+						return derr
+					}
+				}
 				if err != nil {
-					logFunc := logger.Error
+					logFunc, closeReason := logger.Error, closeReasonMatchingError
 					if errors.Is(err, os.ErrDeadlineExceeded) {
 						err = ErrMatchingTimeout
-						logFunc = logger.Warn
+						logFunc, closeReason = logger.Warn, closeReasonMatchingTimeout
 					}
-					logFunc("matching connection", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err))
+					cx.repl.Set(connCloseReasonReplKey, closeReason)
+					setError(cx, err, closeReason)
+					logFunc("matching connection", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err), cx.IDField())
 					return nil // return nil so the error does not get logged again
 				}
 			}
@@ -168,7 +235,9 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 					continue // ignore and try next route
 				}
 				if err != nil {
-					logger.Error("matching connection", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err))
+					cx.repl.Set(connCloseReasonReplKey, closeReasonMatchingError)
+					setError(cx, err, closeReasonMatchingError)
+					logger.Error("matching connection", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err), cx.IDField())
 					return nil
 				}
 				if matched {
@@ -177,6 +246,15 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 					if len(route.matcherSets) == 0 && lastNeedsMoreIdx != -1 && i > lastNeedsMoreIdx {
 						continue
 					}
+					matchedAt := time.Now()
+					if cx.matchedAt.IsZero() {
+						cx.matchedAt = matchedAt
+					}
+					// an unnamed route clears the name of a previously matched one
+					cx.repl.Set(routeNameReplKey, route.Name)
+					if route.Name != "" {
+						route.metrics.routeMatched(route.Name, matchedAt.Sub(start))
+					}
 					routesStatus[i] = routeMatched
 					lastMatchedRouteIdx = i
 					lastNeedsMoreIdx = i + 1
@@ -202,6 +280,7 @@ func (routes RouteList) Compile(logger *zap.Logger, matchingTimeout time.Duratio
 					}
 					err = handler.Handle(cx)
 					if err != nil {
+						route.metrics.handlerFailed(route.Name)
 						return err
 					}
 
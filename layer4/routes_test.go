@@ -188,3 +188,67 @@ func TestMatchingTimeoutWorksUDP(t *testing.T) {
 		t.Fatalf("timeout takes too long %s", elapsed)
 	}
 }
+
+func TestRouteNameIsRecorded(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	routes := RouteList{&Route{ID: "catch_all"}}
+
+	err := routes.Provision(ctx)
+	if err != nil {
+		t.Fatalf("provision failed | %s", err)
+	}
+	if routes[0].Name != "catch_all" {
+		t.Fatalf("route name should default to its @id, got %q", routes[0].Name)
+	}
+
+	compiledRoutes := routes.Compile(zap.NewNop(), time.Second,
+		HandlerFunc(func(con *Connection) error {
+			return nil
+		}))
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	defer func() { _ = cx.Close() }()
+
+	err = compiledRoutes.Handle(cx)
+	if err != nil {
+		t.Fatalf("handle failed | %s", err)
+	}
+
+	if name, _ := cx.Replacer().GetString(routeNameReplKey); name != "catch_all" {
+		t.Fatalf("wrong route name | %q", name)
+	}
+	if cx.matchedAt.IsZero() {
+		t.Fatal("match time should be recorded")
+	}
+}
+
+func TestRouteNameIsClearedByUnnamedRoute(t *testing.T) {
+	// the named route has no handlers, so the connection falls through to the unnamed one
+	routes := RouteList{&Route{Name: "first"}, &Route{}}
+	compiledRoutes := routes.Compile(zap.NewNop(), time.Second,
+		HandlerFunc(func(con *Connection) error {
+			return nil
+		}))
+
+	in, out := net.Pipe()
+	defer func() { _ = in.Close() }()
+	defer func() { _ = out.Close() }()
+
+	cx := WrapConnection(out, []byte{}, zap.NewNop())
+	defer func() { _ = cx.Close() }()
+
+	err := compiledRoutes.Handle(cx)
+	if err != nil {
+		t.Fatalf("handle failed | %s", err)
+	}
+
+	if name, ok := cx.Replacer().GetString(routeNameReplKey); !ok || name != "" {
+		t.Fatalf("route name should be empty after an unnamed route | %q", name)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -45,15 +46,80 @@ type Server struct {
 	// Routes express composable logic for handling byte streams.
 	Routes RouteList `json:"routes,omitempty"`
 
+	// Errors configures routes that handle connections the primary routes have failed to handle.
+	Errors *ErrorRoutes `json:"errors,omitempty"`
+
 	// Maximum time before packet connection association (by downstream address:port) is removed. Default: 30s.
 	// Note: this field is only relevant for packet connections (e.g., UDP).
 	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
 	// Maximum time connections have to complete the matching phase (the first terminal handler is matched). Default: 3s.
 	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
 
+	// Enables access logging and configures how access logs are handled.
+	// If nil, no access logs are emitted.
+	Logs *ServerLogConfig `json:"logs,omitempty"`
+
+	// Maximum number of connections the server handles concurrently. Default: 0 (unlimited).
+	// Note: for packet connections (e.g., UDP), this limits the number of concurrent downstream associations.
+	MaxConnections int `json:"max_connections,omitempty"`
+	// Maximum number of connections the server handles concurrently from a single remote IP. Default: 0 (unlimited).
+	MaxConnectionsPerIP int `json:"max_connections_per_ip,omitempty"`
+	// Maximum number of connections the server handles concurrently from a single remote network prefix,
+	// e.g. an IPv4 /24 or an IPv6 /64 network. Default: 0 (unlimited).
+	MaxConnectionsPerPrefix int `json:"max_connections_per_prefix,omitempty"`
+	// Length of IPv4 network prefixes for MaxConnectionsPerPrefix. Default: 24.
+	ConnectionLimitPrefixIPv4 int `json:"connection_limit_prefix_ipv4,omitempty"`
+	// Length of IPv6 network prefixes for MaxConnectionsPerPrefix. Default: 64.
+	ConnectionLimitPrefixIPv6 int `json:"connection_limit_prefix_ipv6,omitempty"`
+	// Number of connections exceeding MaxConnections that may wait for a slot instead of being closed right away.
+	// Default: 0 (no waiting). Note: this field is only relevant for stream connections (e.g., TCP).
+	AcceptQueueSize int `json:"accept_queue_size,omitempty"`
+	// Maximum time connections may wait in the accept queue before being closed. Default: 5s.
+	AcceptQueueTimeout caddy.Duration `json:"accept_queue_timeout,omitempty"`
+
+	// Maximum number of UDP sessions (i.e. downstream associations) the server tracks at once. Once reached,
+	// a new session evicts another one according to UDPSessionEviction. Default: 0 (unlimited, sessions only
+	// expire after IdleTimeout).
+	MaxUDPSessions int `json:"max_udp_sessions,omitempty"`
+	// Maximum number of UDP sessions the server tracks at once from a single remote network prefix, sized by
+	// ConnectionLimitPrefixIPv4 and ConnectionLimitPrefixIPv6. Once reached, a new session from the prefix evicts
+	// another one from the same prefix. Default: 0 (unlimited).
+	MaxUDPSessionsPerPrefix int `json:"max_udp_sessions_per_prefix,omitempty"`
+	// Policy of choosing which UDP session to evict once a limit is reached: `lru` evicts the least recently
+	// active session, and `oldest` evicts the earliest created one. Default: `lru`.
+	UDPSessionEviction string `json:"udp_session_eviction,omitempty"`
+
+	// Maximum time in-flight connections have to finish when the server is stopped, e.g. on config reload.
+	// Once it expires, the remaining connections are closed. Default: 0 (in-flight connections are left
+	// to finish on their own).
+	GracePeriod caddy.Duration `json:"grace_period,omitempty"`
+
+	// Maximum number of datagrams read or written in a single system call. On Linux, batches are read and written
+	// with recvmmsg and sendmmsg. Default: 1 (no batching). Note: this field is only relevant for UDP sockets.
+	PacketBatchSize int `json:"packet_batch_size,omitempty"`
+	// Number of sockets bound to each packet address with SO_REUSEPORT, letting the kernel balance downstreams
+	// among them. Default: 1. Note: this field is only relevant for packet sockets on Linux, and ignored elsewhere.
+	PacketSockets int `json:"packet_sockets,omitempty"`
+	// Number of shards each packet socket splits its table of downstream associations into, each served by
+	// a separate goroutine. Default: 1. Note: this field is only relevant for packet connections (e.g., UDP).
+	PacketShards int `json:"packet_shards,omitempty"`
+
+	// Socket options applied to the sockets the server listens on, e.g. TCP keepalive parameters,
+	// buffer sizes or a type of service. If nil, the system defaults are used.
+	SocketOptions *SocketOptions `json:"socket_options,omitempty"`
+
 	logger        *zap.Logger
 	listenAddrs   []caddy.NetworkAddress
 	compiledRoute Handler
+	limiter       *connLimiter
+	sessions      *udpSessionTable
+	name          string
+	metrics       *serverMetrics
+
+	connsMu  sync.Mutex
+	conns    map[*Connection]struct{}
+	connsWg  sync.WaitGroup
+	stopping bool
 }
 
 // Provision sets up the server.
@@ -68,6 +134,36 @@ func (s *Server) Provision(ctx caddy.Context, logger *zap.Logger) error {
 		s.MatchingTimeout = caddy.Duration(MatchingTimeoutDefault)
 	}
 
+	if s.ConnectionLimitPrefixIPv4 <= 0 || s.ConnectionLimitPrefixIPv4 > 32 {
+		s.ConnectionLimitPrefixIPv4 = connectionLimitPrefixIPv4Default
+	}
+
+	if s.ConnectionLimitPrefixIPv6 <= 0 || s.ConnectionLimitPrefixIPv6 > 128 {
+		s.ConnectionLimitPrefixIPv6 = connectionLimitPrefixIPv6Default
+	}
+
+	if s.AcceptQueueTimeout <= 0 {
+		s.AcceptQueueTimeout = caddy.Duration(acceptQueueTimeoutDefault)
+	}
+
+	s.limiter = newConnLimiter(s)
+
+	switch s.UDPSessionEviction {
+	case "":
+		s.UDPSessionEviction = udpSessionEvictionLRU
+	case udpSessionEvictionLRU, udpSessionEvictionOldest:
+	default:
+		return fmt.Errorf("unsupported udp session eviction policy: %s", s.UDPSessionEviction)
+	}
+	s.sessions = newUDPSessionTable(s)
+
+	if s.SocketOptions != nil {
+		err := s.SocketOptions.provision()
+		if err != nil {
+			return fmt.Errorf("setting up socket options: %v", err)
+		}
+	}
+
 	repl := caddy.NewReplacer()
 	for i, address := range s.Listen {
 		address = repl.ReplaceAll(address, "")
@@ -78,16 +174,29 @@ func (s *Server) Provision(ctx caddy.Context, logger *zap.Logger) error {
 		s.listenAddrs = append(s.listenAddrs, addr)
 	}
 
+	if s.Logs != nil {
+		err := s.Logs.provision(s.logger)
+		if err != nil {
+			return fmt.Errorf("setting up access logs: %v", err)
+		}
+	}
+
 	err := s.Routes.Provision(ctx)
 	if err != nil {
 		return err
 	}
-	s.compiledRoute = s.Routes.Compile(s.logger, time.Duration(s.MatchingTimeout), nopHandler{})
+	err = s.Errors.Provision(ctx)
+	if err != nil {
+		return err
+	}
+	s.compiledRoute = s.Errors.Wrap(s.Routes.Compile(s.logger, time.Duration(s.MatchingTimeout), nopHandler{}),
+		s.logger, time.Duration(s.MatchingTimeout), nopHandler{})
 
 	return nil
 }
 
 func (s *Server) serve(ln net.Listener) error {
+	listener := ln.Addr().String()
 	for {
 		conn, err := ln.Accept()
 		var nerr net.Error
@@ -98,46 +207,122 @@ func (s *Server) serve(ln net.Listener) error {
 		if err != nil {
 			return err
 		}
-		go s.handle(conn)
+		if err := s.SocketOptions.applyToConn(conn); err != nil {
+			s.logger.Debug("applying socket options", zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+		}
+		if s.limiter == nil {
+			go s.handle(conn, listener)
+			continue
+		}
+		release, wait, err := s.limiter.admit(conn.RemoteAddr(), true)
+		if err != nil {
+			s.rejectConnection(conn.LocalAddr(), conn.RemoteAddr(), listener, err)
+			_ = conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer release()
+			if wait != nil {
+				if err := wait(); err != nil {
+					s.rejectConnection(conn.LocalAddr(), conn.RemoteAddr(), listener, err)
+					_ = conn.Close()
+					return
+				}
+			}
+			s.handle(conn, listener)
+		}(conn)
 	}
 }
 
+// rejectConnection logs and counts that a connection from remote to local has been rejected due to
+// a connection limit. Only the first rejection in each rejectionWarnInterval is logged at WARN level,
+// and the rest are logged at DEBUG level, while rejected_total counts them all.
+func (s *Server) rejectConnection(local, remote net.Addr, listener string, err error) {
+	s.metrics.connectionRejected(s.name, listener)
+	logFunc := s.logger.Debug
+	if s.limiter.shouldWarn(time.Now()) {
+		logFunc = s.logger.Warn
+	}
+	logFunc("rejected connection",
+		zap.String("network", local.Network()),
+		zap.String("local", local.String()),
+		zap.String("remote", remote.String()),
+		zap.Uint64("rejected_total", s.limiter.rejected.Load()),
+		zap.Error(err),
+	)
+}
+
 func (s *Server) servePacket(pc net.PacketConn) error {
-	// Spawn a goroutine whose only job is to consume packets from the socket
-	// and send to the packets channel.
-	packets := make(chan packet, 10)
-	go func(packets chan packet) {
-		for {
-			buf := udpBufPool.Get().([]byte)
-			n, addr, err := pc.ReadFrom(buf)
-			if err != nil {
-				var netErr net.Error
-				if errors.As(err, &netErr) && netErr.Timeout() {
-					continue
-				}
-				packets <- packet{err: err}
-				return
-			}
-			packets <- packet{
-				pooledBuf: buf,
-				n:         n,
-				addr:      addr,
+	listener := pc.LocalAddr().String()
+
+	// done is closed once this function exits, so that packetConns
+	// don't block notifying their shards of their closure afterwards.
+	done := make(chan struct{})
+	defer close(done)
+
+	var batch *batchPacketConn
+	if s.PacketBatchSize > 1 {
+		batch = newBatchPacketConn(pc, s.PacketBatchSize)
+		if batch != nil {
+			defer batch.close()
+		}
+	}
+
+	// Spawn a goroutine per shard to serve the downstreams it's responsible for.
+	// This goroutine's only job is to consume packets from the socket and send
+	// them to the packets channel of the corresponding shard.
+	shards := make([]*packetShard, max(s.PacketShards, 1))
+	for i := range shards {
+		shards[i] = &packetShard{
+			packets:  make(chan packet, 10),
+			udpConns: make(map[string]*packetConn),
+			closeCh:  make(chan string, 10),
+		}
+		go s.servePacketShard(pc, batch, shards[i], listener, done)
+	}
+	defer func() {
+		for _, shard := range shards {
+			close(shard.packets)
+		}
+	}()
+
+	dispatch := func(pkt packet) {
+		shards[packetShardIndex(pkt.addr, len(shards))].packets <- pkt
+	}
+
+	if batch != nil {
+		return batch.readPackets(dispatch)
+	}
+
+	for {
+		buf := udpBufPool.Get().([]byte)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			udpBufPool.Put(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
 			}
+			return err
 		}
-	}(packets)
+		dispatch(packet{
+			pooledBuf: buf,
+			n:         n,
+			addr:      addr,
+		})
+	}
+}
 
-	// udpConns tracks active packetConns by downstream address:port. They will
-	// be removed from this map after being closed.
-	udpConns := make(map[string]*packetConn)
-	// closeCh is used to receive notifications of socket closures from
-	// packetConn, which allows us to remove stale connections (whose
-	// proxy handlers have completed) from the udpConns map.
-	closeCh := make(chan string, 10)
+// servePacketShard serves the downstreams a shard is responsible for, until its packets channel is closed.
+func (s *Server) servePacketShard(pc net.PacketConn, batch *batchPacketConn, shard *packetShard, listener string,
+	done <-chan struct{},
+) {
 	for {
 		select {
-		case addr := <-closeCh:
-			conn, ok := udpConns[addr]
+		case addr := <-shard.closeCh:
+			conn, ok := shard.udpConns[addr]
 			if ok {
+				s.sessions.remove(conn)
 				// This will abort any active Read() from another goroutine and return EOF
 				close(conn.readCh)
 				// Drain pending packets to ensure we release buffers back to the pool
@@ -147,26 +332,50 @@ func (s *Server) servePacket(pc net.PacketConn) error {
 			}
 			// UDP connection is closed (either implicitly through timeout or by
 			// explicit call to Close()).
-			delete(udpConns, addr)
+			delete(shard.udpConns, addr)
 
-		case pkt := <-packets:
-			if pkt.err != nil {
-				return pkt.err
-			}
-			conn, ok := udpConns[pkt.addr.String()]
+		case pkt, ok := <-shard.packets:
 			if !ok {
+				return
+			}
+			conn, ok := shard.udpConns[pkt.addr.String()]
+			if ok && conn.isEnded() {
+				// The ended connection is shutting down, so drop packets until it's closed.
+				udpBufPool.Put(pkt.pooledBuf)
+				continue
+			}
+			if ok {
+				s.sessions.touch(conn)
+			} else {
 				// No existing proxy handler is running for this downstream.
-				// Create one now.
+				// Create one now, unless a connection limit is reached.
+				release := func() {}
+				if s.limiter != nil {
+					var err error
+					release, _, err = s.limiter.admit(pkt.addr, false)
+					if err != nil {
+						s.rejectConnection(pc.LocalAddr(), pkt.addr, listener, err)
+						udpBufPool.Put(pkt.pooledBuf)
+						continue
+					}
+				}
 				conn = &packetConn{
 					PacketConn:  pc,
+					batch:       batch,
 					readCh:      make(chan *packet, 5),
 					addr:        pkt.addr,
-					closeCh:     closeCh,
+					ended:       make(chan struct{}),
+					closeCh:     shard.closeCh,
+					loopDone:    done,
 					idleTimeout: time.Duration(s.IdleTimeout),
 				}
-				udpConns[pkt.addr.String()] = conn
+				shard.udpConns[pkt.addr.String()] = conn
+				for _, ev := range s.sessions.add(conn) {
+					s.evictSession(ev)
+				}
 				go func(conn *packetConn) {
-					s.handle(conn)
+					defer release()
+					s.handle(conn, listener)
 					// It might seem cleaner to send to closeCh here rather than
 					// in packetConn, but doing it earlier in packetConn closes
 					// the gap between the proxy handler shutting down and new
@@ -180,7 +389,7 @@ func (s *Server) servePacket(pc net.PacketConn) error {
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
+func (s *Server) handle(conn net.Conn, listener string) {
 	defer func() { _ = conn.Close() }()
 
 	buf := bufPool.Get().([]byte)
@@ -188,18 +397,32 @@ func (s *Server) handle(conn net.Conn) {
 	defer bufPool.Put(buf)
 
 	cx := WrapConnection(conn, buf, s.logger)
+	cx.repl.Set(connListenerReplKey, listener)
+	cx.repl.Set(connServerNameReplKey, s.name)
+	cx.onPanic = func() { s.metrics.panicRecovered(s.name, listener) }
 
-	s.logger.Debug("started handling connection",
+	if !s.trackConnection(cx) {
+		return
+	}
+	defer s.untrackConnection(cx)
+
+	entry := activeConns.add(cx, s.name, listener)
+	defer activeConns.remove(entry)
+
+	start := time.Now()
+	s.metrics.connectionOpened(s.name, listener)
+	defer func() { s.metrics.connectionClosed(s.name, listener, cx, start) }()
+
+	cx.Logger.Debug("started handling connection",
 		zap.String("network", cx.LocalAddr().Network()),
 		zap.String("local", cx.LocalAddr().String()),
 		zap.String("remote", cx.RemoteAddr().String()),
 	)
 
-	start := time.Now()
-	err := s.compiledRoute.Handle(cx)
+	err := handleRecovering(s.compiledRoute, cx, "server")
 	duration := time.Since(start)
-	if err != nil {
-		s.logger.Error("handling connection",
+	if err != nil && !errors.Is(err, ErrPanicked) {
+		cx.Logger.Error("handling connection",
 			zap.String("network", cx.LocalAddr().Network()),
 			zap.String("local", cx.LocalAddr().String()),
 			zap.String("remote", cx.RemoteAddr().String()),
@@ -207,12 +430,15 @@ func (s *Server) handle(conn net.Conn) {
 		)
 	}
 
-	s.logger.Debug("stopped handling connection; connection stats",
+	setCloseReason(cx, err)
+	s.Logs.logConnection(cx, duration, err)
+
+	cx.Logger.Debug("stopped handling connection; connection stats",
 		zap.String("network", cx.LocalAddr().Network()),
 		zap.String("local", cx.LocalAddr().String()),
 		zap.String("remote", cx.RemoteAddr().String()),
-		zap.Uint64("read", cx.bytesRead),
-		zap.Uint64("written", cx.bytesWritten),
+		zap.Uint64("read", cx.bytesRead.Load()),
+		zap.Uint64("written", cx.bytesWritten.Load()),
 		zap.Duration("duration", duration),
 	)
 }
@@ -222,6 +448,25 @@ func (s *Server) handle(conn net.Conn) {
 //	<address:port> [<address:port>] {
 //		idle_timeout <duration>
 //		matching_timeout <duration>
+//		max_connections <int>
+//		max_connections_per_ip <int>
+//		max_connections_per_prefix <int> [<ipv4_prefix_length> [<ipv6_prefix_length>]]
+//		accept_queue <size> [<timeout>]
+//		max_udp_sessions <int> [lru|oldest]
+//		max_udp_sessions_per_prefix <int>
+//		grace_period <duration>
+//		packet_batch_size <int>
+//		packet_sockets <int>
+//		packet_shards <int>
+//		socket_options {
+//			<socket_option> [<socket_option_args>]
+//		}
+//		log [<logger_name>] {
+//			<log_option> [<log_option_args>]
+//		}
+//		handle_errors {
+//			<routes>
+//		}
 //		@a <matcher> [<matcher_args>]
 //		@b {
 //			<matcher> [<matcher_args>]
@@ -246,30 +491,177 @@ func (s *Server) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		s.Listen = append(s.Listen, d.Val())
 	}
 
-	if err := ParseCaddyfileNestedRoutes(d, &s.Routes, &s.MatchingTimeout, &s.IdleTimeout); err != nil {
+	if err := ParseCaddyfileNestedRoutesWithOptions(d, &s.Routes, &s.MatchingTimeout, &s.IdleTimeout,
+		s.unmarshalCaddyfileOption); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// unmarshalCaddyfileOption sets up the Server's options other than routes and timeouts from Caddyfile tokens.
+func (s *Server) unmarshalCaddyfileOption(d *caddyfile.Dispenser, optionName string) (bool, error) {
+	switch optionName {
+	case "log":
+		if s.Logs != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		s.Logs = new(ServerLogConfig)
+		if err := s.Logs.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+		return true, nil
+	case "handle_errors":
+		if s.Errors != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		s.Errors = new(ErrorRoutes)
+		if err := s.Errors.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+		return true, nil
+	case "socket_options":
+		if s.SocketOptions != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		s.SocketOptions = new(SocketOptions)
+		if err := s.SocketOptions.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+		return true, nil
+	case "max_connections", "max_connections_per_ip", "max_udp_sessions_per_prefix",
+		"packet_batch_size", "packet_sockets", "packet_shards":
+		limit := map[string]*int{
+			"max_connections":             &s.MaxConnections,
+			"max_connections_per_ip":      &s.MaxConnectionsPerIP,
+			"max_udp_sessions_per_prefix": &s.MaxUDPSessionsPerPrefix,
+			"packet_batch_size":           &s.PacketBatchSize,
+			"packet_sockets":              &s.PacketSockets,
+			"packet_shards":               &s.PacketShards,
+		}[optionName]
+		if *limit != 0 {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		if d.CountRemainingArgs() != 1 {
+			return true, d.ArgErr()
+		}
+		d.NextArg()
+		val, err := strconv.Atoi(d.Val())
+		if err != nil || val <= 0 {
+			return true, d.Errf("parsing option '%s': invalid value %s", optionName, d.Val())
+		}
+		*limit = val
+	case "max_connections_per_prefix":
+		if s.MaxConnectionsPerPrefix != 0 {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		if d.CountRemainingArgs() == 0 || d.CountRemainingArgs() > 3 {
+			return true, d.ArgErr()
+		}
+		vals := make([]int, 0, 3)
+		for d.NextArg() {
+			val, err := strconv.Atoi(d.Val())
+			if err != nil || val <= 0 {
+				return true, d.Errf("parsing option '%s': invalid value %s", optionName, d.Val())
+			}
+			vals = append(vals, val)
+		}
+		s.MaxConnectionsPerPrefix = vals[0]
+		if len(vals) > 1 {
+			s.ConnectionLimitPrefixIPv4 = vals[1]
+		}
+		if len(vals) > 2 {
+			s.ConnectionLimitPrefixIPv6 = vals[2]
+		}
+	case "accept_queue":
+		if s.AcceptQueueSize != 0 {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		if d.CountRemainingArgs() == 0 || d.CountRemainingArgs() > 2 {
+			return true, d.ArgErr()
+		}
+		d.NextArg()
+		val, err := strconv.Atoi(d.Val())
+		if err != nil || val <= 0 {
+			return true, d.Errf("parsing option '%s': invalid value %s", optionName, d.Val())
+		}
+		s.AcceptQueueSize = val
+		if d.NextArg() {
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return true, d.Errf("parsing option '%s' duration: %v", optionName, err)
+			}
+			s.AcceptQueueTimeout = caddy.Duration(dur)
+		}
+	case "max_udp_sessions":
+		if s.MaxUDPSessions != 0 {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		if d.CountRemainingArgs() == 0 || d.CountRemainingArgs() > 2 {
+			return true, d.ArgErr()
+		}
+		d.NextArg()
+		val, err := strconv.Atoi(d.Val())
+		if err != nil || val <= 0 {
+			return true, d.Errf("parsing option '%s': invalid value %s", optionName, d.Val())
+		}
+		s.MaxUDPSessions = val
+		if d.NextArg() {
+			switch d.Val() {
+			case udpSessionEvictionLRU, udpSessionEvictionOldest:
+				s.UDPSessionEviction = d.Val()
+			default:
+				return true, d.Errf("parsing option '%s': invalid eviction policy %s", optionName, d.Val())
+			}
+		}
+	case "grace_period":
+		if s.GracePeriod != 0 {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		if d.CountRemainingArgs() != 1 {
+			return true, d.ArgErr()
+		}
+		d.NextArg()
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return true, d.Errf("parsing option '%s' duration: %v", optionName, err)
+		}
+		s.GracePeriod = caddy.Duration(dur)
+	default:
+		return false, nil
+	}
+
+	// No nested blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return true, d.Errf("malformed option '%s': blocks are not supported", optionName)
+	}
+
+	return true, nil
+}
+
 type packet struct {
 	// The underlying bytes slice that was gotten from udpBufPool.  It's up to
 	// packetConn to return it to udpBufPool once it's consumed.
 	pooledBuf []byte
 	// Number of bytes read from socket
 	n int
-	// Error that occurred while reading from socket
-	err error
 	// Address of downstream
 	addr net.Addr
 }
 
 type packetConn struct {
 	net.PacketConn
-	addr    net.Addr
-	readCh  chan *packet
-	closeCh chan string
+	// If not nil, datagrams are written in batches with other packetConns
+	batch *batchPacketConn
+	// If not nil, the connection is tracked in a session table
+	session *udpSession
+	// If not nil, ended is closed once the server ends the session, i.e. evicts it or closes it while draining
+	ended    chan struct{}
+	endOnce  sync.Once
+	addr     net.Addr
+	readCh   chan *packet
+	closeCh  chan string
+	loopDone <-chan struct{}
 	// If not nil, then the previous Read() call didn't consume all the data
 	// from the buffer, and this packet will be reused in the next Read()
 	// without waiting for readCh.
@@ -357,6 +749,8 @@ func (pc *packetConn) Read(b []byte) (n int, err error) {
 			// next loop will run. Don't call Read as that will reset the idle timer.
 		case <-pc.idleTimer.C:
 			done = true
+		case <-pc.ended:
+			done = true
 		}
 	}
 	// Idle timeout simulates socket closure.
@@ -364,13 +758,44 @@ func (pc *packetConn) Read(b []byte) (n int, err error) {
 	// Although Close() also does this, we inform the server loop early about
 	// the closure to ensure that if any new packets are received from this
 	// connection in the meantime, a new handler will be started.
-	pc.closeCh <- pc.addr.String()
+	pc.notifyClosed()
 	// Returning EOF here ensures that io.Copy() waiting on the downstream for
 	// reads will terminate.
 	return 0, io.EOF
 }
 
+// end makes the connection return EOF to its reader, as if it idled out. It's safe to call more than once
+// and concurrently with Read.
+func (pc *packetConn) end() {
+	if pc.ended == nil {
+		return
+	}
+	pc.endOnce.Do(func() { close(pc.ended) })
+}
+
+// isEnded returns whether the session of the connection has been ended by the server.
+func (pc *packetConn) isEnded() bool {
+	select {
+	case <-pc.ended:
+		return true
+	default:
+		return false
+	}
+}
+
+// discardLastPacket releases the partially read packet, if any.
+func (pc *packetConn) discardLastPacket() {
+	if pc.lastPacket != nil {
+		udpBufPool.Put(pc.lastPacket.pooledBuf)
+		pc.lastPacket = nil
+		pc.lastBuf = nil
+	}
+}
+
 func (pc *packetConn) Write(b []byte) (n int, err error) {
+	if pc.batch != nil {
+		return pc.batch.writeTo(b, pc.addr)
+	}
 	return pc.WriteTo(b, pc.addr)
 }
 
@@ -382,12 +807,20 @@ func (pc *packetConn) Close() error {
 	// We may have already done this earlier in Read(), but just in case
 	// Read() wasn't being called, (re-)notify server loop we're closed.
 	// Server loop is responsible to close readCh to abort Read() to avoid race.
-	pc.closeCh <- pc.addr.String()
+	pc.notifyClosed()
 	// We don't call net.PacketConn.Close() here as we would stop the UDP
 	// server.
 	return nil
 }
 
+// notifyClosed informs the server loop that the connection is closed, unless the loop has already exited.
+func (pc *packetConn) notifyClosed() {
+	select {
+	case pc.closeCh <- pc.addr.String():
+	case <-pc.loopDone:
+	}
+}
+
 func (pc *packetConn) RemoteAddr() net.Addr { return pc.addr }
 
 var udpBufPool = sync.Pool{
@@ -396,7 +829,7 @@ var udpBufPool = sync.Pool{
 		// ReadFrom() can't resume partial reads.  (This is standard for UDP
 		// sockets on *nix.)  So our buffer sizes are 9000 bytes to accommodate
 		// networks with jumbo frames.  See also https://github.com/golang/go/issues/18056
-		return make([]byte, 9000)
+		return make([]byte, MaxPacketBytes)
 	},
 }
 
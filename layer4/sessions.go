@@ -0,0 +1,206 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Eviction policies of UDP sessions.
+const (
+	udpSessionEvictionLRU    = "lru"
+	udpSessionEvictionOldest = "oldest"
+)
+
+// Reasons of UDP session evictions, as reported in logs and metrics.
+const (
+	udpEvictionReasonServer = "max_udp_sessions"
+	udpEvictionReasonPrefix = "max_udp_sessions_per_prefix"
+)
+
+// udpSession is an entry of a udpSessionTable.
+type udpSession struct {
+	conn       *packetConn
+	prefix     netip.Prefix
+	elem       *list.Element
+	prefixElem *list.Element
+	removed    bool
+}
+
+// udpEviction is a session evicted from a udpSessionTable to make room for another one.
+type udpEviction struct {
+	conn   *packetConn
+	reason string
+}
+
+// udpSessionTable bounds the number of UDP sessions (i.e. packetConns) a server
+// tracks, in total and per remote network prefix. Sessions are ordered by
+// the time they were last active (lru policy) or created (oldest policy),
+// and those at the back are evicted first.
+type udpSessionTable struct {
+	maxSessions int
+	perPrefix   int
+	prefixIPv4  int
+	prefixIPv6  int
+	lru         bool
+
+	mu       sync.Mutex
+	sessions *list.List
+	byPrefix map[netip.Prefix]*list.List
+}
+
+// newUDPSessionTable returns a udpSessionTable for the server's limits,
+// or nil if the server has no UDP session limits configured.
+func newUDPSessionTable(s *Server) *udpSessionTable {
+	if s.MaxUDPSessions <= 0 && s.MaxUDPSessionsPerPrefix <= 0 {
+		return nil
+	}
+
+	t := &udpSessionTable{
+		maxSessions: s.MaxUDPSessions,
+		perPrefix:   s.MaxUDPSessionsPerPrefix,
+		prefixIPv4:  s.ConnectionLimitPrefixIPv4,
+		prefixIPv6:  s.ConnectionLimitPrefixIPv6,
+		lru:         s.UDPSessionEviction != udpSessionEvictionOldest,
+		sessions:    list.New(),
+	}
+	if t.perPrefix > 0 {
+		t.byPrefix = make(map[netip.Prefix]*list.List)
+	}
+	return t
+}
+
+// add registers conn as a new session. If any limit is reached, sessions
+// are evicted to make room for it, and returned to the caller to be closed.
+func (t *udpSessionTable) add(conn *packetConn) []udpEviction {
+	if t == nil {
+		return nil
+	}
+
+	sess := &udpSession{conn: conn}
+	conn.session = sess
+
+	ip, hasIP := remoteIP(conn.addr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var evictions []udpEviction
+
+	if t.byPrefix != nil && hasIP {
+		bits := t.prefixIPv6
+		if ip.Is4() {
+			bits = t.prefixIPv4
+		}
+		sess.prefix, _ = ip.Prefix(bits)
+
+		if prefixSessions, ok := t.byPrefix[sess.prefix]; ok && prefixSessions.Len() >= t.perPrefix {
+			victim := prefixSessions.Back().Value.(*udpSession)
+			t.removeLocked(victim)
+			evictions = append(evictions, udpEviction{conn: victim.conn, reason: udpEvictionReasonPrefix})
+		}
+		// the eviction may have removed the list of the prefix, so look it up afterwards
+		prefixSessions, ok := t.byPrefix[sess.prefix]
+		if !ok {
+			prefixSessions = list.New()
+			t.byPrefix[sess.prefix] = prefixSessions
+		}
+		sess.prefixElem = prefixSessions.PushFront(sess)
+	}
+
+	if t.maxSessions > 0 && t.sessions.Len() >= t.maxSessions {
+		victim := t.sessions.Back().Value.(*udpSession)
+		t.removeLocked(victim)
+		evictions = append(evictions, udpEviction{conn: victim.conn, reason: udpEvictionReasonServer})
+	}
+	sess.elem = t.sessions.PushFront(sess)
+
+	return evictions
+}
+
+// touch marks the session of conn as active, if sessions are evicted by the lru policy.
+func (t *udpSessionTable) touch(conn *packetConn) {
+	if t == nil || !t.lru || conn.session == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess := conn.session
+	if sess.removed {
+		return
+	}
+	t.sessions.MoveToFront(sess.elem)
+	if sess.prefixElem != nil {
+		t.byPrefix[sess.prefix].MoveToFront(sess.prefixElem)
+	}
+}
+
+// remove unregisters the session of conn, unless it has been evicted already.
+func (t *udpSessionTable) remove(conn *packetConn) {
+	if t == nil || conn.session == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.removeLocked(conn.session)
+}
+
+// removeLocked unregisters sess. The caller must hold t.mu.
+func (t *udpSessionTable) removeLocked(sess *udpSession) {
+	if sess.removed {
+		return
+	}
+	sess.removed = true
+
+	t.sessions.Remove(sess.elem)
+	if sess.prefixElem != nil {
+		prefixSessions := t.byPrefix[sess.prefix]
+		prefixSessions.Remove(sess.prefixElem)
+		if prefixSessions.Len() == 0 {
+			delete(t.byPrefix, sess.prefix)
+		}
+	}
+}
+
+// len returns the number of sessions in the table.
+func (t *udpSessionTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.sessions.Len()
+}
+
+// evictSession makes the evicted packetConn return EOF to its reader,
+// and records the eviction in logs and metrics.
+func (s *Server) evictSession(ev udpEviction) {
+	ev.conn.end()
+
+	s.metrics.sessionEvicted(s.name, ev.conn.LocalAddr().String(), ev.reason)
+	s.logger.Warn("evicted udp session",
+		zap.String("network", ev.conn.LocalAddr().Network()),
+		zap.String("local", ev.conn.LocalAddr().String()),
+		zap.String("remote", ev.conn.addr.String()),
+		zap.String("reason", ev.reason),
+		zap.String("policy", s.UDPSessionEviction),
+	)
+}
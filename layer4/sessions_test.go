@@ -0,0 +1,184 @@
+package layer4
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func newTestSession(ip string, port int) *packetConn {
+	return &packetConn{addr: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}}
+}
+
+func TestUDPSessionTableEvictsLeastRecentlyUsed(t *testing.T) {
+	table := newUDPSessionTable(&Server{MaxUDPSessions: 2})
+
+	a, b, c := newTestSession("192.0.2.1", 1), newTestSession("192.0.2.2", 1), newTestSession("192.0.2.3", 1)
+	if evictions := table.add(a); len(evictions) != 0 {
+		t.Fatalf("expected no evictions, got %d", len(evictions))
+	}
+	if evictions := table.add(b); len(evictions) != 0 {
+		t.Fatalf("expected no evictions, got %d", len(evictions))
+	}
+
+	// a becomes the most recently used one, so b is evicted
+	table.touch(a)
+	evictions := table.add(c)
+	if len(evictions) != 1 || evictions[0].conn != b || evictions[0].reason != udpEvictionReasonServer {
+		t.Fatalf("expected b to be evicted due to the server limit, got %v", evictions)
+	}
+	if table.len() != 2 {
+		t.Fatalf("expected 2 sessions, got %d", table.len())
+	}
+
+	// removing an evicted session has no effect
+	table.remove(b)
+	table.remove(a)
+	if table.len() != 1 {
+		t.Fatalf("expected 1 session, got %d", table.len())
+	}
+}
+
+func TestUDPSessionTableEvictsOldest(t *testing.T) {
+	table := newUDPSessionTable(&Server{MaxUDPSessions: 2, UDPSessionEviction: udpSessionEvictionOldest})
+
+	a, b, c := newTestSession("192.0.2.1", 1), newTestSession("192.0.2.2", 1), newTestSession("192.0.2.3", 1)
+	table.add(a)
+	table.add(b)
+
+	// activity doesn't matter, a is the oldest one
+	table.touch(a)
+	evictions := table.add(c)
+	if len(evictions) != 1 || evictions[0].conn != a {
+		t.Fatalf("expected a to be evicted, got %v", evictions)
+	}
+}
+
+func TestUDPSessionTableEvictsWithinPrefix(t *testing.T) {
+	table := newUDPSessionTable(&Server{
+		MaxUDPSessionsPerPrefix:   2,
+		ConnectionLimitPrefixIPv4: 24,
+		ConnectionLimitPrefixIPv6: 64,
+	})
+
+	a, b := newTestSession("192.0.2.1", 1), newTestSession("192.0.2.1", 2)
+	other := newTestSession("198.51.100.1", 1)
+	table.add(a)
+	table.add(b)
+	if evictions := table.add(other); len(evictions) != 0 {
+		t.Fatalf("expected no evictions for another prefix, got %v", evictions)
+	}
+
+	evictions := table.add(newTestSession("192.0.2.200", 1))
+	if len(evictions) != 1 || evictions[0].conn != a || evictions[0].reason != udpEvictionReasonPrefix {
+		t.Fatalf("expected a to be evicted due to the prefix limit, got %v", evictions)
+	}
+	if len(table.byPrefix) != 2 {
+		t.Fatalf("expected 2 tracked prefixes, got %d", len(table.byPrefix))
+	}
+}
+
+func TestUDPSessionTableSinglePerPrefix(t *testing.T) {
+	table := newUDPSessionTable(&Server{
+		MaxUDPSessionsPerPrefix:   1,
+		ConnectionLimitPrefixIPv4: 24,
+		ConnectionLimitPrefixIPv6: 64,
+	})
+
+	a, b, c := newTestSession("192.0.2.1", 1), newTestSession("192.0.2.2", 1), newTestSession("192.0.2.3", 1)
+	for _, tc := range []struct {
+		name    string
+		op      func() []udpEviction
+		evicted *packetConn
+		len     int
+	}{
+		{name: "add a", op: func() []udpEviction { return table.add(a) }, len: 1},
+		{name: "add b", op: func() []udpEviction { return table.add(b) }, evicted: a, len: 1},
+		{name: "add c", op: func() []udpEviction { return table.add(c) }, evicted: b, len: 1},
+		{name: "remove evicted a", op: func() []udpEviction { table.remove(a); return nil }, len: 1},
+		{name: "remove c", op: func() []udpEviction { table.remove(c); return nil }, len: 0},
+		{name: "add a again", op: func() []udpEviction { return table.add(newTestSession("192.0.2.1", 2)) }, len: 1},
+	} {
+		evictions := tc.op()
+		switch {
+		case tc.evicted == nil && len(evictions) != 0:
+			t.Fatalf("%s: expected no evictions, got %v", tc.name, evictions)
+		case tc.evicted != nil && (len(evictions) != 1 || evictions[0].conn != tc.evicted ||
+			evictions[0].reason != udpEvictionReasonPrefix):
+			t.Fatalf("%s: expected 1 eviction due to the prefix limit, got %v", tc.name, evictions)
+		}
+		if table.len() != tc.len {
+			t.Fatalf("%s: expected %d sessions, got %d", tc.name, tc.len, table.len())
+		}
+		if tc.len > 0 && table.byPrefix[netip.MustParsePrefix("192.0.2.0/24")].Len() != tc.len {
+			t.Fatalf("%s: expected the prefix to track %d sessions", tc.name, tc.len)
+		}
+	}
+	if len(table.byPrefix) != 1 {
+		t.Fatalf("expected 1 tracked prefix, got %d", len(table.byPrefix))
+	}
+}
+
+func TestServePacketEvictsSessions(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen | %s", err)
+	}
+
+	evicted := make(chan error, 2)
+	server := &Server{
+		IdleTimeout:    caddy.Duration(idleTimeoutDefault),
+		MaxUDPSessions: 1,
+		logger:         zap.NewNop(),
+	}
+	server.sessions = newUDPSessionTable(server)
+	server.compiledRoute = RouteList{}.Compile(zap.NewNop(), time.Second, HandlerFunc(func(cx *Connection) error {
+		buf := make([]byte, 9000)
+		for {
+			if _, err := cx.Read(buf); err != nil {
+				evicted <- err
+				return nil
+			}
+		}
+	}))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = server.servePacket(pc)
+	}()
+	defer func() {
+		_ = pc.Close()
+		<-served
+	}()
+
+	for range 2 {
+		client, err := net.Dial("udp", pc.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("failed to dial | %s", err)
+		}
+		defer func() { _ = client.Close() }()
+		if _, err = client.Write([]byte("hello")); err != nil {
+			t.Fatalf("failed to write | %s", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the session of the first client is evicted well before it idles out
+	select {
+	case err := <-evicted:
+		if err != io.EOF {
+			t.Fatalf("expected EOF on eviction, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the first session to be evicted")
+	}
+	if server.sessions.len() != 1 {
+		t.Fatalf("expected 1 session, got %d", server.sessions.len())
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layer4
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// SocketOptions configures the sockets a server listens on. The options are applied
+// when the sockets are created, and the ones irrelevant for a network (e.g. TCP options
+// for UDP sockets) are ignored. Keepalive and no_delay options are supported on all
+// platforms, and the rest of the options are only supported on Linux.
+type SocketOptions struct {
+	// Time TCP connections must be idle for before the first keepalive probe is sent.
+	// A negative value disables keepalive probes. Default: 15s.
+	KeepAliveIdle caddy.Duration `json:"keepalive_idle,omitempty"`
+	// Time between TCP keepalive probes. Default: 15s.
+	KeepAliveInterval caddy.Duration `json:"keepalive_interval,omitempty"`
+	// Number of unanswered TCP keepalive probes before a connection is dropped. Default: 9.
+	KeepAliveCount int `json:"keepalive_count,omitempty"`
+
+	// Whether TCP_NODELAY is set on accepted TCP connections, i.e. Nagle's algorithm is disabled.
+	// Default: true.
+	NoDelay *bool `json:"no_delay,omitempty"`
+
+	// Size of the socket receive buffer (SO_RCVBUF) in bytes. Default: 0 (system default).
+	ReceiveBuffer int `json:"receive_buffer,omitempty"`
+	// Size of the socket send buffer (SO_SNDBUF) in bytes. Default: 0 (system default).
+	SendBuffer int `json:"send_buffer,omitempty"`
+
+	// Length of the queue of pending TCP Fast Open requests (TCP_FASTOPEN).
+	// Default: 0 (TCP Fast Open is disabled).
+	FastOpen int `json:"fast_open,omitempty"`
+	// Time the kernel waits for the first bytes from clients before accepting TCP connections
+	// (TCP_DEFER_ACCEPT). It is rounded up to whole seconds. Default: 0 (no waiting).
+	DeferAccept caddy.Duration `json:"defer_accept,omitempty"`
+
+	// Value of the type of service field of outgoing IPv4 packets (IP_TOS), or the traffic class
+	// field of outgoing IPv6 packets (IPV6_TCLASS). A DSCP value must be shifted left by 2 bits,
+	// e.g. a value of 184 (0xB8) corresponds to DSCP 46 (EF). Default: 0 (system default).
+	TOS int `json:"tos,omitempty"`
+	// Firewall mark of outgoing packets (SO_MARK). Default: 0 (no mark).
+	Mark int `json:"mark,omitempty"`
+}
+
+// provision validates so's values.
+func (so *SocketOptions) provision() error {
+	if so.KeepAliveInterval < 0 {
+		return fmt.Errorf("invalid keepalive interval: %s", time.Duration(so.KeepAliveInterval))
+	}
+	if so.KeepAliveCount < 0 {
+		return fmt.Errorf("invalid keepalive count: %d", so.KeepAliveCount)
+	}
+	if so.ReceiveBuffer < 0 || so.SendBuffer < 0 {
+		return fmt.Errorf("invalid buffer size: %d", min(so.ReceiveBuffer, so.SendBuffer))
+	}
+	if so.FastOpen < 0 {
+		return fmt.Errorf("invalid fast open queue length: %d", so.FastOpen)
+	}
+	if so.DeferAccept < 0 {
+		return fmt.Errorf("invalid defer accept duration: %s", time.Duration(so.DeferAccept))
+	}
+	if so.TOS < 0 || so.TOS > 255 {
+		return fmt.Errorf("invalid type of service: %d", so.TOS)
+	}
+	if so.Mark < 0 {
+		return fmt.Errorf("invalid mark: %d", so.Mark)
+	}
+	return nil
+}
+
+// listenConfig returns a net.ListenConfig applying so to the sockets it creates.
+// A nil SocketOptions returns an empty net.ListenConfig.
+func (so *SocketOptions) listenConfig() net.ListenConfig {
+	if so == nil {
+		return net.ListenConfig{}
+	}
+
+	lc := net.ListenConfig{Control: so.control}
+	if so.KeepAliveIdle < 0 {
+		lc.KeepAlive = -1
+	} else {
+		lc.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     time.Duration(so.KeepAliveIdle),
+			Interval: time.Duration(so.KeepAliveInterval),
+			Count:    so.KeepAliveCount,
+		}
+	}
+	return lc
+}
+
+// control applies so to the socket c before it's bound.
+func (so *SocketOptions) control(network, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = so.setSockopts(network, fd)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// applyToConn applies so to the accepted connection conn.
+func (so *SocketOptions) applyToConn(conn net.Conn) error {
+	if so == nil || so.NoDelay == nil {
+		return nil
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.SetNoDelay(*so.NoDelay)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the SocketOptions from Caddyfile tokens. Syntax:
+//
+//	socket_options {
+//		keepalive <idle> [<interval> [<count>]]
+//		keepalive off
+//		no_delay <true|false>
+//		receive_buffer <size>
+//		send_buffer <size>
+//		fast_open <queue_length>
+//		defer_accept <duration>
+//		tos <value>
+//		dscp <value>
+//		mark <value>
+//	}
+func (so *SocketOptions) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	var hasKeepAlive, hasNoDelay, hasTOS bool
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "keepalive":
+			if hasKeepAlive {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() == 0 || d.CountRemainingArgs() > 3 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			if d.Val() == "off" {
+				if d.CountRemainingArgs() > 0 {
+					return d.ArgErr()
+				}
+				so.KeepAliveIdle, hasKeepAlive = -1, true
+				break
+			}
+			idle, err := caddy.ParseDuration(d.Val())
+			if err != nil || idle <= 0 {
+				return d.Errf("parsing %s option '%s': invalid duration %s", wrapper, optionName, d.Val())
+			}
+			so.KeepAliveIdle = caddy.Duration(idle)
+			if d.NextArg() {
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil || interval <= 0 {
+					return d.Errf("parsing %s option '%s': invalid duration %s", wrapper, optionName, d.Val())
+				}
+				so.KeepAliveInterval = caddy.Duration(interval)
+			}
+			if d.NextArg() {
+				count, err := strconv.Atoi(d.Val())
+				if err != nil || count <= 0 {
+					return d.Errf("parsing %s option '%s': invalid count %s", wrapper, optionName, d.Val())
+				}
+				so.KeepAliveCount = count
+			}
+			hasKeepAlive = true
+		case "no_delay":
+			if hasNoDelay {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("parsing %s option '%s': invalid value %s", wrapper, optionName, d.Val())
+			}
+			so.NoDelay, hasNoDelay = &val, true
+		case "receive_buffer", "send_buffer", "fast_open", "mark":
+			field := map[string]*int{
+				"receive_buffer": &so.ReceiveBuffer,
+				"send_buffer":    &so.SendBuffer,
+				"fast_open":      &so.FastOpen,
+				"mark":           &so.Mark,
+			}[optionName]
+			if *field != 0 {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseInt(d.Val(), 0, 32)
+			if err != nil || val <= 0 {
+				return d.Errf("parsing %s option '%s': invalid value %s", wrapper, optionName, d.Val())
+			}
+			*field = int(val)
+		case "defer_accept":
+			if so.DeferAccept != 0 {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return d.Errf("parsing %s option '%s': invalid duration %s", wrapper, optionName, d.Val())
+			}
+			so.DeferAccept = caddy.Duration(dur)
+		case "tos", "dscp":
+			if hasTOS {
+				return d.Errf("duplicate %s option '%s'", wrapper, "tos")
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.ParseUint(d.Val(), 0, 8)
+			if err != nil || (optionName == "dscp" && val > 63) {
+				return d.Errf("parsing %s option '%s': invalid value %s", wrapper, optionName, d.Val())
+			}
+			if optionName == "dscp" {
+				val <<= 2
+			}
+			so.TOS, hasTOS = int(val), true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Interface guard
+var _ caddyfile.Unmarshaler = (*SocketOptions)(nil)
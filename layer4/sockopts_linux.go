@@ -0,0 +1,82 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package layer4
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSockopts applies so to the socket fd of network on Linux.
+func (so *SocketOptions) setSockopts(network string, fd uintptr) error {
+	sock := int(fd)
+	if so.ReceiveBuffer > 0 {
+		if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_RCVBUF, so.ReceiveBuffer); err != nil {
+			return fmt.Errorf("setting SO_RCVBUF: %v", err)
+		}
+	}
+	if so.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_SNDBUF, so.SendBuffer); err != nil {
+			return fmt.Errorf("setting SO_SNDBUF: %v", err)
+		}
+	}
+	if so.Mark > 0 {
+		if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_MARK, so.Mark); err != nil {
+			return fmt.Errorf("setting SO_MARK: %v", err)
+		}
+	}
+	if so.TOS > 0 && !strings.HasPrefix(network, "unix") {
+		if err := setTOS(sock, network, so.TOS); err != nil {
+			return err
+		}
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	if so.FastOpen > 0 {
+		if err := unix.SetsockoptInt(sock, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, so.FastOpen); err != nil {
+			return fmt.Errorf("setting TCP_FASTOPEN: %v", err)
+		}
+	}
+	if so.DeferAccept > 0 {
+		secs := int((time.Duration(so.DeferAccept) + time.Second - 1) / time.Second)
+		if err := unix.SetsockoptInt(sock, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, secs); err != nil {
+			return fmt.Errorf("setting TCP_DEFER_ACCEPT: %v", err)
+		}
+	}
+	return nil
+}
+
+// setTOS sets the type of service of IPv4 packets and the traffic class of IPv6 packets sent from sock.
+// Since IPv6 sockets may also carry IPv4 traffic, failing to set either option is only an error
+// if the other one has failed as well, or the network is IPv4-only.
+func setTOS(sock int, network string, tos int) error {
+	ipv4Err := unix.SetsockoptInt(sock, unix.IPPROTO_IP, unix.IP_TOS, tos)
+	if strings.HasSuffix(network, "4") {
+		if ipv4Err != nil {
+			return fmt.Errorf("setting IP_TOS: %v", ipv4Err)
+		}
+		return nil
+	}
+	if err := unix.SetsockoptInt(sock, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil && ipv4Err != nil {
+		return fmt.Errorf("setting IPV6_TCLASS: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package layer4
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptionsUnmarshalCaddyfile(t *testing.T) {
+	so := new(SocketOptions)
+	err := so.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`socket_options {
+		keepalive 30s 10s 5
+		no_delay false
+		receive_buffer 65536
+		send_buffer 0x10000
+		defer_accept 2s
+		dscp 46
+	}`))
+	if err != nil {
+		t.Fatalf("unmarshaling socket options: %v", err)
+	}
+	if so.KeepAliveIdle != caddy.Duration(30*time.Second) || so.KeepAliveInterval != caddy.Duration(10*time.Second) ||
+		so.KeepAliveCount != 5 || so.NoDelay == nil || *so.NoDelay || so.ReceiveBuffer != 65536 ||
+		so.SendBuffer != 65536 || so.DeferAccept != caddy.Duration(2*time.Second) || so.TOS != 184 {
+		t.Fatalf("unexpected socket options: %+v", so)
+	}
+
+	for i, input := range []string{
+		"socket_options {\n keepalive off 10s\n}",
+		"socket_options {\n tos 1\n dscp 1\n}",
+		"socket_options {\n dscp 64\n}",
+		"socket_options {\n receive_buffer -1\n}",
+		"socket_options {\n unknown 1\n}",
+	} {
+		if err := new(SocketOptions).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Fatalf("Test %d: expected an error for %q", i, input)
+		}
+	}
+}
+
+func TestSocketOptionsAreApplied(t *testing.T) {
+	noDelay := false
+	so := &SocketOptions{
+		KeepAliveIdle:     caddy.Duration(30 * time.Second),
+		KeepAliveInterval: caddy.Duration(10 * time.Second),
+		KeepAliveCount:    5,
+		NoDelay:           &noDelay,
+		ReceiveBuffer:     65536,
+		DeferAccept:       caddy.Duration(1500 * time.Millisecond),
+		TOS:               184,
+	}
+	if err := so.provision(); err != nil {
+		t.Fatalf("provisioning socket options: %v", err)
+	}
+
+	lc := so.listenConfig()
+	ln, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	getsockopt := func(c syscall.Conn, level, opt int) int {
+		t.Helper()
+		rc, err := c.SyscallConn()
+		if err != nil {
+			t.Fatalf("getting raw connection: %v", err)
+		}
+		var val int
+		var serr error
+		if err := rc.Control(func(fd uintptr) { val, serr = unix.GetsockoptInt(int(fd), level, opt) }); err != nil {
+			t.Fatalf("controlling raw connection: %v", err)
+		}
+		if serr != nil {
+			t.Fatalf("getting socket option %d: %v", opt, serr)
+		}
+		return val
+	}
+
+	tcpLn := ln.(*net.TCPListener)
+	// the kernel doubles the requested buffer size to account for bookkeeping overhead
+	if val := getsockopt(tcpLn, unix.SOL_SOCKET, unix.SO_RCVBUF); val != 2*so.ReceiveBuffer {
+		t.Fatalf("expected SO_RCVBUF %d, got %d", 2*so.ReceiveBuffer, val)
+	}
+	if val := getsockopt(tcpLn, unix.IPPROTO_IP, unix.IP_TOS); val != so.TOS {
+		t.Fatalf("expected IP_TOS %d, got %d", so.TOS, val)
+	}
+	if val := getsockopt(tcpLn, unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT); val < 2 {
+		t.Fatalf("expected TCP_DEFER_ACCEPT of at least 2 seconds, got %d", val)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp4", ln.Addr().String())
+		if err == nil {
+			_, _ = conn.Write([]byte("hello"))
+			time.Sleep(100 * time.Millisecond)
+			_ = conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accepting: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if err := so.applyToConn(conn); err != nil {
+		t.Fatalf("applying socket options to connection: %v", err)
+	}
+
+	tcpConn := conn.(*net.TCPConn)
+	if val := getsockopt(tcpConn, unix.IPPROTO_TCP, unix.TCP_NODELAY); val != 0 {
+		t.Fatalf("expected TCP_NODELAY to be disabled, got %d", val)
+	}
+	if val := getsockopt(tcpConn, unix.SOL_SOCKET, unix.SO_KEEPALIVE); val != 1 {
+		t.Fatalf("expected SO_KEEPALIVE to be enabled, got %d", val)
+	}
+	if val := getsockopt(tcpConn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE); val != 30 {
+		t.Fatalf("expected TCP_KEEPIDLE 30, got %d", val)
+	}
+	if val := getsockopt(tcpConn, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL); val != 10 {
+		t.Fatalf("expected TCP_KEEPINTVL 10, got %d", val)
+	}
+	if val := getsockopt(tcpConn, unix.IPPROTO_TCP, unix.TCP_KEEPCNT); val != 5 {
+		t.Fatalf("expected TCP_KEEPCNT 5, got %d", val)
+	}
+}
@@ -16,6 +16,7 @@ package l4dns
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"regexp"
@@ -96,24 +97,19 @@ func (m *MatchDNS) Match(cx *layer4.Connection) (bool, error) {
 			return false, nil
 		}
 	} else {
-		// Read a minimum number of bytes
-		msgBuf = make([]byte, dnsHeaderBytes)
-		n, err := io.ReadAtLeast(cx, msgBuf, int(dnsHeaderBytes))
+		// Read a single datagram and validate its length
+		msgBuf = make([]byte, layer4.MaxPacketBytes)
+		n, err := cx.ReadPacket(msgBuf)
+		if errors.Is(err, io.ErrShortBuffer) {
+			return false, nil
+		}
 		if err != nil {
 			return false, err
 		}
-
-		// Read the remaining bytes and validate their length
-		var nn int
-		tmpBuf := make([]byte, dns.MinMsgSize)
-		for err == nil {
-			nn, err = io.ReadAtLeast(cx, tmpBuf, 1)
-			msgBuf = append(msgBuf, tmpBuf[:nn]...)
-			n += nn
-		}
-		if n > dns.MaxMsgSize {
+		if n < int(dnsHeaderBytes) || n > dns.MaxMsgSize {
 			return false, nil
 		}
+		msgBuf = msgBuf[:n]
 		msgBytes = uint16(n) //nolint:gosec // disable G115
 	}
 
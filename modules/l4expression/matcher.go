@@ -0,0 +1,360 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4expression
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+	"github.com/google/cel-go/interpreter"
+	"github.com/google/cel-go/parser"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchExpression{})
+}
+
+// MatchExpression is able to match connections by evaluating a [CEL](https://github.com/google/cel-spec) expression.
+// Any placeholders (e.g. `{l4.tls.server_name}` or `{l4.vars.name}`) are expanded into proper CEL function calls
+// before evaluating, and unknown placeholders evaluate to empty strings. Other registered layer4 matchers may be
+// called as functions taking their same-line Caddyfile arguments as string literals, e.g. `remote_ip('10.0.0.0/8')`.
+//
+// This matcher's JSON interface is actually a string, not a struct.
+type MatchExpression struct {
+	// Expr is the CEL expression to evaluate. It must return a boolean value.
+	Expr string `json:"-"`
+
+	expandedExpr string
+	prg          cel.Program
+	matchers     []layer4.ConnMatcher
+	logger       *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchExpression) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.expression",
+		New: func() caddy.Module { return new(MatchExpression) },
+	}
+}
+
+// MarshalJSON marshals m's expression.
+func (m *MatchExpression) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Expr)
+}
+
+// UnmarshalJSON unmarshals m's expression.
+func (m *MatchExpression) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.Expr)
+}
+
+// Match returns true if m's expression evaluates to true for the connection.
+func (m *MatchExpression) Match(cx *layer4.Connection) (bool, error) {
+	out, _, err := m.prg.Eval(celConnection{cx})
+	if err != nil {
+		if errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) || errors.Is(err, layer4.ErrMatchingBufferFull) {
+			return false, err
+		}
+		m.logger.Error("evaluating expression", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err), cx.IDField())
+		return false, err
+	}
+	if outBool, ok := out.Value().(bool); ok {
+		return outBool, nil
+	}
+	return false, nil
+}
+
+// MatchingCheckpoints returns the checkpoints of the timed matchers called from m's expression.
+func (m *MatchExpression) MatchingCheckpoints() []time.Duration {
+	var checkpoints []time.Duration
+	for _, matcher := range m.matchers {
+		if tm, ok := matcher.(layer4.TimedMatcher); ok {
+			checkpoints = append(checkpoints, tm.MatchingCheckpoints()...)
+		}
+	}
+	return checkpoints
+}
+
+// Provision compiles m's expression, and provisions the matchers called from it.
+func (m *MatchExpression) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger()
+
+	// replace placeholders with a function call, and strip the escape
+	// character from escaped placeholders, so that they can be used
+	// as an input to other CEL functions
+	m.expandedExpr = placeholderRegexp.ReplaceAllString(m.Expr, placeholderExpansion)
+	m.expandedExpr = escapedPlaceholderRegexp.ReplaceAllString(m.expandedExpr, escapedPlaceholderExpansion)
+
+	// make other layer4 matchers callable as functions
+	var macros []cel.Macro
+	for _, info := range caddy.GetModules(matchersNamespace) {
+		name := info.ID.Name()
+		switch name {
+		case "all", "any", "expression", "not": // use CEL operators instead
+			continue
+		}
+		if _, ok := info.New().(caddyfile.Unmarshaler); !ok {
+			continue
+		}
+		macros = append(macros, parser.NewGlobalVarArgMacro(name, m.matcherMacroExpander(ctx, name)))
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable(celConnVarName, connectionObjectType),
+		cel.Function(celPlaceholderFuncName, cel.Overload(celPlaceholderFuncName+"_conn_string",
+			[]*cel.Type{connectionObjectType, cel.StringType}, cel.DynType,
+			cel.BinaryBinding(celPlaceholderFunc))),
+		cel.Function(celMatcherFuncName, cel.Overload(celMatcherFuncName+"_conn_int",
+			[]*cel.Type{connectionObjectType, cel.IntType}, cel.BoolType,
+			cel.BinaryBinding(m.celMatcherFunc))),
+		cel.CustomTypeAdapter(celTypeAdapter{}),
+		cel.Macros(macros...),
+		ext.Strings(),
+		ext.Lists(),
+		ext.Math(),
+	)
+	if err != nil {
+		return fmt.Errorf("setting up CEL environment: %v", err)
+	}
+
+	checked, issues := env.Compile(m.expandedExpr)
+	if issues.Err() != nil {
+		return fmt.Errorf("compiling CEL program: %s", issues.Err())
+	}
+	if checked.OutputType() != cel.BoolType {
+		return fmt.Errorf("CEL connection matcher expects return type of bool, not %s", checked.OutputType())
+	}
+
+	m.prg, err = env.Program(checked, cel.EvalOptions(cel.OptOptimize))
+	if err != nil {
+		return fmt.Errorf("compiling CEL program: %s", err)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchExpression from Caddyfile tokens. Syntax:
+//
+//	expression <expression>
+func (m *MatchExpression) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// if there are multiple args, keep the raw tokens, since
+	// the expression may contain quoted strings
+	if d.CountRemainingArgs() > 1 {
+		m.Expr = strings.Join(d.RemainingArgsRaw(), " ")
+	} else if d.NextArg() {
+		m.Expr = d.Val()
+	} else {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s matcher: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// matcherMacroExpander returns a macro expander that provisions the named matcher from the string literals
+// the macro is called with, and replaces the macro with a call of the matcher function referencing it.
+func (m *MatchExpression) matcherMacroExpander(ctx caddy.Context, name string) parser.MacroExpander {
+	return func(eh parser.ExprHelper, _ ast.Expr, args []ast.Expr) (ast.Expr, *common.Error) {
+		tokens := []caddyfile.Token{{Text: name, Line: 1}}
+		for _, arg := range args {
+			if arg.Kind() != ast.LiteralKind || arg.AsLiteral().Type() != types.StringType {
+				return nil, eh.NewError(arg.ID(), fmt.Sprintf("%s matcher arguments must be string literals", name))
+			}
+			tokens = append(tokens, caddyfile.Token{Text: string(arg.AsLiteral().(types.String)), Line: 1})
+		}
+
+		matcher, err := loadMatcher(ctx, name, tokens)
+		if err != nil {
+			return nil, eh.NewError(0, fmt.Sprintf("loading %s matcher: %v", name, err))
+		}
+		m.matchers = append(m.matchers, matcher)
+
+		return eh.NewCall(celMatcherFuncName, eh.NewIdent(celConnVarName),
+			eh.NewLiteral(types.Int(len(m.matchers)-1))), nil
+	}
+}
+
+// celMatcherFunc implements the CEL function calling a matcher provisioned from the expression.
+func (m *MatchExpression) celMatcherFunc(lhs, rhs ref.Val) ref.Val {
+	conn, ok := lhs.(celConnection)
+	if !ok {
+		return types.NewErr("invalid connection of type '%v' to %s(conn, index)", lhs.Type(), celMatcherFuncName)
+	}
+	idx, ok := rhs.(types.Int)
+	if !ok || idx < 0 || int(idx) >= len(m.matchers) {
+		return types.NewErr("invalid matcher index '%v' to %s(conn, index)", rhs, celMatcherFuncName)
+	}
+
+	// a matcher set rewinds the connection, so that each matcher reads the same data
+	matched, err := layer4.MatcherSet{m.matchers[idx]}.Match(conn.Connection)
+	if err != nil {
+		return types.WrapErr(err)
+	}
+	return types.Bool(matched)
+}
+
+// loadMatcher unmarshals the named matcher from Caddyfile tokens, and provisions it.
+func loadMatcher(ctx caddy.Context, name string, tokens []caddyfile.Token) (layer4.ConnMatcher, error) {
+	d := caddyfile.NewDispenser(tokens)
+	d.Next() // consume wrapper name
+
+	unm, err := caddyfile.UnmarshalModule(d, matchersNamespace+"."+name)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := ctx.LoadModuleByID(matchersNamespace+"."+name, caddyconfig.JSON(unm, nil))
+	if err != nil {
+		return nil, err
+	}
+	matcher, ok := mod.(layer4.ConnMatcher)
+	if !ok {
+		return nil, fmt.Errorf("module is not a layer4 connection matcher: %T", mod)
+	}
+	return matcher, nil
+}
+
+// celPlaceholderFunc implements the CEL function getting placeholder values from the connection's replacer.
+func celPlaceholderFunc(lhs, rhs ref.Val) ref.Val {
+	conn, ok := lhs.(celConnection)
+	if !ok {
+		return types.NewErr("invalid connection of type '%v' to %s(conn, placeholder)", lhs.Type(), celPlaceholderFuncName)
+	}
+	key, ok := rhs.(types.String)
+	if !ok {
+		return types.NewErr("invalid placeholder of type '%v' to %s(conn, placeholder)", rhs.Type(), celPlaceholderFuncName)
+	}
+
+	val, known := conn.Replacer().Get(string(key))
+	if !known || val == nil {
+		return types.String("")
+	}
+	return celTypeAdapter{}.NativeToValue(val)
+}
+
+// connectionCELType is the type representation of a layer4 connection.
+var connectionCELType = cel.ObjectType("layer4.Connection", traits.ReceiverType)
+
+// connectionObjectType is the CEL type of the connection variable.
+var connectionObjectType = cel.ObjectType("layer4.Connection")
+
+// celConnection wraps a layer4.Connection with ref.Val interface methods. It also implements
+// the interpreter.Activation interface, so that it can be evaluated without extra allocations.
+type celConnection struct{ *layer4.Connection }
+
+func (cc celConnection) ResolveName(name string) (any, bool) {
+	if name == celConnVarName {
+		return cc, true
+	}
+	return nil, false
+}
+
+func (cc celConnection) Parent() interpreter.Activation {
+	return nil
+}
+
+func (cc celConnection) ConvertToNative(_ reflect.Type) (any, error) {
+	return cc.Connection, nil
+}
+
+func (cc celConnection) ConvertToType(_ ref.Type) ref.Val {
+	return types.NewErr("conversion of %s is not supported", connectionCELType.TypeName())
+}
+
+func (cc celConnection) Equal(other ref.Val) ref.Val {
+	if o, ok := other.Value().(celConnection); ok {
+		return types.Bool(o.Connection == cc.Connection)
+	}
+	return types.ValOrErr(other, "%v is not comparable type", other)
+}
+
+func (celConnection) Type() ref.Type { return connectionCELType }
+
+func (cc celConnection) Value() any { return cc }
+
+// celTypeAdapter adapts placeholder values of types unknown to CEL.
+type celTypeAdapter struct{}
+
+func (celTypeAdapter) NativeToValue(value any) ref.Val {
+	switch v := value.(type) {
+	case celConnection:
+		return v
+	case time.Time:
+		return types.Timestamp{Time: v}
+	case time.Duration:
+		return types.Duration{Duration: v}
+	case net.Addr:
+		return types.String(v.String())
+	case error:
+		return types.WrapErr(v)
+	case fmt.Stringer:
+		return types.String(v.String())
+	}
+	return types.DefaultTypeAdapter.NativeToValue(value)
+}
+
+// Variables used for replacing placeholders in CEL expressions
+// with proper CEL function calls; this is just syntactic sugar.
+var (
+	// The placeholder may not be preceded by a backslash; the expansion
+	// includes the preceding character if it is not a backslash.
+	placeholderRegexp    = regexp.MustCompile(`([^\\]|^){([a-zA-Z][\w.-]+)}`)
+	placeholderExpansion = `${1}` + celPlaceholderFuncName + `(` + celConnVarName + `, "${2}")`
+
+	// As a second pass, the escape character in front of
+	// the placeholder is stripped, if it exists.
+	escapedPlaceholderRegexp    = regexp.MustCompile(`\\{([a-zA-Z][\w.-]+)}`)
+	escapedPlaceholderExpansion = `{${1}}`
+)
+
+const (
+	celConnVarName         = "conn"
+	celMatcherFuncName     = "l4_match"
+	celPlaceholderFuncName = "ph"
+	matchersNamespace      = "layer4.matchers"
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchExpression)(nil)
+	_ caddyfile.Unmarshaler = (*MatchExpression)(nil)
+	_ json.Marshaler        = (*MatchExpression)(nil)
+	_ json.Unmarshaler      = (*MatchExpression)(nil)
+	_ layer4.ConnMatcher    = (*MatchExpression)(nil)
+	_ layer4.TimedMatcher   = (*MatchExpression)(nil)
+)
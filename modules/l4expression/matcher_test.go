@@ -0,0 +1,201 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4expression
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+type dummyConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// LocalAddr implements net.Conn.
+func (dc *dummyConn) LocalAddr() net.Addr {
+	return dc.localAddr
+}
+
+// RemoteAddr implements net.Conn.
+func (dc *dummyConn) RemoteAddr() net.Addr {
+	return dc.remoteAddr
+}
+
+// testNeedsMoreMatcher is a data matcher that never has enough data to decide.
+type testNeedsMoreMatcher struct{}
+
+func (*testNeedsMoreMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.test_needs_more",
+		New: func() caddy.Module { return new(testNeedsMoreMatcher) },
+	}
+}
+
+func (*testNeedsMoreMatcher) Match(*layer4.Connection) (bool, error) {
+	return false, layer4.ErrConsumedAllPrefetchedBytes
+}
+
+func (*testNeedsMoreMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+	return nil
+}
+
+// testPrefixMatcher is a data matcher that reads as many bytes as its prefix has, and compares them.
+type testPrefixMatcher struct {
+	Prefix string `json:"prefix,omitempty"`
+}
+
+func (*testPrefixMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.test_prefix",
+		New: func() caddy.Module { return new(testPrefixMatcher) },
+	}
+}
+
+func (m *testPrefixMatcher) Match(cx *layer4.Connection) (bool, error) {
+	buf := make([]byte, len(m.Prefix))
+	if _, err := io.ReadFull(cx, buf); err != nil {
+		return false, err
+	}
+	return string(buf) == m.Prefix, nil
+}
+
+func (m *testPrefixMatcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume wrapper name
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	m.Prefix = d.Val()
+	return nil
+}
+
+func Test_MatchExpression_Match(t *testing.T) {
+	caddy.RegisterModule(&testNeedsMoreMatcher{})
+
+	type test struct {
+		expr        string
+		shouldMatch bool
+		expectedErr error
+	}
+
+	tests := []test{
+		{expr: `{l4.vars.sni}.endsWith('.internal')`, shouldMatch: true},
+		{expr: `{l4.vars.sni} == 'example.com'`, shouldMatch: false},
+		{expr: `{l4.vars.unknown} == ''`, shouldMatch: true},
+		{expr: `{l4.conn.remote_addr}.startsWith('10.1.2.3:')`, shouldMatch: true},
+		{expr: `remote_ip('10.0.0.0/8') && {l4.vars.sni}.endsWith('.internal')`, shouldMatch: true},
+		{expr: `remote_ip('192.168.0.0/16', '172.16.0.0/12') || local_ip('127.0.0.1')`, shouldMatch: false},
+		{expr: `!remote_ip('192.168.0.0/16') && {l4.vars.port} > 1024`, shouldMatch: true},
+		{expr: `test_needs_more() || remote_ip('10.0.0.0/8')`, shouldMatch: true},
+		{expr: `test_needs_more() && remote_ip('10.0.0.0/8')`, expectedErr: layer4.ErrConsumedAllPrefetchedBytes},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			m := &MatchExpression{Expr: tc.expr}
+			if err := m.Provision(ctx); err != nil {
+				t.Fatalf("test %d: provision failed | %s", i, err)
+			}
+
+			cx := layer4.WrapConnection(&dummyConn{
+				localAddr:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+				remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 54321},
+			}, []byte{}, zap.NewNop())
+			cx.SetVar("sni", "db.internal")
+			cx.SetVar("port", 54321)
+
+			matched, err := m.Match(cx)
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("test %d: expected error %v, got %v", i, tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("test %d: match failed | %s", i, err)
+			}
+			if matched != tc.shouldMatch {
+				t.Fatalf("test %d: matched = %t, want %t", i, matched, tc.shouldMatch)
+			}
+		}()
+	}
+}
+
+func Test_MatchExpression_MatchData(t *testing.T) {
+	caddy.RegisterModule(&testPrefixMatcher{})
+
+	tests := map[string]bool{
+		`test_prefix('SSH')`:                                 true,
+		`test_prefix('\x16\x03') || test_prefix('SSH')`:      true,
+		`test_prefix('SSH') && test_prefix('SSH-2.0')`:       true,
+		`test_prefix('SSH-2.0') && !test_prefix('SSH-1.99')`: true,
+		`test_prefix('SSH') && test_prefix('-2.0')`:          false,
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for expr, shouldMatch := range tests {
+		m := &MatchExpression{Expr: expr}
+		if err := m.Provision(ctx); err != nil {
+			t.Fatalf("%s: provision failed | %s", expr, err)
+		}
+
+		cx := layer4.WrapConnection(&dummyConn{
+			localAddr:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22},
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 54321},
+		}, []byte("SSH-2.0-OpenSSH_9.6\r\n"), zap.NewNop())
+
+		// matchers of an expression must read the same data, as matchers of a set do
+		matched, err := layer4.MatcherSet{m}.Match(cx)
+		if err != nil {
+			t.Fatalf("%s: match failed | %s", expr, err)
+		}
+		if matched != shouldMatch {
+			t.Fatalf("%s: matched = %t, want %t", expr, matched, shouldMatch)
+		}
+	}
+}
+
+func Test_MatchExpression_Provision(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, expr := range []string{
+		`{l4.vars.sni}`,                    // not a boolean
+		`remote_ip({l4.vars.ip})`,          // not a string literal
+		`remote_ip('not-an-ip')`,           // invalid matcher config
+		`{l4.vars.sni}.endsWith('.example`, // syntax error
+	} {
+		m := &MatchExpression{Expr: expr}
+		if err := m.Provision(ctx); err == nil {
+			t.Fatalf("test %d: expected provision error for %q", i, expr)
+		}
+	}
+}
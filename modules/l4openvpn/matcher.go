@@ -248,7 +248,10 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 			}
 		} else {
 			buf = make([]byte, MessageAuthBytesMaxHL+1)
-			n, err = io.ReadAtLeast(cx, buf, 1)
+			n, err = cx.ReadPacket(buf)
+			if errors.Is(err, io.ErrShortBuffer) {
+				return false, nil
+			}
 			if err != nil || n < MessagePlainBytesTotalHL || n > MessageAuthBytesMaxHL {
 				return false, err
 			}
@@ -296,7 +299,10 @@ func (m *MatchOpenVPN) Match(cx *layer4.Connection) (bool, error) {
 			}
 		} else {
 			buf = make([]byte, MessageCrypt2BytesMaxHL+1)
-			n, err = io.ReadAtLeast(cx, buf, 1)
+			n, err = cx.ReadPacket(buf)
+			if errors.Is(err, io.ErrShortBuffer) {
+				return false, nil
+			}
 			if err != nil || n < MessageCrypt2BytesMinHL || n > MessageCrypt2BytesMaxHL {
 				return false, err
 			}
@@ -0,0 +1,161 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func hashedUpstream(i, weight int) *Upstream {
+	return &Upstream{Dial: []string{fmt.Sprintf("10.0.0.%d:5432", i)}, Weight: weight, peers: []*peer{{}}}
+}
+
+func TestHashSelectionIsConsistent(t *testing.T) {
+	pool := UpstreamPool{hashedUpstream(1, 1), hashedUpstream(2, 1), hashedUpstream(3, 1), hashedUpstream(4, 1)}
+	h := &HashSelection{Key: "{l4.vars.key}"}
+
+	const keys = 1000
+	before := make([]*Upstream, keys)
+	for i := range keys {
+		before[i] = h.Select(pool, connWithKey(fmt.Sprintf("key-%d", i)))
+		if before[i] == nil {
+			t.Fatal("unexpected nil selection")
+		}
+		if again := h.Select(pool, connWithKey(fmt.Sprintf("key-%d", i))); again != before[i] {
+			t.Fatalf("key-%d: selected %v, then %v", i, before[i], again)
+		}
+	}
+
+	// removing an upstream only remaps the keys that belonged to it
+	removed := pool[1]
+	smaller := UpstreamPool{pool[0], pool[2], pool[3]}
+	for i := range keys {
+		after := h.Select(smaller, connWithKey(fmt.Sprintf("key-%d", i)))
+		if before[i] != removed && after != before[i] {
+			t.Fatalf("key-%d: moved from %v to %v", i, before[i], after)
+		}
+	}
+
+	// adding an upstream only remaps keys to it
+	larger := append(pool, hashedUpstream(5, 1))
+	for i := range keys {
+		after := h.Select(larger, connWithKey(fmt.Sprintf("key-%d", i)))
+		if after != before[i] && after != larger[4] {
+			t.Fatalf("key-%d: moved from %v to %v", i, before[i], after)
+		}
+	}
+}
+
+func TestHashSelectionHonorsWeight(t *testing.T) {
+	pool := UpstreamPool{hashedUpstream(1, 1), hashedUpstream(2, 3)}
+	h := &HashSelection{Key: "{l4.vars.key}"}
+
+	counts := map[*Upstream]int{}
+	for i := range 4000 {
+		counts[h.Select(pool, connWithKey(fmt.Sprintf("key-%d", i)))]++
+	}
+	// expect roughly 1000 / 3000, allowing for the ring's variance
+	if counts[pool[0]] < 700 || counts[pool[0]] > 1300 {
+		t.Errorf("unexpected distribution: %d / %d", counts[pool[0]], counts[pool[1]])
+	}
+}
+
+func TestHashSelectionSkipsUnavailable(t *testing.T) {
+	pool := UpstreamPool{hashedUpstream(1, 1), hashedUpstream(2, 1), hashedUpstream(3, 1)}
+	h := &HashSelection{Key: "{l4.vars.key}"}
+
+	const keys = 300
+	before := make([]*Upstream, keys)
+	for i := range keys {
+		before[i] = h.Select(pool, connWithKey(fmt.Sprintf("key-%d", i)))
+	}
+
+	down := pool[0]
+	down.peers[0].setHealthy(false)
+	for i := range keys {
+		after := h.Select(pool, connWithKey(fmt.Sprintf("key-%d", i)))
+		if after == down {
+			t.Fatalf("key-%d: selected an unavailable upstream", i)
+		}
+		if before[i] != down && after != before[i] {
+			t.Fatalf("key-%d: moved from %v to %v", i, before[i], after)
+		}
+	}
+
+	pool[1].peers[0].setHealthy(false)
+	pool[2].peers[0].setHealthy(false)
+	if got := h.Select(pool, connWithKey("key")); got != nil {
+		t.Fatalf("expected nil when all upstreams are down, got %v", got)
+	}
+}
+
+func TestHashSelectionDefaultKey(t *testing.T) {
+	pool := UpstreamPool{hashedUpstream(1, 1), hashedUpstream(2, 1), hashedUpstream(3, 1)}
+	h := new(HashSelection)
+	if err := h.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+
+	// connections from the same host land on the same upstream regardless of their ports
+	first := h.Select(pool, connFromAddr("192.168.1.10:50000"))
+	for port := 50001; port < 50100; port++ {
+		if got := h.Select(pool, connFromAddr(fmt.Sprintf("192.168.1.10:%d", port))); got != first {
+			t.Fatalf("port %d: selected %v, want %v", port, got, first)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfileHash(t *testing.T) {
+	h := new(HashSelection)
+	if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser("hash {l4.tls.server_name}")); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if h.Key != "{l4.tls.server_name}" {
+		t.Errorf("Key = %q, want %q", h.Key, "{l4.tls.server_name}")
+	}
+
+	for _, input := range []string{"hash a b", "hash {\n\tkey a\n}"} {
+		if err := new(HashSelection).UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Fatalf("expected an error for %q, got nil", input)
+		}
+	}
+}
+
+func connWithKey(key string) *layer4.Connection {
+	cx := connFromAddr("192.168.1.10:50000")
+	cx.SetVar("key", key)
+	return cx
+}
+
+func connFromAddr(addr string) *layer4.Connection {
+	remote, _ := net.ResolveTCPAddr("tcp", addr)
+	return layer4.WrapConnection(&addrConn{remote: remote}, nil, zap.NewNop())
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 254), Port: 5432} }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
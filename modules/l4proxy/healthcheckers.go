@@ -0,0 +1,722 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/miekg/dns"
+)
+
+func init() {
+	caddy.RegisterModule(&DNSHealthChecker{})
+	caddy.RegisterModule(&HTTPHealthChecker{})
+	caddy.RegisterModule(&PostgresHealthChecker{})
+	caddy.RegisterModule(&SSHHealthChecker{})
+	caddy.RegisterModule(&TLSHealthChecker{})
+}
+
+// HealthChecker is a protocol-aware active health check. Its module name is
+// the reason reported in the logs and metrics when a peer fails the check.
+type HealthChecker interface {
+	// CheckHealth returns an error describing why the peer at host, connected
+	// to with conn over network, is unhealthy, or nil if it's healthy. The
+	// deadline of conn is set according to the active health checks timeout.
+	CheckHealth(conn net.Conn, network, host string) error
+}
+
+// healthCheckerName returns checker's module name, used as the reason of its failures.
+func healthCheckerName(checker HealthChecker) string {
+	if mod, ok := checker.(caddy.Module); ok {
+		return mod.CaddyModule().ID.Name()
+	}
+	return "checker"
+}
+
+// DNSHealthChecker checks that a peer answers DNS queries. Queries are sent
+// in single datagrams over packet networks, and prefixed with their length
+// over stream networks, including the ones secured with TLS.
+type DNSHealthChecker struct {
+	// The domain name to query. Default: `.`.
+	Name string `json:"name,omitempty"`
+
+	// The type of records to query. Default: `NS`.
+	Type string `json:"type,omitempty"`
+
+	// If true, a response must contain at least one answer record.
+	// Otherwise, any response with a NOERROR code is healthy.
+	ExpectAnswer bool `json:"expect_answer,omitempty"`
+
+	qtype uint16
+}
+
+// CaddyModule returns the Caddy module information.
+func (*DNSHealthChecker) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.health_checks.dns",
+		New: func() caddy.Module { return new(DNSHealthChecker) },
+	}
+}
+
+// Provision sets up c.
+func (c *DNSHealthChecker) Provision(_ caddy.Context) error {
+	if c.Name == "" {
+		c.Name = "."
+	}
+	if c.Type == "" {
+		c.Type = "NS"
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(c.Type)]
+	if !ok {
+		return fmt.Errorf("unknown record type: %s", c.Type)
+	}
+	c.qtype = qtype
+	return nil
+}
+
+// CheckHealth sends a query to the peer and validates the response.
+func (c *DNSHealthChecker) CheckHealth(conn net.Conn, network, _ string) error {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(c.Name), c.qtype)
+	msg, err := req.Pack()
+	if err != nil {
+		return fmt.Errorf("packing query: %v", err)
+	}
+
+	packet := isPacketNetwork(network)
+	if !packet {
+		msg = append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...) //nolint:gosec // disable G115
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return fmt.Errorf("sending query: %v", err)
+	}
+
+	var buf []byte
+	if packet {
+		buf = make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("receiving response: %v", err)
+		}
+		buf = buf[:n]
+	} else {
+		buf = make([]byte, 2)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("receiving response: %v", err)
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(buf))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("receiving response: %v", err)
+		}
+	}
+
+	resp := new(dns.Msg)
+	if err = resp.Unpack(buf); err != nil {
+		return fmt.Errorf("unpacking response: %v", err)
+	}
+	if !resp.Response || resp.Id != req.Id {
+		return fmt.Errorf("unexpected message with id %d", resp.Id)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("response code: %s", dns.RcodeToString[resp.Rcode])
+	}
+	if c.ExpectAnswer && len(resp.Answer) == 0 {
+		return fmt.Errorf("no %s records of %s", c.Type, req.Question[0].Name)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the DNSHealthChecker from Caddyfile tokens. Syntax:
+//
+//	dns {
+//		name <name>
+//		type <type>
+//		expect_answer
+//	}
+func (c *DNSHealthChecker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "name", "type":
+			field := map[string]*string{"name": &c.Name, "type": &c.Type}[optionName]
+			if *field != "" {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			*field = d.Val()
+		case "expect_answer":
+			if c.ExpectAnswer {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			c.ExpectAnswer = true
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// HTTPHealthChecker checks that a peer responds to an HTTP/1.1 request.
+// Combined with the TLS option of active health checks, it sends HTTPS requests.
+type HTTPHealthChecker struct {
+	// The request method. Default: `GET`.
+	Method string `json:"method,omitempty"`
+
+	// The request URI. Default: `/`.
+	URI string `json:"uri,omitempty"`
+
+	// The value of the Host header. Default: the peer's host.
+	Host string `json:"host,omitempty"`
+
+	// Additional request headers.
+	Headers http.Header `json:"headers,omitempty"`
+
+	// The expected status code, either a full one like 200, or a class like 2
+	// (i.e. 2xx). Default: any 2xx or 3xx status code.
+	ExpectStatus int `json:"expect_status,omitempty"`
+
+	// A regular expression the response body must match. Only the first 64KiB
+	// of the body are matched.
+	ExpectBody string `json:"expect_body,omitempty"`
+
+	bodyRegexp *regexp.Regexp
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HTTPHealthChecker) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.health_checks.http",
+		New: func() caddy.Module { return new(HTTPHealthChecker) },
+	}
+}
+
+// Provision sets up c.
+func (c *HTTPHealthChecker) Provision(_ caddy.Context) error {
+	if c.Method == "" {
+		c.Method = http.MethodGet
+	}
+	if c.URI == "" {
+		c.URI = "/"
+	}
+	if _, err := http.NewRequest(c.Method, c.URI, nil); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+	if c.ExpectStatus < 0 || c.ExpectStatus > 5 && c.ExpectStatus < 100 || c.ExpectStatus > 599 {
+		return fmt.Errorf("invalid expected status code: %d", c.ExpectStatus)
+	}
+	if c.ExpectBody != "" {
+		re, err := regexp.Compile(c.ExpectBody)
+		if err != nil {
+			return fmt.Errorf("expect_body: %v", err)
+		}
+		c.bodyRegexp = re
+	}
+	return nil
+}
+
+// CheckHealth sends a request to the peer and validates the response.
+func (c *HTTPHealthChecker) CheckHealth(conn net.Conn, _, host string) error {
+	req, err := http.NewRequest(c.Method, c.URI, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = c.Host
+	if req.Host == "" {
+		req.Host = host
+	}
+	if c.Headers != nil {
+		req.Header = c.Headers.Clone()
+	}
+	req.Close = true
+	if err = req.Write(conn); err != nil {
+		return fmt.Errorf("sending request: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("receiving response: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if c.ExpectStatus > 0 {
+		if !caddyhttp.StatusCodeMatches(resp.StatusCode, c.ExpectStatus) {
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status code out of tolerances: %d", resp.StatusCode)
+	}
+	if c.bodyRegexp != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, healthCheckMaxReceivedBytes))
+		if err != nil {
+			return fmt.Errorf("reading response body: %v", err)
+		}
+		if !c.bodyRegexp.Match(body) {
+			return fmt.Errorf("response body does not match %s", c.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the HTTPHealthChecker from Caddyfile tokens. Syntax:
+//
+//	http [<uri>] {
+//		method <method>
+//		host <host>
+//		header <field> <value>
+//		expect_status <code>
+//		expect_body <regexp>
+//	}
+func (c *HTTPHealthChecker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		c.URI = d.Val()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "method", "host", "expect_body":
+			field := map[string]*string{
+				"method":      &c.Method,
+				"host":        &c.Host,
+				"expect_body": &c.ExpectBody,
+			}[optionName]
+			if *field != "" {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			*field = d.Val()
+		case "header":
+			if d.CountRemainingArgs() != 2 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			field := d.Val()
+			d.NextArg()
+			if c.Headers == nil {
+				c.Headers = make(http.Header)
+			}
+			c.Headers.Add(field, d.Val())
+		case "expect_status":
+			if c.ExpectStatus != 0 {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			val, err := strconv.Atoi(strings.TrimSuffix(d.Val(), "xx"))
+			if err != nil || val <= 0 {
+				return d.Errf("parsing %s option '%s': invalid status code %s", wrapper, optionName, d.Val())
+			}
+			c.ExpectStatus = val
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// PostgresHealthChecker checks that a peer speaks the PostgreSQL protocol. By default,
+// it sends an SSLRequest, and a peer is healthy if it either accepts or refuses to use
+// TLS. If a user is set, it sends a startup message instead, and a peer is healthy if
+// it requests authentication or accepts the connection, i.e. doesn't reply with an
+// error, e.g. when the database system is starting up or doesn't accept connections.
+type PostgresHealthChecker struct {
+	// The user to connect as.
+	User string `json:"user,omitempty"`
+
+	// The database to connect to. Default: the same as the user.
+	Database string `json:"database,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*PostgresHealthChecker) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.health_checks.postgres",
+		New: func() caddy.Module { return new(PostgresHealthChecker) },
+	}
+}
+
+// Validate ensures that c's configuration is valid.
+func (c *PostgresHealthChecker) Validate() error {
+	if c.Database != "" && c.User == "" {
+		return fmt.Errorf("database requires a user")
+	}
+	return nil
+}
+
+// CheckHealth sends an SSLRequest or a startup message to the peer and validates the response.
+func (c *PostgresHealthChecker) CheckHealth(conn net.Conn, _, _ string) error {
+	if c.User == "" {
+		if _, err := conn.Write(binary.BigEndian.AppendUint32([]byte{0, 0, 0, 8}, postgresSSLRequestCode)); err != nil {
+			return fmt.Errorf("sending SSLRequest: %v", err)
+		}
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("receiving SSLRequest response: %v", err)
+		}
+		if buf[0] != 'S' && buf[0] != 'N' {
+			return fmt.Errorf("unexpected SSLRequest response: %q", buf[0])
+		}
+		return nil
+	}
+
+	params := []byte("user\x00" + c.User + "\x00")
+	if c.Database != "" {
+		params = append(params, "database\x00"+c.Database+"\x00"...)
+	}
+	params = append(params, 0)
+	msg := binary.BigEndian.AppendUint32(nil, uint32(8+len(params))) //nolint:gosec // disable G115
+	msg = binary.BigEndian.AppendUint32(msg, postgresProtocolVersion)
+	if _, err := conn.Write(append(msg, params...)); err != nil {
+		return fmt.Errorf("sending startup message: %v", err)
+	}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("receiving startup response: %v", err)
+	}
+	switch header[0] {
+	case 'R':
+		return nil
+	case 'E':
+		length := binary.BigEndian.Uint32(header[1:])
+		if length < 4 || length > healthCheckMaxReceivedBytes {
+			return fmt.Errorf("invalid error response length: %d", length)
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return fmt.Errorf("receiving error response: %v", err)
+		}
+		return fmt.Errorf("error response: %s", postgresErrorMessage(body))
+	default:
+		return fmt.Errorf("unexpected startup response: %q", header[0])
+	}
+}
+
+// UnmarshalCaddyfile sets up the PostgresHealthChecker from Caddyfile tokens. Syntax:
+//
+//	postgres [<user> [<database>]]
+func (c *PostgresHealthChecker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only two same-line options are supported
+	if d.CountRemainingArgs() > 2 {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		c.User = d.Val()
+	}
+	if d.NextArg() {
+		c.Database = d.Val()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s health check: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// postgresErrorMessage returns the severity, code and message fields of a PostgreSQL
+// error response body, which consists of null-terminated fields prefixed with their type.
+func postgresErrorMessage(body []byte) string {
+	var severity, code, message string
+	for len(body) > 1 {
+		end := bytes.IndexByte(body, 0)
+		if end < 1 {
+			break
+		}
+		switch body[0] {
+		case 'S':
+			severity = string(body[1:end])
+		case 'C':
+			code = string(body[1:end])
+		case 'M':
+			message = string(body[1:end])
+		}
+		body = body[end+1:]
+	}
+	return fmt.Sprintf("%s %s %s", severity, code, message)
+}
+
+const (
+	// postgresSSLRequestCode is the version number sent in an SSLRequest.
+	postgresSSLRequestCode = 80877103
+	// postgresProtocolVersion is the version number of the protocol 3.0.
+	postgresProtocolVersion = 196608
+)
+
+// SSHHealthChecker checks that a peer sends an SSH identification string
+// of the protocol version 2.0, or 1.99 (i.e. compatible with 2.0).
+type SSHHealthChecker struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*SSHHealthChecker) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.health_checks.ssh",
+		New: func() caddy.Module { return new(SSHHealthChecker) },
+	}
+}
+
+// CheckHealth receives the peer's identification string and validates its version.
+// Other lines may precede the identification string, as allowed by RFC 4253.
+func (*SSHHealthChecker) CheckHealth(conn net.Conn, _, _ string) error {
+	r := bufio.NewReaderSize(io.LimitReader(conn, healthCheckMaxReceivedBytes), sshIdentificationMaxLength)
+	for {
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return fmt.Errorf("line longer than %d bytes", sshIdentificationMaxLength)
+		}
+		if err != nil {
+			return fmt.Errorf("receiving identification: %v", err)
+		}
+		if !bytes.HasPrefix(line, []byte("SSH-")) {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("SSH-2.0-")) || bytes.HasPrefix(line, []byte("SSH-1.99-")) {
+			return nil
+		}
+		return fmt.Errorf("unsupported identification: %q", bytes.TrimRight(line, "\r\n"))
+	}
+}
+
+// UnmarshalCaddyfile sets up the SSHHealthChecker from Caddyfile tokens. Syntax:
+//
+//	ssh
+func (c *SSHHealthChecker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s health check: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// sshIdentificationMaxLength is the maximum length of an identification string,
+// including the trailing CR LF, according to RFC 4253.
+const sshIdentificationMaxLength = 255
+
+// TLSHealthChecker checks that a peer completes a TLS handshake, and that
+// its certificate is valid and isn't going to expire soon. If the TLS option
+// of active health checks is enabled, it validates the certificate received
+// in that handshake instead, and ignores its own server name and verification
+// options.
+type TLSHealthChecker struct {
+	// The server name to send in the handshake and to verify the certificate
+	// against. Default: the peer's host.
+	ServerName string `json:"server_name,omitempty"`
+
+	// If true, the certificate chain and the server name aren't verified,
+	// e.g. for self-signed certificates. The validity period still is.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// How long the certificate must remain valid for, e.g. 168h to get
+	// a peer marked unhealthy a week before its certificate expires.
+	MinValidity caddy.Duration `json:"min_validity,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (*TLSHealthChecker) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.health_checks.tls",
+		New: func() caddy.Module { return new(TLSHealthChecker) },
+	}
+}
+
+// Validate ensures that c's configuration is valid.
+func (c *TLSHealthChecker) Validate() error {
+	if c.MinValidity < 0 {
+		return fmt.Errorf("invalid min validity: %s", time.Duration(c.MinValidity))
+	}
+	return nil
+}
+
+// CheckHealth performs a TLS handshake with the peer, unless it has already
+// been performed, and validates the peer's certificate.
+func (c *TLSHealthChecker) CheckHealth(conn net.Conn, _, host string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		tlsCfg := &tls.Config{
+			ServerName:         c.ServerName,
+			InsecureSkipVerify: c.InsecureSkipVerify, //nolint:gosec // configured by the user
+		}
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = host
+		}
+		tlsConn = tls.Client(conn, tlsCfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake: %v", err)
+		}
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no peer certificate")
+	}
+	now := time.Now()
+	if now.Before(certs[0].NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", certs[0].NotBefore.Format(time.RFC3339))
+	}
+	if now.After(certs[0].NotAfter) {
+		return fmt.Errorf("certificate expired at %s", certs[0].NotAfter.Format(time.RFC3339))
+	}
+	if certs[0].NotAfter.Sub(now) < time.Duration(c.MinValidity) {
+		return fmt.Errorf("certificate expires at %s, in less than %s",
+			certs[0].NotAfter.Format(time.RFC3339), time.Duration(c.MinValidity))
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the TLSHealthChecker from Caddyfile tokens. Syntax:
+//
+//	tls {
+//		server_name <name>
+//		insecure_skip_verify
+//		min_validity <duration>
+//	}
+func (c *TLSHealthChecker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		optionName := d.Val()
+		switch optionName {
+		case "server_name":
+			if c.ServerName != "" {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			c.ServerName = d.Val()
+		case "insecure_skip_verify":
+			if c.InsecureSkipVerify {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() > 0 {
+				return d.ArgErr()
+			}
+			c.InsecureSkipVerify = true
+		case "min_validity":
+			if c.MinValidity != 0 {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return d.Errf("parsing %s option '%s': invalid duration %s", wrapper, optionName, d.Val())
+			}
+			c.MinValidity = caddy.Duration(dur)
+		default:
+			return d.ArgErr()
+		}
+
+		// No nested blocks are supported
+		if d.NextBlock(nesting + 1) {
+			return d.Errf("malformed %s option '%s': blocks are not supported", wrapper, optionName)
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ HealthChecker = (*DNSHealthChecker)(nil)
+	_ HealthChecker = (*HTTPHealthChecker)(nil)
+	_ HealthChecker = (*PostgresHealthChecker)(nil)
+	_ HealthChecker = (*SSHHealthChecker)(nil)
+	_ HealthChecker = (*TLSHealthChecker)(nil)
+
+	_ caddy.Provisioner = (*DNSHealthChecker)(nil)
+	_ caddy.Provisioner = (*HTTPHealthChecker)(nil)
+
+	_ caddy.Validator = (*PostgresHealthChecker)(nil)
+	_ caddy.Validator = (*TLSHealthChecker)(nil)
+
+	_ caddyfile.Unmarshaler = (*DNSHealthChecker)(nil)
+	_ caddyfile.Unmarshaler = (*HTTPHealthChecker)(nil)
+	_ caddyfile.Unmarshaler = (*PostgresHealthChecker)(nil)
+	_ caddyfile.Unmarshaler = (*SSHHealthChecker)(nil)
+	_ caddyfile.Unmarshaler = (*TLSHealthChecker)(nil)
+)
@@ -0,0 +1,371 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// runHealthCheckers provisions checkers, and performs one active health check of the peer at addr with a and them.
+func runHealthCheckers(t *testing.T, a *ActiveHealthChecks, addr string, up *Upstream, checkers ...HealthChecker) bool {
+	t.Helper()
+	for _, checker := range checkers {
+		if prov, ok := checker.(caddy.Provisioner); ok {
+			if err := prov.Provision(caddy.Context{}); err != nil {
+				t.Fatalf("provisioning %s checker: %v", healthCheckerName(checker), err)
+			}
+		}
+		if val, ok := checker.(caddy.Validator); ok {
+			if err := val.Validate(); err != nil {
+				t.Fatalf("validating %s checker: %v", healthCheckerName(checker), err)
+			}
+		}
+	}
+	if a == nil {
+		a = new(ActiveHealthChecks)
+	}
+	a.checkers = checkers
+	return runHealthCheck(t, a, addr, up)
+}
+
+// dnsReply answers A queries for example.com, and NS queries for any name.
+func dnsReply(b []byte) []byte {
+	req := new(dns.Msg)
+	if err := req.Unpack(b); err != nil || len(req.Question) != 1 {
+		return nil
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	q := req.Question[0]
+	switch {
+	case q.Name == "example.com." && q.Qtype == dns.TypeA:
+		rr, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+		resp.Answer = append(resp.Answer, rr)
+	case q.Qtype == dns.TypeNS:
+	default:
+		resp.Rcode = dns.RcodeNameError
+	}
+	out, _ := resp.Pack()
+	return out
+}
+
+func TestDNSHealthChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	serveHealthCheck(t, ln, func(c net.Conn) {
+		var length uint16
+		if binary.Read(c, binary.BigEndian, &length) != nil {
+			return
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		out := dnsReply(b)
+		_, _ = c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+	})
+	udpAddr := serveUDPHealthCheck(t, func(b []byte) [][]byte { return [][]byte{dnsReply(b)} })
+
+	for _, addr := range []string{ln.Addr().String(), "udp/" + udpAddr} {
+		if !runHealthCheckers(t, nil, addr, nil, &DNSHealthChecker{}) {
+			t.Errorf("%s: expected a root NS query to pass", addr)
+		}
+		if !runHealthCheckers(t, nil, addr, nil, &DNSHealthChecker{Name: "example.com", Type: "a", ExpectAnswer: true}) {
+			t.Errorf("%s: expected an answered query to pass", addr)
+		}
+		if runHealthCheckers(t, nil, addr, nil, &DNSHealthChecker{Name: "example.net", Type: "A"}) {
+			t.Errorf("%s: expected an NXDOMAIN response to fail", addr)
+		}
+		if runHealthCheckers(t, nil, addr, nil, &DNSHealthChecker{Name: "example.net", ExpectAnswer: true}) {
+			t.Errorf("%s: expected a response without answers to fail", addr)
+		}
+	}
+
+	if err := (&DNSHealthChecker{Type: "BOGUS"}).Provision(caddy.Context{}); err == nil {
+		t.Error("expected an unknown record type to fail provisioning")
+	}
+}
+
+func TestHTTPHealthChecker(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			if r.Host != "backend.local" || r.Header.Get("X-Probe") != "1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = io.WriteString(w, `{"status":"ok"}`)
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	healthz := func() *HTTPHealthChecker {
+		return &HTTPHealthChecker{
+			URI:     "/healthz",
+			Host:    "backend.local",
+			Headers: http.Header{"X-Probe": []string{"1"}},
+		}
+	}
+	if !runHealthCheckers(t, nil, addr, nil, healthz()) {
+		t.Error("expected a 200 response to pass")
+	}
+	c := healthz()
+	c.ExpectBody = `"status":"ok"`
+	if !runHealthCheckers(t, nil, addr, nil, c) {
+		t.Error("expected a matching body to pass")
+	}
+	c = healthz()
+	c.ExpectBody = `"status":"down"`
+	if runHealthCheckers(t, nil, addr, nil, c) {
+		t.Error("expected a body mismatch to fail")
+	}
+	if runHealthCheckers(t, nil, addr, nil, &HTTPHealthChecker{URI: "/healthz"}) {
+		t.Error("expected a 400 response to fail")
+	}
+	if runHealthCheckers(t, nil, addr, nil, &HTTPHealthChecker{}) {
+		t.Error("expected a 503 response to fail")
+	}
+	if !runHealthCheckers(t, nil, addr, nil, &HTTPHealthChecker{URI: "/empty", ExpectStatus: 204}) {
+		t.Error("expected an expected status code to pass")
+	}
+	if runHealthCheckers(t, nil, addr, nil, &HTTPHealthChecker{URI: "/empty", ExpectStatus: 200}) {
+		t.Error("expected an unexpected status code to fail")
+	}
+
+	if err := (&HTTPHealthChecker{ExpectStatus: 9}).Provision(caddy.Context{}); err == nil {
+		t.Error("expected an invalid status class to fail provisioning")
+	}
+
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	up := &Upstream{tlsConfig: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec // test server certificate
+	if !runHealthCheckers(t, &ActiveHealthChecks{TLS: true}, strings.TrimPrefix(tlsSrv.URL, "https://"), up,
+		&HTTPHealthChecker{URI: "/empty", ExpectStatus: 2}) {
+		t.Error("expected an HTTPS request to pass")
+	}
+}
+
+// postgresLike replies to SSLRequests with N, and to startup messages with an authentication
+// request, unless the user is "starting", which gets an error like a database system starting up.
+func postgresLike(c net.Conn) {
+	var length, code uint32
+	if binary.Read(c, binary.BigEndian, &length) != nil || binary.Read(c, binary.BigEndian, &code) != nil || length < 8 {
+		return
+	}
+	if code == postgresSSLRequestCode {
+		_, _ = c.Write([]byte{'N'})
+		return
+	}
+	params := make([]byte, length-8)
+	if _, err := io.ReadFull(c, params); err != nil {
+		return
+	}
+	if strings.HasPrefix(string(params), "user\x00starting\x00") {
+		fields := "SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00"
+		_, _ = c.Write(append(binary.BigEndian.AppendUint32([]byte{'E'}, uint32(4+len(fields))), fields...))
+		return
+	}
+	// AuthenticationMD5Password with a salt
+	_, _ = c.Write([]byte{'R', 0, 0, 0, 12, 0, 0, 0, 5, 1, 2, 3, 4})
+}
+
+func TestPostgresHealthChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	serveHealthCheck(t, ln, postgresLike)
+	addr := ln.Addr().String()
+
+	if !runHealthCheckers(t, nil, addr, nil, &PostgresHealthChecker{}) {
+		t.Error("expected an SSLRequest to pass")
+	}
+	if !runHealthCheckers(t, nil, addr, nil, &PostgresHealthChecker{User: "healthcheck", Database: "postgres"}) {
+		t.Error("expected an authentication request to pass")
+	}
+	if runHealthCheckers(t, nil, addr, nil, &PostgresHealthChecker{User: "starting"}) {
+		t.Error("expected an error response to fail")
+	}
+
+	if msg := postgresErrorMessage([]byte("SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00")); msg != "FATAL 57P03 the database system is starting up" {
+		t.Errorf("postgresErrorMessage = %q", msg)
+	}
+	if err := (&PostgresHealthChecker{Database: "postgres"}).Validate(); err == nil {
+		t.Error("expected a database without a user to fail validation")
+	}
+}
+
+func TestSSHHealthChecker(t *testing.T) {
+	for banner, want := range map[string]bool{
+		"SSH-2.0-OpenSSH_9.6\r\n":                      true,
+		"pre-banner notice\r\nSSH-1.99-Legacy_1.0\r\n": true,
+		"SSH-1.5-Ancient\r\n":                          false,
+		strings.Repeat("x", 300) + "\r\n":              false,
+		"HTTP/1.1 400 Bad Request\r\n":                 false,
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		serveHealthCheck(t, ln, func(c net.Conn) { _, _ = io.WriteString(c, banner) })
+		if got := runHealthCheckers(t, nil, ln.Addr().String(), nil, &SSHHealthChecker{}); got != want {
+			t.Errorf("banner %q: healthy = %t, want %t", banner, got, want)
+		}
+	}
+}
+
+func TestTLSHealthChecker(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	notAfter := srv.Certificate().NotAfter
+
+	if runHealthCheckers(t, nil, addr, nil, &TLSHealthChecker{}) {
+		t.Error("expected an untrusted certificate to fail")
+	}
+	if !runHealthCheckers(t, nil, addr, nil, &TLSHealthChecker{InsecureSkipVerify: true}) {
+		t.Error("expected a valid certificate to pass without verification")
+	}
+	if !runHealthCheckers(t, nil, addr, nil, &TLSHealthChecker{InsecureSkipVerify: true, MinValidity: caddy.Duration(time.Hour)}) {
+		t.Error("expected a long-lived certificate to pass")
+	}
+	if runHealthCheckers(t, nil, addr, nil, &TLSHealthChecker{
+		InsecureSkipVerify: true,
+		MinValidity:        caddy.Duration(time.Until(notAfter) + time.Hour),
+	}) {
+		t.Error("expected a certificate expiring sooner than the min validity to fail")
+	}
+
+	// the certificate of the handshake performed by active health checks is validated
+	up := &Upstream{tlsConfig: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec // test server certificate
+	if runHealthCheckers(t, &ActiveHealthChecks{TLS: true}, addr, up,
+		&TLSHealthChecker{MinValidity: caddy.Duration(time.Until(notAfter) + time.Hour)}) {
+		t.Error("expected the certificate of the TLS option handshake to be validated")
+	}
+}
+
+func TestActiveHealthCheckReason(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	serveHealthCheck(t, ln, func(c net.Conn) { _, _ = io.WriteString(c, "+OK ready\r\n") })
+
+	parsed, err := caddy.ParseNetworkAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("parsing address: %v", err)
+	}
+	p := &peer{address: &parsed, dialAddr: ln.Addr().String()}
+	a := &ActiveHealthChecks{
+		Timeout: caddy.Duration(time.Second),
+		Steps:   []*HealthCheckStep{{Expect: "+OK"}},
+		logger:  zap.NewNop(),
+	}
+	if err := a.provision(nil); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	h := &Handler{metrics: newProxyMetrics(prometheus.NewRegistry()), HealthChecks: &HealthChecks{Active: a}}
+	up := &Upstream{peers: []*peer{p}}
+
+	a.checkers = []HealthChecker{&SSHHealthChecker{}}
+	if err := h.doActiveHealthCheck(up, p); err != nil {
+		t.Fatalf("health check: %v", err)
+	}
+	if got := testutil.ToFloat64(h.metrics.upstreamReason.WithLabelValues(p.dialAddr, "ssh")); got != 1 || p.healthy() {
+		t.Errorf("upstream_unhealthy_reason{reason=ssh} = %v, healthy = %t, want 1, false", got, p.healthy())
+	}
+
+	a.Steps[0].Expect = "+PONG"
+	if err := a.provision(nil); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if err := h.doActiveHealthCheck(up, p); err != nil {
+		t.Fatalf("health check: %v", err)
+	}
+	if got := testutil.ToFloat64(h.metrics.upstreamReason.WithLabelValues(p.dialAddr, "steps")); got != 1 {
+		t.Errorf("upstream_unhealthy_reason{reason=steps} = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(h.metrics.upstreamReason); got != 1 {
+		t.Errorf("upstream_unhealthy_reason series = %d, want 1", got)
+	}
+}
+
+func TestUnmarshalCaddyfileHealthCheckers(t *testing.T) {
+	d := caddyfile.NewTestDispenser("proxy localhost:5432 {\n" +
+		"\thealth_check postgres healthcheck postgres\n" +
+		"\thealth_check tls {\n" +
+		"\t\tmin_validity 168h\n" +
+		"\t}\n" +
+		"\thealth_check ssh\n" +
+		"}")
+	h := new(Handler)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	a := h.HealthChecks.Active
+	want := []string{
+		`{"checker":"postgres","database":"postgres","user":"healthcheck"}`,
+		`{"checker":"tls","min_validity":604800000000000}`,
+		`{"checker":"ssh"}`,
+	}
+	if len(a.CheckersRaw) != len(want) {
+		t.Fatalf("checkers = %d, want %d", len(a.CheckersRaw), len(want))
+	}
+	for i, raw := range a.CheckersRaw {
+		if string(raw) != want[i] {
+			t.Errorf("checker %d = %s, want %s", i, raw, want[i])
+		}
+	}
+
+	cases := map[string]string{
+		"missing name":       "proxy localhost:1 {\n\thealth_check\n}",
+		"unknown checker":    "proxy localhost:1 {\n\thealth_check bogus\n}",
+		"ssh arguments":      "proxy localhost:1 {\n\thealth_check ssh 2.0\n}",
+		"duplicate dns type": "proxy localhost:1 {\n\thealth_check dns {\n\t\ttype A\n\t\ttype NS\n\t}\n}",
+		"bad http status":    "proxy localhost:1 {\n\thealth_check http {\n\t\texpect_status ok\n\t}\n}",
+		"bad tls validity":   "proxy localhost:1 {\n\thealth_check tls {\n\t\tmin_validity soon\n\t}\n}",
+	}
+	for name, input := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := new(Handler)
+			if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+				t.Fatalf("expected an error for %q, got nil", name)
+			}
+		})
+	}
+}
@@ -15,14 +15,24 @@
 package l4proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/pires/go-proxyproto"
 	"go.uber.org/zap"
 )
 
@@ -51,7 +61,9 @@ type ActiveHealthChecks struct {
 	Interval caddy.Duration `json:"interval,omitempty"`
 
 	// How long to wait for a connection to be established with
-	// peer before considering it unhealthy (default 5s).
+	// peer before considering it unhealthy (default 5s). It also
+	// limits the TLS handshake, each of the steps and each of the
+	// checkers, if any.
 	Timeout caddy.Duration `json:"timeout,omitempty"`
 
 	// CloseIfUnhealthy, when true, force-closes a peer's currently open proxied
@@ -76,9 +88,320 @@ type ActiveHealthChecks struct {
 	// required to mark an unhealthy upstream healthy again (default 1).
 	Rise int `json:"rise,omitempty"`
 
+	// Steps is a sequence of payloads to send and responses to expect once
+	// a connection to the peer is established, e.g. `PING\r\n` and `+PONG`
+	// for Redis. A peer is healthy only if all the steps succeed. By default,
+	// establishing a connection is enough.
+	Steps []*HealthCheckStep `json:"steps,omitempty"`
+
+	// If true, a TLS handshake is performed before the steps, using
+	// the upstream's TLS config, if any, or the default one otherwise.
+	TLS bool `json:"tls,omitempty"`
+
+	// Specifies the version of the Proxy Protocol header to send before
+	// the TLS handshake and the steps, either "v1" or "v2".
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
+	// Checkers are protocol-aware health checks, e.g. a DNS query or an HTTP
+	// request, performed after the steps, each over a connection of its own
+	// (preceded by the Proxy Protocol header and the TLS handshake, if enabled).
+	// A peer is healthy only if all of them pass.
+	CheckersRaw []json.RawMessage `json:"checkers,omitempty" caddy:"namespace=layer4.proxy.health_checks inline_key=checker"`
+
+	proxyProtocolVersion uint8
+	checkers             []HealthChecker
+
 	logger *zap.Logger
 }
 
+// provision validates a's steps and Proxy Protocol version, and their compatibility with upstreams.
+func (a *ActiveHealthChecks) provision(upstreams UpstreamPool) error {
+	switch a.ProxyProtocol {
+	case "":
+	case "v1":
+		a.proxyProtocolVersion = 1
+	case "v2":
+		a.proxyProtocolVersion = 2
+	default:
+		return fmt.Errorf("proxy_protocol: \"%s\" should be empty, or one of \"v1\" \"v2\"", a.ProxyProtocol)
+	}
+	// checkers are expected to wait for replies
+	expects := len(a.checkers) > 0
+	for i, step := range a.Steps {
+		if err := step.provision(); err != nil {
+			return fmt.Errorf("step %d: %v", i, err)
+		}
+		expects = expects || step.payload == nil
+	}
+
+	for _, upstream := range upstreams {
+		for _, p := range upstream.peers {
+			if p.address == nil || !isPacketNetwork(p.address.Network) {
+				continue
+			}
+			if a.TLS {
+				return fmt.Errorf("tls: not supported for packet upstream %s", p.dialAddr)
+			}
+			// UDP dials never fail, so a reply must be required to tell anything about the peer
+			if !expects && a.logger != nil {
+				a.logger.Warn("active health checks of packet upstreams always pass without expecting a reply",
+					zap.String("peer", p.dialAddr))
+			}
+		}
+	}
+	return nil
+}
+
+// prepare sends a's Proxy Protocol header and performs a's TLS handshake on conn established
+// to upstream at host, and returns the connection to run the steps and checkers on. For packet
+// networks, the Proxy Protocol header is prepended to each datagram sent.
+func (a *ActiveHealthChecks) prepare(conn net.Conn, upstream *Upstream, network, host string) (net.Conn, error) {
+	if a.proxyProtocolVersion > 0 {
+		header := proxyproto.HeaderProxyFromAddrs(a.proxyProtocolVersion, conn.LocalAddr(), conn.RemoteAddr())
+		if header != nil {
+			header.Command = proxyproto.PROXY
+			if isPacketNetwork(network) {
+				conn = &packetProxyProtocolConn{Conn: conn, header: header}
+			} else {
+				if err := conn.SetDeadline(time.Now().Add(time.Duration(a.Timeout))); err != nil {
+					return nil, err
+				}
+				if _, err := header.WriteTo(conn); err != nil {
+					return nil, fmt.Errorf("sending proxy protocol header: %v", err)
+				}
+			}
+		}
+	}
+
+	if a.TLS {
+		// The prepared config could be nil, if the user enabled but did not customize TLS
+		var tlsCfg *tls.Config
+		if upstream.tlsConfig != nil {
+			tlsCfg = upstream.tlsConfig.Clone()
+		} else {
+			tlsCfg = new(tls.Config)
+		}
+		// Placeholders of the downstream connections can't be expanded here
+		tlsCfg.ServerName = caddy.NewReplacer().ReplaceAll(tlsCfg.ServerName, "")
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tlsCfg)
+		if err := conn.SetDeadline(time.Now().Add(time.Duration(a.Timeout))); err != nil {
+			return nil, err
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("TLS handshake: %v", err)
+		}
+		conn = tlsConn
+	}
+
+	return conn, nil
+}
+
+// check prepares conn established to upstream at host, runs either a's steps or checker on it,
+// and closes it. If the check fails, the reason is returned along with the error: either
+// healthReasonConnect, healthReasonSteps, or the checker's name.
+func (a *ActiveHealthChecks) check(conn net.Conn, upstream *Upstream, network, host string, checker HealthChecker) (string, error) {
+	defer func() { _ = conn.Close() }()
+
+	prepared, err := a.prepare(conn, upstream, network, host)
+	if err != nil {
+		return healthReasonConnect, err
+	}
+	if checker == nil {
+		if err = a.runSteps(prepared, network); err != nil {
+			return healthReasonSteps, err
+		}
+		return "", nil
+	}
+	if err = prepared.SetDeadline(time.Now().Add(time.Duration(a.Timeout))); err != nil {
+		return healthReasonConnect, err
+	}
+	if err = checker.CheckHealth(prepared, network, host); err != nil {
+		return healthCheckerName(checker), err
+	}
+	return "", nil
+}
+
+// runSteps performs a's steps on conn prepared for network. For packet networks, each
+// payload is sent in a datagram, and each expectation must be met by a single datagram.
+// Reading errors, e.g. caused by ICMP port unreachable messages, fail the check.
+func (a *ActiveHealthChecks) runSteps(conn net.Conn, network string) error {
+	packet := isPacketNetwork(network)
+
+	var received []byte
+	buf := make([]byte, 4096)
+	if packet {
+		// datagrams mustn't be truncated
+		buf = make([]byte, healthCheckMaxReceivedBytes)
+	}
+	for i, step := range a.Steps {
+		timeout := time.Duration(step.Timeout)
+		if timeout == 0 {
+			timeout = time.Duration(a.Timeout)
+		}
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+
+		if step.payload != nil {
+			if _, err := conn.Write(step.payload); err != nil {
+				return fmt.Errorf("step %d: sending: %v", i, err)
+			}
+			continue
+		}
+
+		for {
+			if end := step.match(received); end >= 0 {
+				// the next steps only see the data after the match,
+				// unless it's a datagram which is matched as a whole
+				if packet {
+					received = nil
+				} else {
+					received = received[end:]
+				}
+				break
+			}
+			if packet {
+				received = received[:0]
+			} else if len(received) >= healthCheckMaxReceivedBytes {
+				return fmt.Errorf("step %d: expectation not met in %d received bytes", i, len(received))
+			}
+			n, err := conn.Read(buf)
+			received = append(received, buf[:n]...)
+			// the data received along with an error is matched before returning the error
+			if err != nil && n == 0 {
+				return fmt.Errorf("step %d: expecting: %v", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// HealthCheckStep is a step of active health checks: either a payload
+// to send, or a response to expect. Exactly one of the fields, except
+// the timeout, must be set.
+type HealthCheckStep struct {
+	// Text to send. Go escape sequences, e.g. `\r\n` or `\x00`, are interpreted.
+	Send string `json:"send,omitempty"`
+	// Hex-encoded bytes to send.
+	SendHex string `json:"send_hex,omitempty"`
+	// Path of a file whose contents to send.
+	SendFile string `json:"send_file,omitempty"`
+
+	// Text the received data must contain. Go escape sequences, e.g. `\r\n` or `\x00`, are interpreted.
+	Expect string `json:"expect,omitempty"`
+	// Hex-encoded bytes the received data must contain.
+	ExpectHex string `json:"expect_hex,omitempty"`
+	// Regular expression the received data must match. At least one byte
+	// must be received, even if it can match an empty string.
+	ExpectRegexp string `json:"expect_regexp,omitempty"`
+	// If true, any received data meets the expectation, e.g. a reply datagram of any content.
+	ExpectAny bool `json:"expect_any,omitempty"`
+
+	// How long to wait for the step to complete. Default: the active health check timeout.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+
+	payload []byte
+	literal []byte
+	regexp  *regexp.Regexp
+}
+
+// provision validates s and prepares its payload or expectation.
+func (s *HealthCheckStep) provision() error {
+	var set int
+	for _, field := range []string{s.Send, s.SendHex, s.SendFile, s.Expect, s.ExpectHex, s.ExpectRegexp} {
+		if field != "" {
+			set++
+		}
+	}
+	if s.ExpectAny {
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of send, send_hex, send_file, expect, expect_hex, expect_regexp or expect_any must be set")
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", time.Duration(s.Timeout))
+	}
+
+	var err error
+	switch {
+	case s.Send != "":
+		s.payload, err = unescapeText(s.Send)
+	case s.SendHex != "":
+		s.payload, err = hex.DecodeString(s.SendHex)
+	case s.SendFile != "":
+		s.payload, err = os.ReadFile(s.SendFile)
+		if err == nil && len(s.payload) == 0 {
+			err = fmt.Errorf("file %s is empty", s.SendFile)
+		}
+	case s.Expect != "":
+		s.literal, err = unescapeText(s.Expect)
+	case s.ExpectHex != "":
+		s.literal, err = hex.DecodeString(s.ExpectHex)
+	case s.ExpectRegexp != "":
+		s.regexp, err = regexp.Compile(s.ExpectRegexp)
+	}
+	return err
+}
+
+// match returns the end of the first match of s's expectation in data, or -1 if there is none.
+// No data never meets an expectation, even a regular expression matching an empty string.
+func (s *HealthCheckStep) match(data []byte) int {
+	if len(data) == 0 {
+		return -1
+	}
+	if s.ExpectAny {
+		return len(data)
+	}
+	if s.regexp != nil {
+		if loc := s.regexp.FindIndex(data); loc != nil {
+			return loc[1]
+		}
+		return -1
+	}
+	if i := bytes.Index(data, s.literal); i >= 0 {
+		return i + len(s.literal)
+	}
+	return -1
+}
+
+// unescapeText interprets Go escape sequences in s.
+func unescapeText(s string) ([]byte, error) {
+	var b []byte
+	for len(s) > 0 {
+		value, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		if multibyte {
+			b = utf8.AppendRune(b, value)
+		} else {
+			b = append(b, byte(value))
+		}
+		s = tail
+	}
+	return b, nil
+}
+
+// isPacketNetwork returns true if network is a UDP or unixgram network.
+func isPacketNetwork(network string) bool {
+	return strings.HasPrefix(network, "udp") || network == "unixgram"
+}
+
+// healthCheckMaxReceivedBytes limits how much data active health checks may
+// receive from a peer while waiting for an expected response.
+const healthCheckMaxReceivedBytes = 64 * 1024
+
+// Reasons of failed active health checks, other than the names of the failed checkers.
+const (
+	healthReasonConnect = "connect"
+	healthReasonSteps   = "steps"
+)
+
 // PassiveHealthChecks holds configuration related to passive
 // health checks (that is, health checks which occur during
 // the normal flow of connection proxying).
@@ -183,16 +506,17 @@ func (h *Handler) doActiveHealthCheck(upstream *Upstream, p *peer) error {
 	dialNetwork := narrowNetworkForFamily(addr.Network, destFam)
 	localAddrs := buildLocalAddrs(upstream.localAddrs, dialNetwork, destFam, h.logger)
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+	dial := func() (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
 
-	var conn net.Conn
-	var err error
-	if len(localAddrs) == 0 {
-		var d net.Dialer
-		d.Timeout = timeout
-		conn, err = d.DialContext(ctx, dialNetwork, hostPort)
-	} else {
+		if len(localAddrs) == 0 {
+			var d net.Dialer
+			d.Timeout = timeout
+			return d.DialContext(ctx, dialNetwork, hostPort)
+		}
+		var conn net.Conn
+		var err error
 		for _, la := range localAddrs {
 			d := &net.Dialer{LocalAddr: la, Timeout: timeout}
 			conn, err = d.DialContext(ctx, dialNetwork, hostPort)
@@ -200,12 +524,34 @@ func (h *Handler) doActiveHealthCheck(upstream *Upstream, p *peer) error {
 				break
 			}
 		}
+		return conn, err
+	}
+
+	// the steps run on the first connection, and each checker on a connection of its own
+	var reason string
+	conn, err := dial()
+	if err != nil {
+		reason = healthReasonConnect
+	} else {
+		reason, err = h.HealthChecks.Active.check(conn, upstream, dialNetwork, addr.Host, nil)
+	}
+	for _, checker := range h.HealthChecks.Active.checkers {
+		if err != nil {
+			break
+		}
+		conn, err = dial()
+		if err != nil {
+			reason = healthCheckerName(checker)
+			break
+		}
+		reason, err = h.HealthChecks.Active.check(conn, upstream, dialNetwork, addr.Host, checker)
 	}
 	rise, fall := h.HealthChecks.Active.Rise, h.HealthChecks.Active.Fall
 	if err != nil {
 		h.HealthChecks.Active.logger.Info("active health check failed",
 			zap.String("address", addr.String()),
 			zap.Duration("timeout", timeout),
+			zap.String("reason", reason),
 			zap.Error(err))
 		if mark, healthy := p.recordActiveCheck(false, rise, fall); mark {
 			swapped, err2 := p.setHealthy(healthy)
@@ -219,12 +565,11 @@ func (h *Handler) doActiveHealthCheck(upstream *Upstream, p *peer) error {
 				p.closeOpenConns()
 			}
 		}
-		h.metrics.setUpstreamHealthy(p.dialAddr, false)
+		h.metrics.setUpstreamHealthy(p.dialAddr, false, reason)
 		return nil
 	}
-	_ = conn.Close()
 
-	// connection succeeded
+	// connection, steps and checkers succeeded
 	if mark, healthy := p.recordActiveCheck(true, rise, fall); mark {
 		swapped, err := p.setHealthy(healthy)
 		if err != nil {
@@ -234,7 +579,7 @@ func (h *Handler) doActiveHealthCheck(upstream *Upstream, p *peer) error {
 			h.HealthChecks.Active.logger.Info("host is up", zap.String("address", addr.String()))
 		}
 	}
-	h.metrics.setUpstreamHealthy(p.dialAddr, true)
+	h.metrics.setUpstreamHealthy(p.dialAddr, true, "")
 
 	return nil
 }
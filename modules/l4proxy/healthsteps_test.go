@@ -0,0 +1,414 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/pires/go-proxyproto"
+	"go.uber.org/zap"
+)
+
+// serveHealthCheck accepts connections on ln and handles each of them with fn.
+func serveHealthCheck(t *testing.T, ln net.Listener, fn func(net.Conn)) {
+	t.Helper()
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				fn(c)
+			}(c)
+		}
+	}()
+}
+
+// runHealthCheck provisions a, performs one active health check of the peer at addr, and returns its health.
+func runHealthCheck(t *testing.T, a *ActiveHealthChecks, addr string, up *Upstream) bool {
+	t.Helper()
+	parsed, err := caddy.ParseNetworkAddress(addr)
+	if err != nil {
+		t.Fatalf("parsing address: %v", err)
+	}
+	if a.Timeout == 0 {
+		a.Timeout = caddy.Duration(time.Second)
+	}
+	a.logger = zap.NewNop()
+	if err := a.provision(nil); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	p := &peer{address: &parsed}
+	if up == nil {
+		up = &Upstream{}
+	}
+	up.peers = []*peer{p}
+	h := &Handler{HealthChecks: &HealthChecks{Active: a}}
+	if err := h.doActiveHealthCheck(up, p); err != nil {
+		t.Fatalf("active health check: %v", err)
+	}
+	return p.healthy()
+}
+
+// redisLike replies +PONG to PING, and -ERR to anything else.
+func redisLike(c net.Conn) {
+	redisReply(bufio.NewReader(c), c)
+}
+
+func redisReply(r *bufio.Reader, c io.Writer) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if line == "PING\r\n" {
+			_, _ = c.Write([]byte("+PONG\r\n"))
+		} else {
+			_, _ = c.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func TestActiveHealthCheckSteps(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	serveHealthCheck(t, ln, redisLike)
+
+	file := filepath.Join(t.TempDir(), "ping")
+	if err := os.WriteFile(file, []byte("PING\r\n"), 0o600); err != nil {
+		t.Fatalf("writing payload file: %v", err)
+	}
+
+	tests := map[string]struct {
+		steps   []*HealthCheckStep
+		healthy bool
+	}{
+		"text":        {steps: []*HealthCheckStep{{Send: `PING\r\n`}, {Expect: "+PONG"}}, healthy: true},
+		"hex":         {steps: []*HealthCheckStep{{SendHex: "50494e470d0a"}, {ExpectHex: "2b504f4e47"}}, healthy: true},
+		"file":        {steps: []*HealthCheckStep{{SendFile: file}, {ExpectRegexp: `^\+PO+NG\r\n`}}, healthy: true},
+		"multi-step":  {steps: []*HealthCheckStep{{Send: `PING\r\n`}, {Expect: "+PONG"}, {Send: `PING\r\n`}, {Expect: "+PONG"}}, healthy: true},
+		"mismatch":    {steps: []*HealthCheckStep{{Send: `HELLO\r\n`}, {Expect: "+PONG", Timeout: caddy.Duration(200 * time.Millisecond)}}},
+		"consumed":    {steps: []*HealthCheckStep{{Send: `PING\r\n`}, {Expect: "+PONG"}, {Expect: "+PONG", Timeout: caddy.Duration(200 * time.Millisecond)}}},
+		"no response": {steps: []*HealthCheckStep{{Expect: "+PONG", Timeout: caddy.Duration(200 * time.Millisecond)}}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := &ActiveHealthChecks{Steps: tc.steps}
+			if got := runHealthCheck(t, a, ln.Addr().String(), nil); got != tc.healthy {
+				t.Fatalf("healthy = %t, want %t", got, tc.healthy)
+			}
+		})
+	}
+}
+
+func TestActiveHealthCheckBanner(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	serveHealthCheck(t, ln, func(c net.Conn) {
+		_, _ = c.Write([]byte("220 mail.example.com ESMTP ready\r\n"))
+		_, _ = io.Copy(io.Discard, c)
+	})
+
+	a := &ActiveHealthChecks{Steps: []*HealthCheckStep{{ExpectRegexp: `^220 .*ESMTP`}, {Send: `QUIT\r\n`}}}
+	if !runHealthCheck(t, a, ln.Addr().String(), nil) {
+		t.Fatal("expected the SMTP banner check to pass")
+	}
+}
+
+func TestActiveHealthCheckProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	serveHealthCheck(t, ln, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		header, err := proxyproto.Read(r)
+		if err != nil || header.Version != 2 {
+			return
+		}
+		redisReply(r, c)
+	})
+
+	a := &ActiveHealthChecks{ProxyProtocol: "v2", Steps: []*HealthCheckStep{{Send: `PING\r\n`}, {Expect: "+PONG"}}}
+	if !runHealthCheck(t, a, ln.Addr().String(), nil) {
+		t.Fatal("expected the check with a proxy protocol header to pass")
+	}
+
+	a = &ActiveHealthChecks{Steps: []*HealthCheckStep{{Send: `PING\r\n`}, {Expect: "+PONG", Timeout: caddy.Duration(200 * time.Millisecond)}}}
+	if runHealthCheck(t, a, ln.Addr().String(), nil) {
+		t.Fatal("expected the check without a proxy protocol header to fail")
+	}
+}
+
+func TestActiveHealthCheckTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	steps := []*HealthCheckStep{{Send: `GET / HTTP/1.0\r\n\r\n`}, {ExpectRegexp: `^HTTP/1\.. 200`}}
+
+	up := &Upstream{tlsConfig: &tls.Config{InsecureSkipVerify: true}} //nolint:gosec // test server certificate
+	if !runHealthCheck(t, &ActiveHealthChecks{TLS: true, Steps: steps}, addr, up) {
+		t.Fatal("expected the check over TLS to pass")
+	}
+
+	// the default TLS config doesn't trust the test server certificate
+	if runHealthCheck(t, &ActiveHealthChecks{TLS: true, Steps: steps}, addr, nil) {
+		t.Fatal("expected the check over TLS with an untrusted certificate to fail")
+	}
+}
+
+func TestHealthCheckStepProvisionErrors(t *testing.T) {
+	cases := map[string]*HealthCheckStep{
+		"empty":            {},
+		"two actions":      {Send: "a", Expect: "b"},
+		"bad hex":          {SendHex: "zz"},
+		"bad escape":       {Send: `\q`},
+		"bad regexp":       {ExpectRegexp: "("},
+		"missing file":     {SendFile: filepath.Join(t.TempDir(), "missing")},
+		"negative timeout": {Expect: "a", Timeout: -1},
+	}
+	for name, step := range cases {
+		t.Run(name, func(t *testing.T) {
+			if err := step.provision(); err == nil {
+				t.Fatalf("expected an error for %q, got nil", name)
+			}
+		})
+	}
+
+	if err := (&ActiveHealthChecks{ProxyProtocol: "v3"}).provision(nil); err == nil {
+		t.Fatal("expected an error for an invalid proxy protocol version, got nil")
+	}
+}
+
+func TestUnmarshalCaddyfileHealthSteps(t *testing.T) {
+	d := caddyfile.NewTestDispenser("proxy localhost:6379 {\n" +
+		"\thealth_send \"PING\\r\\n\"\n" +
+		"\thealth_expect +PONG 2s\n" +
+		"\thealth_send_hex 0a\n" +
+		"\thealth_expect_regexp ^\\+\n" +
+		"\thealth_tls\n" +
+		"\thealth_proxy_protocol v2\n" +
+		"}")
+	h := new(Handler)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	a := h.HealthChecks.Active
+	if len(a.Steps) != 4 {
+		t.Fatalf("steps = %d, want 4", len(a.Steps))
+	}
+	if a.Steps[0].Send != `PING\r\n` || a.Steps[1].Expect != "+PONG" || a.Steps[2].SendHex != "0a" || a.Steps[3].ExpectRegexp != `^\+` {
+		t.Errorf("unexpected steps: %+v %+v %+v %+v", a.Steps[0], a.Steps[1], a.Steps[2], a.Steps[3])
+	}
+	if a.Steps[1].Timeout != caddy.Duration(2*time.Second) {
+		t.Errorf("Timeout = %v, want 2s", time.Duration(a.Steps[1].Timeout))
+	}
+	if !a.TLS || a.ProxyProtocol != "v2" {
+		t.Errorf("TLS = %t, ProxyProtocol = %q, want true, v2", a.TLS, a.ProxyProtocol)
+	}
+
+	cases := map[string]string{
+		"send timeout":       "proxy localhost:1 {\n\thealth_send PING 1s\n}",
+		"bad expect timeout": "proxy localhost:1 {\n\thealth_expect PONG nope\n}",
+		"duplicate tls":      "proxy localhost:1 {\n\thealth_tls\n\thealth_tls\n}",
+		"missing version":    "proxy localhost:1 {\n\thealth_proxy_protocol\n}",
+	}
+	for name, input := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := new(Handler)
+			if err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+				t.Fatalf("expected an error for %q, got nil", name)
+			}
+		})
+	}
+}
+
+// serveUDPHealthCheck replies to each datagram received on pc with the datagrams returned by fn.
+func serveUDPHealthCheck(t *testing.T, fn func([]byte) [][]byte) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, reply := range fn(buf[:n]) {
+				_, _ = pc.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// closedUDPAddr returns a UDP address nothing listens on.
+func closedUDPAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserving a closed port: %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	_ = pc.Close()
+	return addr
+}
+
+func TestActiveHealthCheckUDP(t *testing.T) {
+	addr := serveUDPHealthCheck(t, func(b []byte) [][]byte {
+		switch string(b) {
+		case "ping":
+			return [][]byte{[]byte("pong")}
+		case "split":
+			return [][]byte{[]byte("po"), []byte("ng")}
+		}
+		return nil
+	})
+	short := caddy.Duration(300 * time.Millisecond)
+
+	tests := map[string]struct {
+		addr    string
+		steps   []*HealthCheckStep
+		healthy bool
+	}{
+		"reply":          {addr: addr, steps: []*HealthCheckStep{{Send: "ping"}, {Expect: "pong"}}, healthy: true},
+		"any reply":      {addr: addr, steps: []*HealthCheckStep{{Send: "ping"}, {ExpectAny: true}}, healthy: true},
+		"no reply":       {addr: addr, steps: []*HealthCheckStep{{Send: "hello"}, {ExpectAny: true, Timeout: short}}},
+		"split reply":    {addr: addr, steps: []*HealthCheckStep{{Send: "split"}, {Expect: "pong", Timeout: short}}},
+		"unmatched":      {addr: addr, steps: []*HealthCheckStep{{Send: "ping"}, {ExpectRegexp: "^ping$", Timeout: short}}},
+		"unreachable":    {addr: closedUDPAddr(t), steps: []*HealthCheckStep{{Send: "ping"}, {ExpectAny: true}}},
+		"empty regexp":   {addr: addr, steps: []*HealthCheckStep{{Send: "hello"}, {ExpectRegexp: ".*", Timeout: short}}},
+		"datagram reply": {addr: addr, steps: []*HealthCheckStep{{Send: "ping"}, {Expect: "po"}, {Expect: "ng", Timeout: short}}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			a := &ActiveHealthChecks{Timeout: caddy.Duration(5 * time.Second), Steps: tc.steps}
+			if got := runHealthCheck(t, a, "udp/"+tc.addr, nil); got != tc.healthy {
+				t.Fatalf("healthy = %t, want %t", got, tc.healthy)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("check took %s, expected it to finish before the health check timeout", elapsed)
+			}
+		})
+	}
+}
+
+func TestActiveHealthCheckUDPFallThreshold(t *testing.T) {
+	parsed, err := caddy.ParseNetworkAddress("udp/" + closedUDPAddr(t))
+	if err != nil {
+		t.Fatalf("parsing address: %v", err)
+	}
+	p := &peer{address: &parsed}
+	a := &ActiveHealthChecks{
+		Timeout: caddy.Duration(time.Second),
+		Fall:    2,
+		Steps:   []*HealthCheckStep{{Send: "ping"}, {ExpectAny: true}},
+		logger:  zap.NewNop(),
+	}
+	if err := a.provision(nil); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	h := &Handler{HealthChecks: &HealthChecks{Active: a}}
+	up := &Upstream{peers: []*peer{p}}
+
+	if err := h.doActiveHealthCheck(up, p); err != nil {
+		t.Fatalf("check 1: %v", err)
+	}
+	if !p.healthy() {
+		t.Fatal("peer should still be healthy after 1 failure with fall=2")
+	}
+	if err := h.doActiveHealthCheck(up, p); err != nil {
+		t.Fatalf("check 2: %v", err)
+	}
+	if p.healthy() {
+		t.Fatal("peer should be unhealthy after 2 failures with fall=2")
+	}
+}
+
+func TestActiveHealthCheckUDPProxyProtocol(t *testing.T) {
+	addr := serveUDPHealthCheck(t, func(b []byte) [][]byte {
+		r := bufio.NewReader(bytes.NewReader(b))
+		header, err := proxyproto.Read(r)
+		if err != nil || header.Version != 2 {
+			return nil
+		}
+		if payload, _ := io.ReadAll(r); string(payload) == "ping" {
+			return [][]byte{[]byte("pong")}
+		}
+		return nil
+	})
+
+	a := &ActiveHealthChecks{ProxyProtocol: "v2", Steps: []*HealthCheckStep{{Send: "ping"}, {Expect: "pong"}}}
+	if !runHealthCheck(t, a, "udp/"+addr, nil) {
+		t.Fatal("expected the check with a proxy protocol header in each datagram to pass")
+	}
+}
+
+func TestActiveHealthCheckUDPRejectsTLS(t *testing.T) {
+	parsed, err := caddy.ParseNetworkAddress("udp/127.0.0.1:53")
+	if err != nil {
+		t.Fatalf("parsing address: %v", err)
+	}
+	up := &Upstream{peers: []*peer{{address: &parsed}}}
+	a := &ActiveHealthChecks{TLS: true, Steps: []*HealthCheckStep{{Send: "ping"}, {ExpectAny: true}}}
+	if err := a.provision(UpstreamPool{up}); err == nil {
+		t.Fatal("expected an error for TLS health checks of a UDP upstream, got nil")
+	}
+}
+
+func TestUnmarshalCaddyfileHealthExpectAny(t *testing.T) {
+	d := caddyfile.NewTestDispenser("proxy udp/localhost:53 {\n\thealth_send_hex 00\n\thealth_expect_any 1s\n}")
+	h := new(Handler)
+	if err := h.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	steps := h.HealthChecks.Active.Steps
+	if len(steps) != 2 || !steps[1].ExpectAny || steps[1].Timeout != caddy.Duration(time.Second) {
+		t.Fatalf("unexpected steps: %+v", steps)
+	}
+
+	d = caddyfile.NewTestDispenser("proxy udp/localhost:53 {\n\thealth_expect_any 1s 2s\n}")
+	if err := new(Handler).UnmarshalCaddyfile(d); err == nil {
+		t.Fatal("expected an error for extra arguments, got nil")
+	}
+}
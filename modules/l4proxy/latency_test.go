@@ -0,0 +1,305 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestLatencyEWMA(t *testing.T) {
+	var e latencyEWMA
+	now := time.Now()
+	if e.get(false, now) != 0 || e.get(true, now) != 0 {
+		t.Fatal("expected zero latency before any samples")
+	}
+
+	e.observe(10*time.Millisecond, now)
+	if e.get(false, now) != float64(10*time.Millisecond) || e.get(true, now) != float64(10*time.Millisecond) {
+		t.Fatalf("first sample: got %v / %v, want 10ms", e.get(false, now), e.get(true, now))
+	}
+
+	// a spike is taken by the peak average at once, but only partially by the plain one
+	now = now.Add(latencyDecay / 10)
+	e.observe(100*time.Millisecond, now)
+	if e.get(true, now) != float64(100*time.Millisecond) {
+		t.Errorf("peak after spike = %v, want 100ms", time.Duration(e.get(true, now)))
+	}
+	if v := e.get(false, now); v <= float64(10*time.Millisecond) || v >= float64(50*time.Millisecond) {
+		t.Errorf("plain average after spike = %v, want between 10ms and 50ms", time.Duration(v))
+	}
+
+	// lower samples bring both averages down over time
+	for range 10 {
+		now = now.Add(latencyDecay)
+		e.observe(10*time.Millisecond, now)
+	}
+	if v := e.get(true, now); v > float64(11*time.Millisecond) {
+		t.Errorf("peak after recovery = %v, want about 10ms", time.Duration(v))
+	}
+
+	// without new samples, both averages decay towards zero
+	now = now.Add(latencyDecay)
+	if v := e.get(false, now); v > float64(4*time.Millisecond) || v <= 0 {
+		t.Errorf("plain average without samples = %v, want about 3.7ms", time.Duration(v))
+	}
+}
+
+func measuredUpstream(latency time.Duration, conns int32) *Upstream {
+	u := healthyUpstream(1)
+	if latency > 0 {
+		u.peers[0].connectLatency.observe(latency, time.Now())
+	}
+	u.peers[0].numConns.Store(conns)
+	return u
+}
+
+func TestLeastLatencySelection(t *testing.T) {
+	near, far := measuredUpstream(2*time.Millisecond, 10), measuredUpstream(40*time.Millisecond, 0)
+	pool := UpstreamPool{far, near}
+	s := new(LeastLatencySelection)
+	for range 10 {
+		if got := s.Select(pool, nil); got != near {
+			t.Fatalf("expected the nearest upstream to be selected, got %v", got)
+		}
+	}
+
+	// an unmeasured upstream is tried first
+	fresh := measuredUpstream(0, 0)
+	if got := s.Select(UpstreamPool{far, near, fresh}, nil); got != fresh {
+		t.Fatalf("expected the unmeasured upstream to be selected, got %v", got)
+	}
+
+	// unavailable upstreams are skipped
+	near.peers[0].setHealthy(false)
+	if got := s.Select(pool, nil); got != far {
+		t.Fatalf("expected the available upstream to be selected, got %v", got)
+	}
+	far.peers[0].setHealthy(false)
+	if got := s.Select(pool, nil); got != nil {
+		t.Fatalf("expected nil when all upstreams are down, got %v", got)
+	}
+}
+
+func TestLeastLatencySelectionRecovery(t *testing.T) {
+	// an upstream which failed a dial a while ago, and one which is being measured
+	failed, busy := healthyUpstream(1), measuredUpstream(5*time.Millisecond, 0)
+	failed.peers[0].connectLatency.observe(dialFailurePenalty, time.Now())
+	pool := UpstreamPool{failed, busy}
+	s := new(LeastLatencySelection)
+	if got := s.Select(pool, nil); got != busy {
+		t.Fatalf("expected the upstream without a failure to be selected, got %v", got)
+	}
+
+	// the stale penalty decays, so the failed upstream is tried again
+	failed.peers[0].connectLatency = latencyEWMA{}
+	failed.peers[0].connectLatency.observe(dialFailurePenalty, time.Now().Add(-6*latencyDecay))
+	if got := s.Select(pool, nil); got != failed {
+		t.Fatalf("expected the upstream with a stale failure to be retried, got %v", got)
+	}
+
+	// and wins once it's measured to have recovered
+	failed.peers[0].connectLatency.observe(time.Millisecond, time.Now())
+	for range 10 {
+		if got := s.Select(pool, nil); got != failed {
+			t.Fatalf("expected the recovered upstream to be selected, got %v", got)
+		}
+	}
+}
+
+func TestLeastLatencySelectionProbesOnce(t *testing.T) {
+	// a known-slow upstream measured long ago, and a fast one measured recently
+	slow, fast := healthyUpstream(1), measuredUpstream(2*time.Millisecond, 0)
+	slow.peers[0].connectLatency.observe(40*time.Millisecond, time.Now().Add(-6*latencyDecay))
+	pool := UpstreamPool{slow, fast}
+	s := new(LeastLatencySelection)
+
+	// the slow upstream's decayed latency wins once, but only the probing connection is sent there
+	var slowSelected int
+	for range 100 {
+		if s.Select(pool, nil) == slow {
+			slowSelected++
+		}
+	}
+	if slowSelected != 1 {
+		t.Fatalf("expected the slow upstream to be selected once, got %d times", slowSelected)
+	}
+
+	// once the probe confirms it's still slow, it isn't selected anymore
+	slow.peers[0].connectLatency.observe(40*time.Millisecond, time.Now())
+	for range 100 {
+		if got := s.Select(pool, nil); got != fast {
+			t.Fatalf("expected the fast upstream to be selected, got %v", got)
+		}
+	}
+}
+
+func TestLatencyEWMAProbeExpires(t *testing.T) {
+	var e latencyEWMA
+	now := time.Now()
+	e.observe(40*time.Millisecond, now)
+
+	// recent samples aren't probed
+	e.startProbe(now.Add(latencyDecay / 2))
+	if v := e.get(false, now.Add(latencyDecay/2)); v >= float64(40*time.Millisecond) {
+		t.Fatalf("expected the recent average to decay, got %v", time.Duration(v))
+	}
+
+	// stale ones don't decay while being probed, until the probe expires
+	now = now.Add(6 * latencyDecay)
+	e.startProbe(now)
+	if v := e.get(false, now); v != float64(40*time.Millisecond) {
+		t.Fatalf("expected the probed average not to decay, got %v", time.Duration(v))
+	}
+	if v := e.get(false, now.Add(latencyDecay)); v >= float64(time.Millisecond) {
+		t.Fatalf("expected the average to decay once the probe expires, got %v", time.Duration(v))
+	}
+}
+
+func TestPeakEWMASelection(t *testing.T) {
+	// the nearer upstream wins while its load is low enough
+	near, far := measuredUpstream(2*time.Millisecond, 5), measuredUpstream(40*time.Millisecond, 0)
+	pool := UpstreamPool{far, near}
+	s := new(PeakEWMASelection)
+	if got := s.Select(pool, nil); got != near {
+		t.Fatalf("expected the nearest upstream to be selected, got %v", got)
+	}
+
+	// and loses once it gets too many active connections
+	near.peers[0].numConns.Store(20)
+	if got := s.Select(pool, nil); got != far {
+		t.Fatalf("expected the less loaded upstream to be selected, got %v", got)
+	}
+
+	// a latency spike moves connections away at once
+	near.peers[0].numConns.Store(0)
+	near.peers[0].firstByteLatency.observe(time.Second, time.Now())
+	if got := s.Select(pool, nil); got != far {
+		t.Fatalf("expected the upstream without a spike to be selected, got %v", got)
+	}
+}
+
+func TestUnmarshalCaddyfileLatencyPolicies(t *testing.T) {
+	for _, policy := range []string{"least_latency", "peak_ewma"} {
+		h := new(Handler)
+		d := caddyfile.NewTestDispenser("proxy {\n\tlb_policy " + policy + "\n\tupstream localhost:5432\n}")
+		if err := h.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("%s: unmarshal: %v", policy, err)
+		}
+		d = caddyfile.NewTestDispenser("proxy {\n\tlb_policy " + policy + " 1\n\tupstream localhost:5432\n}")
+		if err := new(Handler).UnmarshalCaddyfile(d); err == nil {
+			t.Fatalf("%s: expected an error for an extra argument, got nil", policy)
+		}
+	}
+}
+
+// TestHandleRecordsUpstreamLatency ensures Handle measures the connect and
+// first byte latencies of the upstream, and exposes them as metrics.
+func TestHandleRecordsUpstreamLatency(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for echo upstream: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+		_ = c.Close()
+	}()
+
+	parsed, err := caddy.ParseNetworkAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("parsing upstream address: %v", err)
+	}
+
+	h := &Handler{logger: zap.NewNop(), ctx: caddy.Context{Context: context.Background()}}
+	h.metrics = newProxyMetrics(prometheus.NewRegistry())
+	h.LoadBalancing = &LoadBalancing{SelectionPolicy: &LeastLatencySelection{}}
+	p := &peer{address: &parsed, dialAddr: ln.Addr().String()}
+	h.Upstreams = UpstreamPool{{peers: []*peer{p}}}
+
+	downClient, down := newHandleTestConn(t, h)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- h.Handle(down, nil) }()
+
+	if _, err := downClient.Write([]byte("ping")); err != nil {
+		t.Fatalf("writing to downstream: %v", err)
+	}
+	if _, err := io.ReadFull(downClient, make([]byte, 4)); err != nil {
+		t.Fatalf("reading echoed bytes: %v", err)
+	}
+	_ = downClient.Close()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Handle returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle did not return after the downstream connection was closed")
+	}
+
+	if p.connectLatency.get(false, time.Now()) <= 0 || p.firstByteLatency.get(false, time.Now()) <= 0 {
+		t.Fatalf("expected latencies to be measured, got connect %v, first byte %v",
+			p.connectLatency.get(false, time.Now()), p.firstByteLatency.get(false, time.Now()))
+	}
+	if n := testutil.CollectAndCount(h.metrics.upstreamLatency); n != 2 {
+		t.Fatalf("upstream_latency_seconds series = %d, want 2", n)
+	}
+}
+
+// TestHandlePenalizesDialFailure ensures a failed dial raises the peer's connect latency.
+func TestHandlePenalizesDialFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserving a closed port: %v", err)
+	}
+	closedAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	parsed, err := caddy.ParseNetworkAddress(closedAddr)
+	if err != nil {
+		t.Fatalf("parsing upstream address: %v", err)
+	}
+
+	h := &Handler{logger: zap.NewNop(), ctx: caddy.Context{Context: context.Background()}}
+	h.LoadBalancing = &LoadBalancing{SelectionPolicy: &PeakEWMASelection{}}
+	p := &peer{address: &parsed}
+	h.Upstreams = UpstreamPool{{peers: []*peer{p}}}
+
+	_, down := newHandleTestConn(t, h)
+
+	if err := h.Handle(down, nil); err == nil {
+		t.Fatal("expected a dial error when the upstream is unreachable, got nil")
+	}
+	// the penalty has hardly decayed yet
+	if got := p.connectLatency.get(true, time.Now()); got < 0.99*float64(dialFailurePenalty) {
+		t.Fatalf("connect latency after a failed dial = %v, want at least %v", time.Duration(got), dialFailurePenalty)
+	}
+}
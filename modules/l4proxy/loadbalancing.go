@@ -15,11 +15,15 @@
 package l4proxy
 
 import (
+	"cmp"
+	"crypto/md5"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
 	weakrand "math/rand/v2"
 	"net"
+	"slices"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -85,6 +89,9 @@ func init() {
 	caddy.RegisterModule(&WeightedRoundRobinSelection{})
 	caddy.RegisterModule(&FirstSelection{})
 	caddy.RegisterModule(&IPHashSelection{})
+	caddy.RegisterModule(&HashSelection{})
+	caddy.RegisterModule(&LeastLatencySelection{})
+	caddy.RegisterModule(&PeakEWMASelection{})
 }
 
 // RandomSelection is a policy that selects
@@ -479,6 +486,275 @@ func (r *IPHashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// HashSelection is a policy that selects a host based on consistent hashing
+// of a key, which may contain placeholders. Upstreams are placed on a ketama
+// ring with a number of points proportional to their Weight, so that adding,
+// removing or losing an upstream only remaps the keys that belonged to it.
+type HashSelection struct {
+	// The key to hash. Placeholders are replaced for each connection, and unknown
+	// placeholders are replaced with empty strings. Default: `{l4.conn.remote_host}`.
+	Key string `json:"key,omitempty"`
+
+	mu   sync.Mutex
+	ring *hashRing
+}
+
+// CaddyModule returns the Caddy module information.
+func (*HashSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.selection_policies.hash",
+		New: func() caddy.Module { return new(HashSelection) },
+	}
+}
+
+// Provision sets up h.
+func (h *HashSelection) Provision(_ caddy.Context) error {
+	if h.Key == "" {
+		h.Key = hashSelectionKeyDefault
+	}
+	return nil
+}
+
+// Select returns an available host, if any. It walks the ring clockwise
+// from the key's position and returns the first available host it meets.
+func (h *HashSelection) Select(pool UpstreamPool, conn *layer4.Connection) *Upstream {
+	key := h.Key
+	if key == "" {
+		key = hashSelectionKeyDefault
+	}
+	if conn != nil {
+		key = conn.Replacer().ReplaceAll(key, "")
+	}
+
+	h.mu.Lock()
+	if h.ring == nil || !h.ring.builtFrom(pool) {
+		h.ring = newHashRing(pool)
+	}
+	ring := h.ring
+	h.mu.Unlock()
+
+	return ring.lookup(key)
+}
+
+// UnmarshalCaddyfile sets up the HashSelection from Caddyfile tokens. Syntax:
+//
+//	hash [<key>]
+func (h *HashSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line option is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		h.Key = d.Val()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s selection policy: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// hashRing is a ketama consistent hashing ring of upstreams.
+type hashRing struct {
+	pool   []*Upstream
+	points []hashRingPoint
+}
+
+// hashRingPoint is a position of an upstream on a hashRing.
+type hashRingPoint struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// newHashRing places each upstream of pool on a new ring at hashRingPointsPerWeight
+// points per unit of its weight (an unset or non-positive weight is treated as 1).
+// The points are derived from the upstream's dial addresses rather than its index,
+// so that they don't move when other upstreams are added or removed.
+func newHashRing(pool []*Upstream) *hashRing {
+	r := &hashRing{pool: slices.Clone(pool)}
+	for _, up := range pool {
+		weight := up.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		// each md5 digest yields 4 points, as in the original ketama implementation
+		for i := range weight * hashRingPointsPerWeight / 4 {
+			digest := md5.Sum([]byte(up.String() + "-" + strconv.Itoa(i))) //nolint:gosec // not used for security
+			for j := range 4 {
+				r.points = append(r.points, hashRingPoint{
+					hash:     binary.LittleEndian.Uint32(digest[j*4:]),
+					upstream: up,
+				})
+			}
+		}
+	}
+	slices.SortStableFunc(r.points, func(a, b hashRingPoint) int {
+		return cmp.Compare(a.hash, b.hash)
+	})
+	return r
+}
+
+// builtFrom returns true if r has been built from the same upstreams as pool.
+func (r *hashRing) builtFrom(pool []*Upstream) bool {
+	return slices.Equal(r.pool, pool)
+}
+
+// lookup returns the first available upstream at or after the position of key on r.
+func (r *hashRing) lookup(key string) *Upstream {
+	n := len(r.points)
+	if n == 0 {
+		return nil
+	}
+	digest := md5.Sum([]byte(key)) //nolint:gosec // not used for security
+	h := binary.LittleEndian.Uint32(digest[:4])
+	start, _ := slices.BinarySearchFunc(r.points, h, func(p hashRingPoint, t uint32) int {
+		return cmp.Compare(p.hash, t)
+	})
+	for i := range n {
+		if up := r.points[(start+i)%n].upstream; up.available() {
+			return up
+		}
+	}
+	return nil
+}
+
+// LeastLatencySelection is a policy that selects the upstream with the lowest
+// moving average of its connect and first byte latencies. If multiple upstreams
+// have the same lowest latency (e.g. they haven't been measured yet), the one
+// with the least active connections is chosen, or a random one of those.
+type LeastLatencySelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*LeastLatencySelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.selection_policies.least_latency",
+		New: func() caddy.Module { return new(LeastLatencySelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (*LeastLatencySelection) Select(pool UpstreamPool, _ *layer4.Connection) *Upstream {
+	var best *Upstream
+	var count, bestConns int
+	var bestLatency float64
+
+	for _, upstream := range pool {
+		if !upstream.available() {
+			continue
+		}
+		latency, conns := upstream.latency(false), upstream.totalConns()
+		if best == nil || latency < bestLatency || (latency == bestLatency && conns < bestConns) {
+			best, bestLatency, bestConns, count = upstream, latency, conns, 1
+			continue
+		}
+
+		// among hosts with same latency and connections, perform a reservoir
+		// sample: https://en.wikipedia.org/wiki/Reservoir_sampling
+		if latency == bestLatency && conns == bestConns {
+			count++
+			if weakrand.IntN(count) == 0 {
+				best = upstream
+			}
+		}
+	}
+
+	if best != nil {
+		best.probe()
+	}
+	return best
+}
+
+// UnmarshalCaddyfile sets up the LeastLatencySelection from Caddyfile tokens. Syntax:
+//
+//	least_latency
+func (r *LeastLatencySelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s selection policy: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// PeakEWMASelection is a policy that selects the upstream with the lowest cost,
+// i.e. the peak-sensitive moving average of its connect and first byte latencies
+// multiplied by the number of its active connections plus one. Latency spikes
+// move connections away from an upstream at once, while recoveries bring them
+// back gradually. If multiple upstreams have the same lowest cost, one is chosen
+// randomly.
+type PeakEWMASelection struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*PeakEWMASelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.proxy.selection_policies.peak_ewma",
+		New: func() caddy.Module { return new(PeakEWMASelection) },
+	}
+}
+
+// Select returns an available host, if any.
+func (*PeakEWMASelection) Select(pool UpstreamPool, _ *layer4.Connection) *Upstream {
+	var best *Upstream
+	var count int
+	var bestCost float64
+
+	for _, upstream := range pool {
+		if !upstream.available() {
+			continue
+		}
+		cost := upstream.latency(true) * float64(upstream.totalConns()+1)
+		if best == nil || cost < bestCost {
+			best, bestCost, count = upstream, cost, 1
+			continue
+		}
+
+		// among hosts with same cost, perform a reservoir
+		// sample: https://en.wikipedia.org/wiki/Reservoir_sampling
+		if cost == bestCost {
+			count++
+			if weakrand.IntN(count) == 0 {
+				best = upstream
+			}
+		}
+	}
+
+	if best != nil {
+		best.probe()
+	}
+	return best
+}
+
+// UnmarshalCaddyfile sets up the PeakEWMASelection from Caddyfile tokens. Syntax:
+//
+//	peak_ewma
+func (r *PeakEWMASelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// No same-line options are supported
+	if d.CountRemainingArgs() > 0 {
+		return d.ArgErr()
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s selection policy: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
 // leastConns returns the upstream with the
 // least number of active connections to it.
 // If more than one upstream has the same
@@ -525,6 +801,11 @@ func hostByHashing(pool []*Upstream, s string) *Upstream {
 	return upstream
 }
 
+const (
+	hashSelectionKeyDefault = "{l4.conn.remote_host}"
+	hashRingPointsPerWeight = 160
+)
+
 // hash calculates a fast hash based on s.
 func hash(s string) uint32 {
 	h := fnv.New32a()
@@ -541,9 +822,13 @@ var (
 	_ Selector = (*WeightedRoundRobinSelection)(nil)
 	_ Selector = (*FirstSelection)(nil)
 	_ Selector = (*IPHashSelection)(nil)
+	_ Selector = (*HashSelection)(nil)
+	_ Selector = (*LeastLatencySelection)(nil)
+	_ Selector = (*PeakEWMASelection)(nil)
 
 	_ caddy.Validator   = (*RandomChoiceSelection)(nil)
 	_ caddy.Provisioner = (*RandomChoiceSelection)(nil)
+	_ caddy.Provisioner = (*HashSelection)(nil)
 
 	_ caddyfile.Unmarshaler = (*RandomSelection)(nil)
 	_ caddyfile.Unmarshaler = (*RandomChoiceSelection)(nil)
@@ -552,4 +837,7 @@ var (
 	_ caddyfile.Unmarshaler = (*WeightedRoundRobinSelection)(nil)
 	_ caddyfile.Unmarshaler = (*FirstSelection)(nil)
 	_ caddyfile.Unmarshaler = (*IPHashSelection)(nil)
+	_ caddyfile.Unmarshaler = (*HashSelection)(nil)
+	_ caddyfile.Unmarshaler = (*LeastLatencySelection)(nil)
+	_ caddyfile.Unmarshaler = (*PeakEWMASelection)(nil)
 )
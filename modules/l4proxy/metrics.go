@@ -15,9 +15,12 @@
 package l4proxy
 
 import (
-	"errors"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/mholt/caddy-l4/layer4"
 )
 
 // proxyMetrics holds the Prometheus collectors for a proxy handler. They are
@@ -27,51 +30,51 @@ type proxyMetrics struct {
 	connectionsTotal *prometheus.CounterVec
 	activeConns      *prometheus.GaugeVec
 	upstreamHealthy  *prometheus.GaugeVec
-}
+	upstreamReason   *prometheus.GaugeVec
+	upstreamLatency  *prometheus.HistogramVec
 
-// registerOrExisting registers c on reg, or returns the already-registered
-// equivalent collector if an identical one is present. Several proxy handlers
-// in one config share the same instance registry, so the second and subsequent
-// Provision calls must reuse the collectors instead of panicking on a duplicate
-// registration (see issue #445).
-func registerOrExisting[C prometheus.Collector](reg *prometheus.Registry, c C) C {
-	if err := reg.Register(c); err != nil {
-		var are prometheus.AlreadyRegisteredError
-		if errors.As(err, &are) {
-			if existing, ok := are.ExistingCollector.(C); ok {
-				return existing
-			}
-		}
-		// Any other registration error means the metric is unusable; fall back to
-		// the unregistered collector so recording is a harmless no-op rather than
-		// crashing the whole server.
-	}
-	return c
+	// reasons holds the reason each unhealthy upstream is down for
+	reasonsMu sync.Mutex
+	reasons   map[string]string
 }
 
 // newProxyMetrics creates and registers the proxy metrics on reg, reusing any
-// collectors already registered there by another proxy handler.
+// collectors already registered there by another proxy handler (see issue #445).
 func newProxyMetrics(reg *prometheus.Registry) *proxyMetrics {
 	const ns, sub = "caddy", "layer4_proxy"
 	return &proxyMetrics{
-		connectionsTotal: registerOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		connectionsTotal: layer4.RegisterOrExisting(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: ns,
 			Subsystem: sub,
 			Name:      "connections_total",
 			Help:      "Total number of connections proxied, labeled by upstream.",
 		}, []string{"upstream"})),
-		activeConns: registerOrExisting(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		activeConns: layer4.RegisterOrExisting(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: sub,
 			Name:      "active_connections",
 			Help:      "Number of connections currently being proxied, labeled by upstream.",
 		}, []string{"upstream"})),
-		upstreamHealthy: registerOrExisting(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		upstreamHealthy: layer4.RegisterOrExisting(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: sub,
 			Name:      "upstream_healthy",
 			Help:      "Whether an upstream is currently healthy (1) or down (0), per active health checks.",
 		}, []string{"upstream"})),
+		upstreamReason: layer4.RegisterOrExisting(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "upstream_unhealthy_reason",
+			Help:      "Reason an upstream is down per active health checks (1), labeled by upstream and reason. Healthy upstreams have no series.",
+		}, []string{"upstream", "reason"})),
+		upstreamLatency: layer4.RegisterOrExisting(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: sub,
+			Name:      "upstream_latency_seconds",
+			Help:      "Latency of establishing connections to an upstream (connect) and of receiving the first byte from it (first_byte), labeled by upstream and phase.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"upstream", "phase"})),
+		reasons: make(map[string]string),
 	}
 }
 
@@ -92,14 +95,38 @@ func (m *proxyMetrics) connectionClosed(upstream string) {
 	m.activeConns.WithLabelValues(upstream).Dec()
 }
 
-// setUpstreamHealthy records an upstream's current health state.
-func (m *proxyMetrics) setUpstreamHealthy(upstream string, healthy bool) {
+// setUpstreamHealthy records an upstream's current health state, and the reason it's down, if any.
+func (m *proxyMetrics) setUpstreamHealthy(upstream string, healthy bool, reason string) {
 	if m == nil {
 		return
 	}
 	v := 0.0
 	if healthy {
-		v = 1.0
+		v, reason = 1.0, ""
 	}
 	m.upstreamHealthy.WithLabelValues(upstream).Set(v)
+
+	// the series of a new reason is added before the one of the previous reason
+	// is removed, so that an unhealthy upstream always has a reason to scrape
+	m.reasonsMu.Lock()
+	defer m.reasonsMu.Unlock()
+	if reason != "" {
+		m.upstreamReason.WithLabelValues(upstream, reason).Set(1)
+	}
+	if prev := m.reasons[upstream]; prev != "" && prev != reason {
+		m.upstreamReason.DeleteLabelValues(upstream, prev)
+	}
+	if reason != "" {
+		m.reasons[upstream] = reason
+	} else {
+		delete(m.reasons, upstream)
+	}
+}
+
+// observeLatency records an upstream's latency sample in phase.
+func (m *proxyMetrics) observeLatency(upstream, phase string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.upstreamLatency.WithLabelValues(upstream, phase).Observe(d.Seconds())
 }
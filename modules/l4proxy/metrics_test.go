@@ -46,21 +46,38 @@ func TestProxyMetricsConnections(t *testing.T) {
 func TestProxyMetricsHealth(t *testing.T) {
 	m := newProxyMetrics(prometheus.NewRegistry())
 
-	m.setUpstreamHealthy("p1", true)
+	m.setUpstreamHealthy("p1", true, "")
 	if got := testutil.ToFloat64(m.upstreamHealthy.WithLabelValues("p1")); got != 1 {
 		t.Errorf("upstream_healthy = %v, want 1", got)
 	}
-	m.setUpstreamHealthy("p1", false)
+	if got := testutil.CollectAndCount(m.upstreamReason); got != 0 {
+		t.Errorf("upstream_unhealthy_reason series of a healthy upstream = %d, want 0", got)
+	}
+
+	m.setUpstreamHealthy("p1", false, "connect")
+	m.setUpstreamHealthy("p1", false, "steps")
 	if got := testutil.ToFloat64(m.upstreamHealthy.WithLabelValues("p1")); got != 0 {
 		t.Errorf("upstream_healthy = %v, want 0", got)
 	}
+	// only the latest reason has a series
+	if got := testutil.CollectAndCount(m.upstreamReason); got != 1 {
+		t.Errorf("upstream_unhealthy_reason series = %d, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.upstreamReason.WithLabelValues("p1", "steps")); got != 1 {
+		t.Errorf("upstream_unhealthy_reason{reason=steps} = %v, want 1", got)
+	}
+
+	m.setUpstreamHealthy("p1", true, "")
+	if got := testutil.CollectAndCount(m.upstreamReason); got != 0 {
+		t.Errorf("upstream_unhealthy_reason series after recovery = %d, want 0", got)
+	}
 }
 
 func TestProxyMetricsNilSafe(t *testing.T) {
 	var m *proxyMetrics // a handler that was never provisioned
 	m.connectionOpened("x")
 	m.connectionClosed("x")
-	m.setUpstreamHealthy("x", true)
+	m.setUpstreamHealthy("x", true, "")
 }
 
 // TestProxyMetricsDuplicateRegistration reproduces issue #445: multiple proxy
@@ -98,7 +115,7 @@ func TestActiveHealthCheckUpdatesHealthMetricDown(t *testing.T) {
 			logger:  zap.NewNop(),
 		}},
 	}
-	h.metrics.setUpstreamHealthy(p.dialAddr, true) // pretend it was healthy
+	h.metrics.setUpstreamHealthy(p.dialAddr, true, "") // pretend it was healthy
 
 	if err := h.doActiveHealthCheck(&Upstream{peers: []*peer{p}}, p); err != nil {
 		t.Fatalf("health check: %v", err)
@@ -106,6 +123,9 @@ func TestActiveHealthCheckUpdatesHealthMetricDown(t *testing.T) {
 	if got := testutil.ToFloat64(h.metrics.upstreamHealthy.WithLabelValues(p.dialAddr)); got != 0 {
 		t.Errorf("upstream_healthy after failed check = %v, want 0", got)
 	}
+	if got := testutil.ToFloat64(h.metrics.upstreamReason.WithLabelValues(p.dialAddr, "connect")); got != 1 {
+		t.Errorf("upstream_unhealthy_reason{reason=connect} after failed check = %v, want 1", got)
+	}
 }
 
 func TestActiveHealthCheckUpdatesHealthMetricUp(t *testing.T) {
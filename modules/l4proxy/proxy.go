@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -60,6 +61,11 @@ type Handler struct {
 	// Ref: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 	ProxyProtocol string `json:"proxy_protocol,omitempty"`
 
+	// If true, the ID of the downstream connection (i.e. `{l4.conn.id}`) is sent to upstreams
+	// in a PP2_TYPE_UNIQUE_ID TLV of the Proxy Protocol header, so that upstream logs and packet
+	// captures could be correlated with Caddy logs. It requires Proxy Protocol "v2".
+	ProxyProtocolUniqueID bool `json:"proxy_protocol_unique_id,omitempty"`
+
 	proxyProtocolVersion uint8
 
 	metrics *proxyMetrics
@@ -100,6 +106,9 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 	} else if proxyProtocol != "" {
 		return fmt.Errorf("proxy_protocol: \"%s\" should be empty, or one of \"v1\" \"v2\"", proxyProtocol)
 	}
+	if h.ProxyProtocolUniqueID && h.proxyProtocolVersion != 2 {
+		return fmt.Errorf("proxy_protocol_unique_id: requires proxy_protocol \"v2\"")
+	}
 
 	// prepare upstreams
 	if len(h.Upstreams) == 0 {
@@ -131,6 +140,18 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 			if h.HealthChecks.Active.Interval == 0 {
 				h.HealthChecks.Active.Interval = caddy.Duration(30 * time.Second)
 			}
+			if h.HealthChecks.Active.CheckersRaw != nil {
+				mods, err := ctx.LoadModule(h.HealthChecks.Active, "CheckersRaw")
+				if err != nil {
+					return fmt.Errorf("loading active health checkers: %v", err)
+				}
+				for _, mod := range mods.([]any) {
+					h.HealthChecks.Active.checkers = append(h.HealthChecks.Active.checkers, mod.(HealthChecker))
+				}
+			}
+			if err := h.HealthChecks.Active.provision(h.Upstreams); err != nil {
+				return fmt.Errorf("active health checks: %v", err)
+			}
 
 			go h.activeHealthChecker()
 		}
@@ -192,6 +213,7 @@ func (h *Handler) Handle(down *layer4.Connection, _ layer4.Handler) error {
 
 	upstreamLabel := upstream.String()
 	h.metrics.connectionOpened(upstreamLabel)
+	repl.Set(layer4.ProxyUpstreamReplKey, upstreamLabel)
 
 	// if enabled, track these connections on their peers so they can be
 	// force-closed when a peer is marked unhealthy. upConns[i] corresponds to
@@ -217,7 +239,7 @@ func (h *Handler) Handle(down *layer4.Connection, _ layer4.Handler) error {
 	}()
 
 	// finally, proxy the connection
-	h.proxy(down, upConns)
+	h.proxy(down, upstream.peers, upConns)
 
 	return nil
 }
@@ -241,6 +263,21 @@ func (pp *packetProxyProtocolConn) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// firstByteConn calls onFirstByte once the first byte is read from the connection
+type firstByteConn struct {
+	net.Conn
+	once        sync.Once
+	onFirstByte func()
+}
+
+func (fb *firstByteConn) Read(p []byte) (int, error) {
+	n, err := fb.Conn.Read(p)
+	if n > 0 {
+		fb.once.Do(fb.onFirstByte)
+	}
+	return n, err
+}
+
 func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *layer4.Connection) ([]net.Conn, error) {
 	upConns := make([]net.Conn, 0, 10)
 
@@ -286,6 +323,7 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 		}
 		localAddrs := buildLocalAddrs(resolvedLocalAddrs, dialNetwork, destFam, h.logger)
 
+		dialStart := time.Now()
 		if upstream.TLS == nil {
 			up, err = dialWithLocalAddrs(localAddrs, dialNetwork, hostPort)
 		} else {
@@ -324,7 +362,8 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 		h.logger.Debug("dial upstream",
 			zap.String("remote", down.RemoteAddr().String()),
 			zap.String("upstream", hostPort),
-			zap.Error(err))
+			zap.Error(err),
+			down.IDField())
 
 		// Send the PROXY protocol header.
 		if err == nil && h.proxyProtocolVersion > 0 {
@@ -334,6 +373,10 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 			// Only write the PROXY protocol header if it's not nil
 			if header != nil {
 				header.Command = proxyproto.PROXY
+				if h.ProxyProtocolUniqueID {
+					// connection IDs are always short enough to fit into a TLV
+					_ = header.SetTLVs([]proxyproto.TLV{{Type: proxyproto.PP2_TYPE_UNIQUE_ID, Value: []byte(down.ID())}})
+				}
 				// for packet connection, prepend each message with pp
 				// unix connections always implement this interface while not necessarily in datagram mode
 				// ignore it unless the unix socket is in datagram mode
@@ -360,6 +403,7 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 
 		if err != nil {
 			h.countFailure(p)
+			p.connectLatency.observe(max(time.Since(dialStart), dialFailurePenalty), time.Now())
 			for _, conn := range upConns {
 				_ = conn.Close()
 			}
@@ -367,12 +411,14 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 		}
 
 		upConns = append(upConns, up)
+		h.observeLatency(p, latencyPhaseConnect, time.Since(dialStart))
 
 		err = p.countConn(1)
 		if err != nil {
 			h.logger.Error("could not count connection",
 				zap.String("peer_address", p.address.String()),
-				zap.Error(err))
+				zap.Error(err),
+				down.IDField())
 			return upConns, err
 		}
 	}
@@ -381,7 +427,11 @@ func (h *Handler) dialPeers(upstream *Upstream, repl *caddy.Replacer, down *laye
 }
 
 // proxy proxies the downstream connection to all upstream connections.
-func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
+// The peers correspond to the upstream connections, and their first
+// byte latencies are measured from the moment this method is called.
+func (h *Handler) proxy(down *layer4.Connection, peers []*peer, upConns []net.Conn) {
+	established := time.Now()
+
 	// every time we read from downstream, we write
 	// the same to each upstream; this is half of
 	// the proxy duplex
@@ -393,13 +443,26 @@ func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 	var wg sync.WaitGroup
 	var downClosed atomic.Bool
 
-	for _, up := range upConns {
+	for i, up := range upConns {
 		wg.Add(1)
 
 		go func(up net.Conn) {
 			defer wg.Done()
 
-			if _, err := io.Copy(down, up); err != nil {
+			var src net.Conn = up
+			if i < len(peers) {
+				src = &firstByteConn{Conn: up, onFirstByte: func() {
+					h.observeLatency(peers[i], latencyPhaseFirstByte, time.Since(established))
+				}}
+			}
+
+			var err error
+			if down.IsPacket() {
+				err = copyPackets(down, src)
+			} else {
+				_, err = io.Copy(down, src)
+			}
+			if err != nil {
 				// If the downstream connection has been closed, we can assume this is
 				// the reason io.Copy() errored.  That's normal operation for UDP
 				// connections after idle timeout, so don't log an error in that case.
@@ -408,6 +471,7 @@ func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 						zap.String("local_address", up.LocalAddr().String()),
 						zap.String("remote_address", up.RemoteAddr().String()),
 						zap.Error(err),
+						down.IDField(),
 					)
 				}
 			}
@@ -418,8 +482,13 @@ func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 
 	go func() {
 		// read from downstream until connection is closed;
-		// TODO: this pumps the reader, but writing into discard is a weird way to do it; could be avoided if we used io.Pipe - see _gitignore/oldtee.go.txt
-		_, _ = io.Copy(io.Discard, downTee)
+		// datagrams are relayed one by one to keep their boundaries
+		if down.IsPacket() {
+			_ = pumpPackets(down, upConns)
+		} else {
+			// TODO: this pumps the reader, but writing into discard is a weird way to do it; could be avoided if we used io.Pipe - see _gitignore/oldtee.go.txt
+			_, _ = io.Copy(io.Discard, downTee)
+		}
 		downConnClosedCh <- struct{}{}
 
 		// Shut down the writing side of all upstream connections, in case
@@ -453,6 +522,56 @@ func (h *Handler) proxy(down *layer4.Connection, upConns []net.Conn) {
 	<-downConnClosedCh
 }
 
+// pumpPackets reads datagrams from the downstream packet connection
+// and writes each of them to all upstream connections at once.
+func pumpPackets(down *layer4.Connection, upConns []net.Conn) error {
+	buf := make([]byte, layer4.MaxPacketBytes)
+	for {
+		n, err := down.ReadPacket(buf)
+		if err != nil {
+			return err
+		}
+		for _, up := range upConns {
+			if _, err = up.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copyPackets writes the messages read from the upstream connection
+// to the downstream packet connection, one datagram per message.
+func copyPackets(down *layer4.Connection, up net.Conn) error {
+	// upstream datagrams aren't limited by the server socket buffers
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := up.Read(buf)
+		if n > 0 {
+			if _, werr := down.WritePacket(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// observeLatency records a latency sample d of peer p in phase,
+// both in the peer's moving averages and in the metrics.
+func (h *Handler) observeLatency(p *peer, phase string, d time.Duration) {
+	switch phase {
+	case latencyPhaseConnect:
+		p.connectLatency.observe(d, time.Now())
+	case latencyPhaseFirstByte:
+		p.firstByteLatency.observe(d, time.Now())
+	}
+	h.metrics.observeLatency(p.dialAddr, phase, d)
+}
+
 // countFailure is used with passive health checks. It
 // remembers 1 failure for upstream for the configured
 // duration. If passive health checks are disabled or
@@ -514,6 +633,16 @@ func (h *Handler) Cleanup() error {
 //		health_timeout <duration>
 //		health_fall <int>
 //		health_rise <int>
+//		health_send <text>
+//		health_send_hex <hex>
+//		health_send_file <path>
+//		health_expect <text> [<timeout>]
+//		health_expect_hex <hex> [<timeout>]
+//		health_expect_regexp <regexp> [<timeout>]
+//		health_expect_any [<timeout>]
+//		health_tls
+//		health_proxy_protocol <v1|v2>
+//		health_check <name> [<args...>]
 //		close_if_unhealthy
 //
 //		# passive health check options
@@ -527,6 +656,7 @@ func (h *Handler) Cleanup() error {
 //		lb_try_interval <duration>
 //
 //		proxy_protocol <v1|v2>
+//		proxy_protocol_unique_id
 //
 //		# multiple upstream options are supported
 //		upstream [<args...>] {
@@ -545,9 +675,10 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	var (
 		hasHealthInterval, hasHealthPort, hasHealthTimeout  bool // active health check options
 		hasHealthFall, hasHealthRise, hasCloseIfUnhealthy   bool // active health check thresholds
+		hasHealthTLS, hasHealthProxyProtocol                bool // active health check connection options
 		hasFailDuration, hasMaxFails, hasUnhealthyConnCount bool // passive health check options
 		hasLBPolicy, hasLBTryDuration, hasLBTryInterval     bool // load balancing options
-		hasProxyProtocol                                    bool
+		hasProxyProtocol, hasProxyProtocolUniqueID          bool
 	)
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		optionName := d.Val()
@@ -642,6 +773,105 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				h.HealthChecks.Active = &ActiveHealthChecks{}
 			}
 			h.HealthChecks.Active.Rise, hasHealthRise = int(val), true
+		case "health_send", "health_send_hex", "health_send_file",
+			"health_expect", "health_expect_hex", "health_expect_regexp", "health_expect_any":
+			// expectations may be followed by a timeout, and only health_expect_any takes no value
+			minArgs, maxArgs := 1, 1
+			if strings.HasPrefix(optionName, "health_expect") {
+				maxArgs = 2
+			}
+			if optionName == "health_expect_any" {
+				minArgs, maxArgs = 0, 1
+			}
+			if d.CountRemainingArgs() < minArgs || d.CountRemainingArgs() > maxArgs {
+				return d.ArgErr()
+			}
+			if minArgs > 0 {
+				d.NextArg()
+			}
+			step := &HealthCheckStep{}
+			switch optionName {
+			case "health_send":
+				step.Send = d.Val()
+			case "health_send_hex":
+				step.SendHex = d.Val()
+			case "health_send_file":
+				step.SendFile = d.Val()
+			case "health_expect":
+				step.Expect = d.Val()
+			case "health_expect_hex":
+				step.ExpectHex = d.Val()
+			case "health_expect_regexp":
+				step.ExpectRegexp = d.Val()
+			case "health_expect_any":
+				step.ExpectAny = true
+			}
+			if d.NextArg() {
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing %s option '%s' duration: %v", wrapper, optionName, err)
+				}
+				step.Timeout = caddy.Duration(dur)
+			}
+			if h.HealthChecks == nil {
+				h.HealthChecks = &HealthChecks{Active: &ActiveHealthChecks{}}
+			} else if h.HealthChecks.Active == nil {
+				h.HealthChecks.Active = &ActiveHealthChecks{}
+			}
+			h.HealthChecks.Active.Steps = append(h.HealthChecks.Active.Steps, step)
+		case "health_tls":
+			if hasHealthTLS {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 0 {
+				return d.ArgErr()
+			}
+			if h.HealthChecks == nil {
+				h.HealthChecks = &HealthChecks{Active: &ActiveHealthChecks{}}
+			} else if h.HealthChecks.Active == nil {
+				h.HealthChecks.Active = &ActiveHealthChecks{}
+			}
+			h.HealthChecks.Active.TLS, hasHealthTLS = true, true
+		case "health_proxy_protocol":
+			if hasHealthProxyProtocol {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 1 {
+				return d.ArgErr()
+			}
+			d.NextArg()
+			if h.HealthChecks == nil {
+				h.HealthChecks = &HealthChecks{Active: &ActiveHealthChecks{}}
+			} else if h.HealthChecks.Active == nil {
+				h.HealthChecks.Active = &ActiveHealthChecks{}
+			}
+			h.HealthChecks.Active.ProxyProtocol, hasHealthProxyProtocol = d.Val(), true
+		case "health_check":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			checkerName := d.Val()
+
+			unm, err := caddyfile.UnmarshalModule(d, "layer4.proxy.health_checks."+checkerName)
+			if err != nil {
+				return err
+			}
+			hc, ok := unm.(HealthChecker)
+			if !ok {
+				return d.Errf("checker module '%s' is not a health checker", checkerName)
+			}
+			checkerRaw := caddyconfig.JSON(hc, nil)
+
+			checkerRaw, err = layer4.SetModuleNameInline("checker", checkerName, checkerRaw)
+			if err != nil {
+				return d.Errf("re-encoding module '%s' configuration: %v", checkerName, err)
+			}
+			if h.HealthChecks == nil {
+				h.HealthChecks = &HealthChecks{Active: &ActiveHealthChecks{}}
+			} else if h.HealthChecks.Active == nil {
+				h.HealthChecks.Active = &ActiveHealthChecks{}
+			}
+			h.HealthChecks.Active.CheckersRaw = append(h.HealthChecks.Active.CheckersRaw, checkerRaw)
 		case "fail_duration":
 			if hasFailDuration {
 				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
@@ -773,6 +1003,14 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
 			}
 			_, h.ProxyProtocol, hasProxyProtocol = d.NextArg(), d.Val(), true
+		case "proxy_protocol_unique_id":
+			if hasProxyProtocolUniqueID {
+				return d.Errf("duplicate %s option '%s'", wrapper, optionName)
+			}
+			if d.CountRemainingArgs() != 0 {
+				return d.ArgErr()
+			}
+			h.ProxyProtocolUniqueID, hasProxyProtocolUniqueID = true, true
 		case "upstream":
 			u := &Upstream{}
 			if err := u.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
@@ -792,6 +1030,12 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// Phases of upstream latency measurements
+const (
+	latencyPhaseConnect   = "connect"
+	latencyPhaseFirstByte = "first_byte"
+)
+
 // peers is the global repository for peers that are
 // currently in use by active configuration(s). This
 // allows the state of remote hosts to be preserved
@@ -1,6 +1,7 @@
 package l4proxy
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/mholt/caddy-l4/layer4"
+	"github.com/pires/go-proxyproto"
 	"go.uber.org/zap"
 )
 
@@ -677,3 +679,86 @@ func TestHandleProxiesDataToUpstream(t *testing.T) {
 		t.Fatal("Handle did not return after the downstream connection was closed")
 	}
 }
+
+// Ensure dialPeers sends the downstream connection ID in a PROXY protocol v2 TLV, if enabled.
+func TestDialPeersSendsUniqueIDTLV(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for upstream: %v", err)
+	}
+	defer ln.Close()
+
+	headers := make(chan *proxyproto.Header, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, _ := proxyproto.Read(bufio.NewReader(conn))
+		headers <- header
+	}()
+
+	parsedUpstream, err := caddy.ParseNetworkAddress(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("parsing upstream address: %v", err)
+	}
+
+	h := &Handler{logger: zap.NewNop(), ProxyProtocol: "v2", ProxyProtocolUniqueID: true, proxyProtocolVersion: 2}
+	upstream := &Upstream{peers: []*peer{{address: &parsedUpstream}}}
+
+	// the downstream must have TCP addresses for the header to carry them
+	downLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for downstream: %v", err)
+	}
+	defer downLn.Close()
+	downClient, err := net.Dial("tcp", downLn.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing downstream: %v", err)
+	}
+	defer downClient.Close()
+	downServer, err := downLn.Accept()
+	if err != nil {
+		t.Fatalf("accepting downstream: %v", err)
+	}
+	defer downServer.Close()
+	down := layer4.WrapConnection(downServer, nil, h.logger)
+
+	upConns, err := h.dialPeers(upstream, down.Replacer(), down)
+	if err != nil {
+		t.Fatalf("dialPeers: %v", err)
+	}
+	defer upConns[0].Close()
+
+	select {
+	case header := <-headers:
+		if header == nil {
+			t.Fatal("expected a PROXY protocol header")
+		}
+		tlvs, err := header.TLVs()
+		if err != nil {
+			t.Fatalf("parsing TLVs: %v", err)
+		}
+		if len(tlvs) != 1 || tlvs[0].Type != proxyproto.PP2_TYPE_UNIQUE_ID || string(tlvs[0].Value) != down.ID() {
+			t.Fatalf("expected a unique ID TLV with %s, got %+v", down.ID(), tlvs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream did not receive a PROXY protocol header")
+	}
+}
+
+// Ensure the unique ID TLV can't be enabled without PROXY protocol v2.
+func TestProvisionRejectsUniqueIDWithoutProxyProtocolV2(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := &Handler{
+		Upstreams:             UpstreamPool{{Dial: []string{"127.0.0.1:1"}}},
+		ProxyProtocol:         "v1",
+		ProxyProtocolUniqueID: true,
+	}
+	if err := h.Provision(ctx); err == nil || !strings.Contains(err.Error(), "proxy_protocol_unique_id") {
+		t.Fatalf("expected a proxy_protocol_unique_id error, got %v", err)
+	}
+}
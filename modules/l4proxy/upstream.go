@@ -17,11 +17,13 @@ package l4proxy
 import (
 	"crypto/tls"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -88,7 +90,7 @@ type Upstream struct {
 	MaxConnections int `json:"max_connections,omitempty"`
 
 	// Weight is this upstream's relative weight for weighted load-balancing
-	// policies (e.g. weighted_round_robin). A value <= 0 is treated as 1.
+	// policies (e.g. hash, weighted_round_robin). A value <= 0 is treated as 1.
 	Weight int `json:"weight,omitempty"`
 
 	peers             []*peer
@@ -277,6 +279,29 @@ func (u *Upstream) full() bool {
 	return false
 }
 
+// latency returns the latency of this upstream, i.e. the highest sum of the peers'
+// connect and first byte latencies, in nanoseconds. If peak is true, the peak-sensitive
+// moving averages are used instead of the plain ones. It returns 0 until measured.
+func (u *Upstream) latency(peak bool) float64 {
+	var latency float64
+	now := time.Now()
+	for _, p := range u.peers {
+		latency = max(latency, p.connectLatency.get(peak, now)+p.firstByteLatency.get(peak, now))
+	}
+	return latency
+}
+
+// probe must be called once this upstream is selected by its latency. If the latency
+// is stale, the selected connection probes it, and other connections aren't sent here
+// because of its decayed latency until it's measured again.
+func (u *Upstream) probe() {
+	now := time.Now()
+	for _, p := range u.peers {
+		p.connectLatency.startProbe(now)
+		p.firstByteLatency.startProbe(now)
+	}
+}
+
 // totalConns returns the total number of active connections
 // to this upstream (across all peers).
 func (u *Upstream) totalConns() int {
@@ -540,6 +565,12 @@ type peer struct {
 	// populated when HealthChecks.Active.CloseIfUnhealthy is enabled.
 	openConnsMu sync.Mutex
 	openConns   map[net.Conn]struct{}
+
+	// connectLatency and firstByteLatency keep moving averages of the time
+	// it takes to establish connections to this peer, and of the time it takes
+	// for the first byte to arrive from this peer once they are established.
+	connectLatency   latencyEWMA
+	firstByteLatency latencyEWMA
 }
 
 // getNumConns returns the number of active connections with the peer.
@@ -642,5 +673,87 @@ func (p *peer) setHealthy(healthy bool) (bool, error) {
 	return swapped, nil
 }
 
+// latencyEWMA is an exponentially weighted moving average of latency samples.
+// It keeps both a plain average and a peak-sensitive one, which jumps to any
+// sample above it at once and only decays towards lower samples over time.
+type latencyEWMA struct {
+	mu    sync.Mutex
+	value float64
+	peak  float64
+	stamp time.Time
+	// when a probe of the stale average started, if it's being probed
+	probe time.Time
+}
+
+// observe folds a latency sample d taken at now into e. The weight of
+// the previous value decays with the time elapsed since the last sample.
+func (e *latencyEWMA) observe(d time.Duration, now time.Time) {
+	sample := float64(d)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.probe = time.Time{}
+	if e.stamp.IsZero() {
+		e.value, e.peak, e.stamp = sample, sample, now
+		return
+	}
+	w := math.Exp(-float64(max(now.Sub(e.stamp), 0)) / float64(latencyDecay))
+	e.value = e.value*w + sample*(1-w)
+	if sample > e.peak {
+		e.peak = sample
+	} else {
+		e.peak = e.peak*w + sample*(1-w)
+	}
+	e.stamp = now
+}
+
+// get returns the plain or peak-sensitive average of e at now in nanoseconds, or 0 if there are
+// no samples. The average decays towards 0 with the time elapsed since the last sample, so that
+// an upstream isn't starved by a stale high latency (e.g. of a failed dial), but gets selected
+// and measured again eventually. While a probe is in progress, the average doesn't decay, so
+// that only the probing connection is sent to a known-slow upstream.
+func (e *latencyEWMA) get(peak bool, now time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	v := e.value
+	if peak {
+		v = e.peak
+	}
+	if v == 0 || e.probing(now) {
+		return v
+	}
+	return v * math.Exp(-float64(max(now.Sub(e.stamp), 0))/float64(latencyDecay))
+}
+
+// startProbe starts a probe of e at now, if its last sample is older than latencyDecay,
+// and it isn't being probed already. The probe ends once a new sample is observed, or
+// after latencyDecay, e.g. if the probing connection has never been established.
+func (e *latencyEWMA) startProbe(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.stamp.IsZero() || now.Sub(e.stamp) < latencyDecay || e.probing(now) {
+		return
+	}
+	e.probe = now
+}
+
+// probing returns true if e is being probed at now. The caller must hold e.mu.
+func (e *latencyEWMA) probing(now time.Time) bool {
+	return !e.probe.IsZero() && now.Sub(e.probe) < latencyDecay
+}
+
+const (
+	// latencyDecay is the time constant of latency moving averages: the weight of
+	// a sample falls to 1/e of its original value after this long.
+	latencyDecay = 10 * time.Second
+
+	// dialFailurePenalty is the minimum latency recorded for a failed dial,
+	// so that latency-aware policies move away from unreachable peers.
+	dialFailurePenalty = time.Second
+)
+
 // Interface guard
 var _ caddyfile.Unmarshaler = (*Upstream)(nil)
@@ -151,14 +151,16 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 
 // newConn creates a new connection which will handle the PROXY protocol.
 func (h *Handler) newConn(cx *layer4.Connection) *proxyproto.Conn {
+	logger := h.logger.With(cx.IDField())
+
 	// Check policy
 	policy, err := h.policy(proxyproto.ConnPolicyOptions{Upstream: cx.RemoteAddr()})
 	if err != nil {
-		h.logger.Debug("policy check failed", zap.Error(err))
+		logger.Debug("policy check failed", zap.Error(err))
 		return nil
 	}
 	if policy == proxyproto.REJECT {
-		h.logger.Debug("connection rejected by policy")
+		logger.Debug("connection rejected by policy")
 		return nil
 	}
 
@@ -200,9 +202,11 @@ func (h *Handler) newConn(cx *layer4.Connection) *proxyproto.Conn {
 
 // Handle handles the connections.
 func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	logger := h.logger.With(cx.IDField())
+
 	conn := h.newConn(cx)
 	if conn == nil {
-		h.logger.Debug("untrusted party not allowed",
+		logger.Debug("untrusted party not allowed",
 			zap.String("remote", cx.RemoteAddr().String()),
 			zap.Strings("allow", h.Allow),
 		)
@@ -212,22 +216,22 @@ func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	header := conn.ProxyHeader()
 	if header == nil {
 		// No proxy header was present, but that might be okay depending on policy
-		h.logger.Debug("no PROXY header received")
+		logger.Debug("no PROXY header received")
 
 		// check the policy again for the `REQUIRE` case
 		policy, err := h.policy(proxyproto.ConnPolicyOptions{Upstream: cx.RemoteAddr()})
 		if err != nil {
-			h.logger.Debug("policy check in handler failed", zap.Error(err))
+			logger.Debug("policy check in handler failed", zap.Error(err))
 			return nil
 		}
 		if policy == proxyproto.REQUIRE {
-			h.logger.Debug("connection rejected in handler by policy")
+			logger.Debug("connection rejected in handler by policy")
 			return errors.New("PROXY header required but not received")
 		}
 	} else {
-		h.logger.Debug("received PROXY header")
+		logger.Debug("received PROXY header")
 	}
-	h.logger.Debug("connection established",
+	logger.Debug("connection established",
 		zap.String("remote", conn.RemoteAddr().String()),
 		zap.String("local", conn.LocalAddr().String()),
 	)
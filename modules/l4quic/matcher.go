@@ -85,13 +85,18 @@ func (m *MatchQUIC) Match(cx *layer4.Connection) (bool, error) {
 		return false, nil
 	}
 
-	// Read one byte
-	n := 1
-	buf := make([]byte, n)
-	_, err := io.ReadAtLeast(cx, buf, n)
+	// Read a single datagram and validate its length
+	buf := make([]byte, QUICPacketBytesMax+1)
+	n, err := cx.ReadPacket(buf)
+	if errors.Is(err, io.ErrShortBuffer) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
+	if n < QUICPacketBytesMin || n > QUICPacketBytesMax {
+		return false, nil
+	}
 
 	// Ensure the second bit of the first byte is set, i.e. continue if
 	// github.com/quic-go/quic-go/internal/wire.IsPotentialQUICPacket(buf[0]).
@@ -108,14 +113,6 @@ func (m *MatchQUIC) Match(cx *layer4.Connection) (bool, error) {
 		return false, nil
 	}
 
-	// Read the remaining bytes
-	buf = make([]byte, QUICPacketBytesMax+1)
-	buf[0] = qFirstByte
-	n, err = io.ReadAtLeast(cx, buf[1:], 1)
-	if err != nil || n < QUICPacketBytesMin-1 || n == QUICPacketBytesMax {
-		return false, err
-	}
-
 	// Use a workaround to match ALPNs. This way quic.EarlyListener.Accept() exits on deadline
 	// if it receives a packet having an ALPN other than those present in tls.Config.NextProtos.
 	repl := cx.Replacer()
@@ -159,14 +156,18 @@ func (m *MatchQUIC) Match(cx *layer4.Connection) (bool, error) {
 	}()
 
 	// Write the buffered bytes into the pipe
-	_, err = clientFPC.WriteTo(buf[:n+1], nil)
+	_, err = clientFPC.WriteTo(buf[:n], nil)
 	if err != nil {
 		return false, nil
 	}
 
-	// Write more buffered bytes into the pipe, the writer here ensures all frames are likely quic frames based on their lengths
-	_, err = io.CopyBuffer(quicPipeWriter{clientFPC}, cx, buf)
-	if err != nil && !errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+	// Write more buffered datagrams into the pipe, the writer here ensures all of them are likely quic packets based on their lengths
+	for err == nil {
+		if n, err = cx.ReadPacket(buf); err == nil {
+			_, err = quicPipeWriter{clientFPC}.Write(buf[:n])
+		}
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
 		return false, err
 	}
 
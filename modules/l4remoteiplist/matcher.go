@@ -64,15 +64,15 @@ func (m *RemoteIPList) Match(cx *layer4.Connection) (bool, error) {
 	remoteIP, err := m.getRemoteIP(cx)
 	if err != nil {
 		// Error, tread IP as matched
-		m.logger.Error("error parsing the remote IP from the connection", zap.Error(err))
+		m.logger.Error("error parsing the remote IP from the connection", zap.Error(err), cx.IDField())
 		return true, err
 	}
 
 	// IP not matched
-	m.logger.Debug("received request", zap.String("remote_addr", remoteIP.String()))
+	m.logger.Debug("received request", zap.String("remote_addr", remoteIP.String()), cx.IDField())
 
 	if m.remoteIPList.IsMatched(remoteIP) {
-		m.logger.Info("matched IP found", zap.String("remote_addr", remoteIP.String()))
+		m.logger.Info("matched IP found", zap.String("remote_addr", remoteIP.String()), cx.IDField())
 		return true, nil
 	}
 	return false, nil
@@ -0,0 +1,110 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4silence
+
+import (
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchSilence{})
+}
+
+// MatchSilence is able to match connections on which clients have sent no bytes within a window since the start
+// of matching. It is intended for protocols where servers speak first (e.g. FTP, IMAP, MySQL, POP3, SMTP, VNC),
+// so that they could share a port with protocols where clients speak first. Packet connections never match,
+// since they only exist once a client has sent a packet.
+type MatchSilence struct {
+	// Window is the time clients must remain silent for since the start of matching. It must be shorter than
+	// the matching timeout for connections to ever match. Default: 500ms.
+	Window caddy.Duration `json:"window,omitempty"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchSilence) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.silence",
+		New: func() caddy.Module { return new(MatchSilence) },
+	}
+}
+
+// Match returns true if no bytes have been received from the client within m's window.
+func (m *MatchSilence) Match(cx *layer4.Connection) (bool, error) {
+	if cx.IsPacket() || len(cx.MatchingBytes()) > 0 {
+		return false, nil
+	}
+
+	if time.Since(cx.MatchingStartedAt()) < time.Duration(m.Window) {
+		return false, layer4.ErrConsumedAllPrefetchedBytes
+	}
+
+	return true, nil
+}
+
+// MatchingCheckpoints returns m's window, so that routes are re-evaluated once it has elapsed.
+func (m *MatchSilence) MatchingCheckpoints() []time.Duration {
+	return []time.Duration{time.Duration(m.Window)}
+}
+
+// Provision prepares m's internal structures.
+func (m *MatchSilence) Provision(_ caddy.Context) error {
+	if m.Window <= 0 {
+		m.Window = caddy.Duration(WindowDefault)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the MatchSilence from Caddyfile tokens. Syntax:
+//
+//	silence [<window>]
+func (m *MatchSilence) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	_, wrapper := d.Next(), d.Val() // consume wrapper name
+
+	// Only one same-line argument is supported
+	if d.CountRemainingArgs() > 1 {
+		return d.ArgErr()
+	}
+
+	if d.NextArg() {
+		dur, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("parsing %s matcher window: %v", wrapper, err)
+		}
+		m.Window = caddy.Duration(dur)
+	}
+
+	// No blocks are supported
+	if d.NextBlock(d.Nesting()) {
+		return d.Errf("malformed %s matcher: blocks are not supported", wrapper)
+	}
+
+	return nil
+}
+
+// WindowDefault is the default time clients must remain silent for.
+const WindowDefault = 500 * time.Millisecond
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*MatchSilence)(nil)
+	_ caddyfile.Unmarshaler = (*MatchSilence)(nil)
+	_ layer4.ConnMatcher    = (*MatchSilence)(nil)
+	_ layer4.TimedMatcher   = (*MatchSilence)(nil)
+)
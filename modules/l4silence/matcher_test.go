@@ -0,0 +1,102 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4silence
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+// testNeedsMoreMatcher is a data matcher that never has enough data to decide.
+type testNeedsMoreMatcher struct{}
+
+func (*testNeedsMoreMatcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.test_needs_more",
+		New: func() caddy.Module { return new(testNeedsMoreMatcher) },
+	}
+}
+
+func (*testNeedsMoreMatcher) Match(*layer4.Connection) (bool, error) {
+	return false, layer4.ErrConsumedAllPrefetchedBytes
+}
+
+func Test_MatchSilence_Routing(t *testing.T) {
+	caddy.RegisterModule(&testNeedsMoreMatcher{})
+
+	type test struct {
+		data        []byte
+		shouldMatch bool
+	}
+
+	tests := []test{
+		{data: nil, shouldMatch: true},
+		{data: []byte("EHLO example.com\r\n"), shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		// a route of a client-first protocol waits for data before the silence route
+		routes := layer4.RouteList{&layer4.Route{
+			MatcherSetsRaw: []caddy.ModuleMap{{"test_needs_more": json.RawMessage(`{}`)}},
+		}, &layer4.Route{
+			Name:           "silent",
+			MatcherSetsRaw: []caddy.ModuleMap{{"silence": json.RawMessage(`{"window":50000000}`)}},
+		}}
+		if err := routes.Provision(ctx); err != nil {
+			t.Fatalf("test %d: provision failed | %s", i, err)
+		}
+
+		var matched bool
+		handler := routes.Compile(zap.NewNop(), 2*time.Second, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+			routeName, _ := cx.Replacer().GetString("l4.route.name")
+			matched = routeName == "silent"
+			return nil
+		}))
+
+		in, out := net.Pipe()
+		cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+		go func() {
+			if len(tc.data) > 0 {
+				_, _ = in.Write(tc.data)
+			}
+		}()
+
+		start := time.Now()
+		if err := handler.Handle(cx); err != nil {
+			t.Fatalf("test %d: handle failed | %s", i, err)
+		}
+		_ = in.Close()
+		_ = out.Close()
+
+		if matched != tc.shouldMatch {
+			t.Fatalf("test %d: matched = %t, want %t", i, matched, tc.shouldMatch)
+		}
+		// the window is much shorter than the matching timeout
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("test %d: matching took %s", i, elapsed)
+		}
+	}
+}
@@ -37,6 +37,9 @@ type Handler struct {
 	// The primary list of routes to compile and execute.
 	Routes layer4.RouteList `json:"routes,omitempty"`
 
+	// Errors configures routes that handle connections the primary routes have failed to handle.
+	Errors *layer4.ErrorRoutes `json:"errors,omitempty"`
+
 	// Maximum time connections have to complete the matching phase (the first terminal handler is matched). Default: 3s.
 	MatchingTimeout caddy.Duration `json:"matching_timeout,omitempty"`
 
@@ -65,19 +68,37 @@ func (h *Handler) Provision(ctx caddy.Context) error {
 			return fmt.Errorf("setting up subroutes: %v", err)
 		}
 	}
-	return nil
+	return h.Errors.Provision(ctx)
 }
 
 // Handle handles the connections.
 func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
-	subroute := h.Routes.Compile(h.logger, time.Duration(h.MatchingTimeout), next)
-	return subroute.Handle(cx)
+	if h.Errors == nil || len(h.Errors.Routes) == 0 {
+		return h.Routes.Compile(h.logger, time.Duration(h.MatchingTimeout), next).Handle(cx)
+	}
+
+	// the error routes only handle errors of the subroute, so the connection passed through it
+	// is recorded and handed to next once they are done, rather than compiled into the subroute
+	var passed *layer4.Connection
+	passThrough := layer4.HandlerFunc(func(conn *layer4.Connection) error {
+		passed = conn
+		return nil
+	})
+	subroute := h.Routes.Compile(h.logger, time.Duration(h.MatchingTimeout), passThrough)
+	err := h.Errors.Wrap(subroute, h.logger, time.Duration(h.MatchingTimeout), passThrough).Handle(cx)
+	if err != nil || passed == nil {
+		return err
+	}
+	return next.Handle(passed)
 }
 
 // UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
 //
 //	subroute {
 //		matching_timeout <duration>
+//		handle_errors {
+//			<routes>
+//		}
 //		@a <matcher> [<matcher_args>]
 //		@b {
 //			<matcher> [<matcher_args>]
@@ -104,13 +125,32 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		return d.ArgErr()
 	}
 
-	if err := layer4.ParseCaddyfileNestedRoutes(d, &h.Routes, &h.MatchingTimeout, nil); err != nil {
+	if err := layer4.ParseCaddyfileNestedRoutesWithOptions(d, &h.Routes, &h.MatchingTimeout, nil,
+		h.unmarshalCaddyfileOption); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// unmarshalCaddyfileOption sets up the Handler's options other than routes and timeouts from Caddyfile tokens.
+func (h *Handler) unmarshalCaddyfileOption(d *caddyfile.Dispenser, optionName string) (bool, error) {
+	switch optionName {
+	case "handle_errors":
+		if h.Errors != nil {
+			return true, d.Errf("duplicate option '%s'", optionName)
+		}
+		h.Errors = new(layer4.ErrorRoutes)
+		if err := h.Errors.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+			return true, err
+		}
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner     = (*Handler)(nil)
@@ -0,0 +1,92 @@
+package l4subroute
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&testHandler{})
+}
+
+var errTestHandler = errors.New("test handler failed")
+
+// testHandler fails if configured so, or records its invocation otherwise.
+type testHandler struct {
+	Fail bool `json:"fail,omitempty"`
+}
+
+func (*testHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.subroute_test",
+		New: func() caddy.Module { return new(testHandler) },
+	}
+}
+
+func (h *testHandler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	if h.Fail {
+		return errTestHandler
+	}
+	cx.SetVar("error_routes_invoked", true)
+	return nil
+}
+
+func newTestRoutes(fail bool) layer4.RouteList {
+	handler := json.RawMessage(fmt.Sprintf(`{"handler": "subroute_test", "fail": %t}`, fail))
+	return layer4.RouteList{&layer4.Route{HandlersRaw: []json.RawMessage{handler}}}
+}
+
+func TestHandlerErrorRoutesAreScopedToSubroute(t *testing.T) {
+	errNext := errors.New("next handler failed")
+
+	for _, tc := range []struct {
+		name          string
+		routes        layer4.RouteList
+		expectErr     error
+		expectInvoked bool
+		expectNext    bool
+	}{
+		{name: "subroute fails", routes: newTestRoutes(true), expectInvoked: true},
+		{name: "next fails", routes: nil, expectErr: errNext, expectNext: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			h := &Handler{Routes: tc.routes, Errors: &layer4.ErrorRoutes{Routes: newTestRoutes(false)}}
+			if err := h.Provision(ctx); err != nil {
+				t.Fatalf("provision failed | %s", err)
+			}
+
+			in, out := net.Pipe()
+			defer func() { _ = in.Close() }()
+			defer func() { _ = out.Close() }()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			nextCalled := false
+			err := h.Handle(cx, layer4.HandlerFunc(func(*layer4.Connection) error {
+				nextCalled = true
+				return errNext
+			}))
+
+			if !errors.Is(err, tc.expectErr) {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if nextCalled != tc.expectNext {
+				t.Fatalf("expected next to be called: %t", tc.expectNext)
+			}
+			if invoked := cx.GetVar("error_routes_invoked") != nil; invoked != tc.expectInvoked {
+				t.Fatalf("expected the error routes to be invoked: %t", tc.expectInvoked)
+			}
+		})
+	}
+}
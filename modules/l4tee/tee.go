@@ -16,6 +16,7 @@ package l4tee
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net"
 
@@ -87,29 +88,36 @@ func (t *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	// (it also needs a pointer to the pipe, so it can
 	// close the pipe when the connection closes,
 	// otherwise we'll leak the goroutine, yikes!)
-	nextc := *cx
-	nextc.Conn = nextConn{
+	nextc := cx.Wrap(nextConn{
 		Conn:   cx,
-		Reader: io.TeeReader(cx, pw),
+		Reader: io.TeeReader(cx, branchWriter{pw}),
 		pipe:   pw,
-	}
+	})
 
 	// this is the conn we pass to the branch
-	branchc := *cx
-	branchc.Conn = teeConn{
+	branchc := cx.Wrap(teeConn{
 		Conn:   cx,
 		Reader: pr,
-	}
+	})
 
 	// run the branch concurrently
 	go func() {
-		err := t.compiledChain.Handle(&branchc)
+		// a panic in the branch only stops the branch: the pipe
+		// is closed, so that the next handler isn't blocked by it
+		defer func() {
+			if r := recover(); r != nil {
+				branchc.ReportPanic("tee_branch", r)
+				_ = pr.CloseWithError(layer4.ErrPanicked)
+			}
+		}()
+
+		err := t.compiledChain.Handle(branchc)
 		if err != nil {
-			t.logger.Error("handling connection in branch", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err))
+			t.logger.Error("handling connection in branch", zap.String("remote", cx.RemoteAddr().String()), zap.Error(err), cx.IDField())
 		}
 	}()
 
-	return next.Handle(&nextc)
+	return next.Handle(nextc)
 }
 
 // UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
@@ -161,6 +169,20 @@ func (nc nextConn) Read(p []byte) (n int, err error) {
 	return
 }
 
+// branchWriter is a pipe writer that discards writes once
+// the branch has stopped reading from the pipe due to a panic.
+type branchWriter struct {
+	*io.PipeWriter
+}
+
+func (bw branchWriter) Write(p []byte) (int, error) {
+	n, err := bw.PipeWriter.Write(p)
+	if errors.Is(err, layer4.ErrPanicked) {
+		return len(p), nil
+	}
+	return n, err
+}
+
 // Interface guards
 var (
 	_ caddyfile.Unmarshaler = (*Handler)(nil)
@@ -102,7 +102,7 @@ func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	cx.Conn = throttledConn{
 		Conn:         cx.Conn,
 		ctx:          cx.Context,
-		logger:       h.logger.Named("conn"),
+		logger:       h.logger.Named("conn").With(cx.IDField()),
 		totalLimiter: h.totalLimiter,
 		localLimiter: localLimiter,
 	}
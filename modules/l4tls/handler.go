@@ -102,6 +102,7 @@ func (t *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
 	t.logger.Debug("terminated TLS",
 		zap.String("remote", cx.RemoteAddr().String()),
 		zap.String("server_name", clientHello.ServerName),
+		cx.IDField(),
 	)
 
 	// preserve this ClientHello info for later, if needed
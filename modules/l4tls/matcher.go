@@ -184,6 +184,7 @@ func (m *MatchTLS) Match(cx *layer4.Connection) (bool, error) {
 	m.logger.Debug("matched",
 		zap.String("remote", cx.RemoteAddr().String()),
 		zap.String("server_name", chi.ServerName),
+		cx.IDField(),
 	)
 
 	return true, nil
@@ -17,6 +17,7 @@ package l4wireguard
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"strconv"
 
@@ -50,9 +51,12 @@ func (m *MatchWireGuard) CaddyModule() caddy.ModuleInfo {
 
 // Match returns true if the connection looks like WireGuard.
 func (m *MatchWireGuard) Match(cx *layer4.Connection) (bool, error) {
-	// Read a number of bytes
+	// Read a single datagram
 	buf := make([]byte, MessageInitiationBytesTotal+1)
-	n, err := io.ReadAtLeast(cx, buf, 1)
+	n, err := cx.ReadPacket(buf)
+	if errors.Is(err, io.ErrShortBuffer) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}